@@ -9,7 +9,9 @@ import (
 	"strings"
 
 	"github.com/devtio/canary/config"
+	"github.com/devtio/canary/kubernetes"
 	"github.com/devtio/canary/log"
+	"github.com/devtio/canary/rollout"
 	server "github.com/devtio/canary/server"
 	"github.com/devtio/canary/status"
 
@@ -57,16 +59,30 @@ func main() {
 	status.Put(status.CoreVersion, version)
 	status.Put(status.CoreCommitHash, commitHash)
 
+	// Keep the objects canary lists in memory, so requests don't have to query the cluster for them
+	stopCache := make(chan struct{})
+	if client, err := kubernetes.GetClient(); err != nil {
+		log.Errorf("Objects won't be cached, the client can't be created: %v", err)
+	} else {
+		client.StartCache(stopCache)
+	}
+
 	// Start listening to requests
 	server := server.NewServer()
 	server.Start()
 
+	// Start moving the release rollouts through their steps
+	controller := rollout.NewController()
+	controller.Start()
+
 	// wait forever, or at least until we are told to exit
 	waitForTermination()
 
 	// Shutdown internal components
 	log.Info("Shutting down internal components")
+	controller.Stop()
 	server.Stop()
+	close(stopCache)
 }
 
 func waitForTermination() {
@@ -49,6 +49,8 @@ const (
 
 	EnvTokenSecret       = "TOKEN_SECRET"
 	EnvTokenExpirationAt = "TOKEN_EXPIRATION_AT"
+
+	EnvRolloutInterval = "ROLLOUT_INTERVAL_SECONDS"
 )
 
 // Global configuration for the application.
@@ -95,6 +97,21 @@ type Products struct {
 	Jaeger               JaegerConfig  `yaml:"jaeger,omitempty"`
 }
 
+// RolloutConfig describes how often the release rollouts are moved to their next step
+type RolloutConfig struct {
+	Interval int `yaml:"interval_seconds,omitempty"`
+}
+
+// ClusterConfig names a cluster releases can target, by its context in the kubeconfig.
+// Releases are applied to their clusters in the order of the configuration.
+// An empty context is the cluster canary runs in.
+// PrometheusServiceURL is the Prometheus the rollout analysis queries in the cluster, the global one when empty.
+type ClusterConfig struct {
+	Name                 string `yaml:"name"`
+	Context              string `yaml:"context,omitempty"`
+	PrometheusServiceURL string `yaml:"prometheus_service_url,omitempty"`
+}
+
 type Token struct {
 	Secret       []byte `yaml:"secret,omitempty"`
 	ExpirationAt int64  `yaml:"expiration,omitempty"`
@@ -109,6 +126,8 @@ type Config struct {
 	VersionFilterLabelName string            `yaml:"version_filter_label_name,omitempty"`
 	Products               Products          `yaml:"products,omitempty"`
 	Token                  Token             `yaml:"token,omitempty"`
+	Rollout                RolloutConfig     `yaml:"rollout,omitempty"`
+	Clusters               []ClusterConfig   `yaml:"clusters,omitempty"`
 }
 
 // NewConfig creates a default Config struct
@@ -156,6 +175,9 @@ func NewConfig() (c *Config) {
 	c.Token.Secret = []byte(strings.TrimSpace(getDefaultString(EnvTokenSecret, "devtio")))
 	c.Token.ExpirationAt = getDefaultInt64(EnvTokenExpirationAt, 36000)
 
+	// Rollout Configuration
+	c.Rollout.Interval = getDefaultInt(EnvRolloutInterval, 10)
+
 	return
 }
 
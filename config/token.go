@@ -74,3 +74,16 @@ func ValidateToken(tokenString string) error {
 	}
 	return nil
 }
+
+// TokenUser returns the username of a token generated by GenerateToken.
+// It returns an error if the token isn't valid.
+func TokenUser(tokenString string) (string, error) {
+	claim := TokenClaim{}
+	_, err := jwt.ParseWithClaims(tokenString, &claim, func(token *jwt.Token) (interface{}, error) {
+		return Get().Token.Secret, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return claim.User, nil
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	istioclient "github.com/devtio/canary/kubernetes"
+	models "github.com/devtio/canary/models"
+	"github.com/devtio/canary/releases"
+	"github.com/gorilla/mux"
+)
+
+// CreateReleaseDeployments creates the Deployments of the release's versions of its apps in its clusters,
+// cloned from the Deployments of the stable versions with a new image.
+// The release's rules are removed until the Deployments are ready, the rollout controller then adds them again
+// and restarts its rollout, and rolling back or deleting the release deletes them.
+func CreateReleaseDeployments(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	releaseID := vars["releaseId"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var deployments []models.Deployment
+	if err := json.NewDecoder(r.Body).Decode(&deployments); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Deployments can't be decoded: "+err.Error())
+		return
+	}
+	managed, err := releases.GetManagedVirtualServices(client, namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	store := releases.NewConfigMapStore(client)
+	stored, err := store.List(namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	release, ok := releases.WithStatus(releases.Releases(managed), stored)[releaseID]
+	if !ok {
+		RespondWithError(w, http.StatusNotFound, fmt.Sprintf("Release %s not found in namespace %s", releaseID, namespace))
+		return
+	}
+	if release.Status != nil && release.Status.Phase == releases.PhaseRolledBack {
+		RespondWithError(w, http.StatusConflict, fmt.Sprintf("Release %s was rolled back", releaseID))
+		return
+	}
+	if fields := releases.ValidateDeployments(release, deployments); len(fields) > 0 {
+		RespondWithJSON(w, http.StatusBadRequest, models.ValidationError{Error: "Deployments are invalid", Fields: fields})
+		return
+	}
+	clusters, err := releases.ReleaseClusters(release, client)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !checkMaintenanceWindows(w, r, client, namespace) {
+		return
+	}
+
+	result, err := releases.Deploy(client, clusters, namespace, release, deployments)
+	saveEvent(client, namespace, releaseID, deployedEvent(r, result, deployments, err))
+	if err != nil {
+		respondWithDeployError(w, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusCreated, result)
+}
+
+// deployedEvent returns the event of creating the deployments of a release, with the changes removing its rules until they are ready
+func deployedEvent(r *http.Request, result models.ReleaseResult, deployments []models.Deployment, err error) models.ReleaseEvent {
+	event := releases.NewEvent(releases.ActionDeployed, requestUser(r), result.VirtualServices, err)
+	if err != nil {
+		return event
+	}
+	names := []string{}
+	for _, deployment := range result.Release.Deployments {
+		for _, requested := range deployments {
+			if deployment.App == requested.App {
+				names = append(names, fmt.Sprintf("%s with image %s", deployment.Name, deployment.Image))
+			}
+		}
+	}
+	event.Message = "Created deployments " + strings.Join(names, ", ") + ", the release waits until they are ready"
+	return event
+}
+
+// respondWithDeployError responds with the error of creating the deployments of a release,
+// as a conflict when a Deployment of a version of the release already exists
+func respondWithDeployError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.IsAlreadyExists(err) {
+		status = http.StatusConflict
+	}
+	RespondWithError(w, status, "Deployments can't be created: "+err.Error())
+}
+
+// checkDeployments answers with a 409 and returns false if the Deployments canary created for the release aren't ready yet,
+// as no traffic is shifted to the release's versions before they are
+func checkDeployments(w http.ResponseWriter, clusters []releases.Cluster, namespace string, release models.Release) bool {
+	reason, err := releases.DeploymentsReady(clusters, namespace, release)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	if reason != "" {
+		RespondWithError(w, http.StatusConflict, fmt.Sprintf("Release %s waits for its deployments: %s", release.ID, reason))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	istioclient "github.com/devtio/canary/kubernetes"
+	models "github.com/devtio/canary/models"
+	"github.com/devtio/canary/releases"
+	"github.com/gorilla/mux"
+)
+
+// ListExperiments returns the experiments injecting faults in the releases of a namespace, sorted by id
+func ListExperiments(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	experiments, err := releases.NewConfigMapExperimentStore(client).List(namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, experiments)
+}
+
+// CreateExperiment injects the faults of an experiment in the rules of a release, or of the releases targeting a traffic segment,
+// until it expires and the rollout controller removes them
+func CreateExperiment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var experiment models.Experiment
+	if err := json.NewDecoder(r.Body).Decode(&experiment); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Experiment can't be decoded: "+err.Error())
+		return
+	}
+	if fields := releases.ValidateExperiment(experiment); len(fields) > 0 {
+		RespondWithJSON(w, http.StatusBadRequest, models.ValidationError{Error: "Experiment is invalid", Fields: fields})
+		return
+	}
+	existing, err := releases.NewConfigMapExperimentStore(client).Get(namespace, experiment.ID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if existing != nil {
+		RespondWithError(w, http.StatusConflict, fmt.Sprintf("Experiment %s already exists in namespace %s", experiment.ID, namespace))
+		return
+	}
+
+	managed, err := releases.GetManagedVirtualServices(client, namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	stored, err := releases.NewConfigMapStore(client).List(namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	targets := releases.ExperimentTargets(releases.WithStatus(releases.Releases(managed), stored), experiment)
+	if len(targets) == 0 {
+		field := models.FieldError{Field: "release", Message: fmt.Sprintf("release %s not found", experiment.Release)}
+		if experiment.Segment != "" {
+			field = models.FieldError{Field: "segment", Message: fmt.Sprintf("no release targets traffic segment %s", experiment.Segment)}
+		}
+		RespondWithJSON(w, http.StatusUnprocessableEntity, models.ValidationError{Error: "Experiment has no release to inject faults in", Fields: []models.FieldError{field}})
+		return
+	}
+	clusters, err := releases.ExperimentClusters(targets, client)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// a rule injects a single fault
+	for _, cluster := range clusters {
+		clusterManaged, err := releases.GetManagedVirtualServices(cluster.Client, namespace)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, release := range targets {
+			if running := releases.FaultingExperiment(clusterManaged, release.ID); running != "" {
+				RespondWithError(w, http.StatusConflict, fmt.Sprintf("Experiment %s already injects faults in release %s", running, release.ID))
+				return
+			}
+		}
+	}
+	if !checkMaintenanceWindows(w, r, client, namespace) {
+		return
+	}
+
+	for _, release := range targets {
+		experiment.Releases = append(experiment.Releases, release.ID)
+	}
+	experiment.User = requestUser(r)
+	releases.StartExperiment(&experiment, time.Now())
+	changes, err := releases.ApplyExperiment(client, clusters, namespace, experiment)
+	for _, releaseID := range experiment.Releases {
+		event := releases.NewEvent(releases.ActionFaultsInjected, experiment.User, changes, err)
+		if err == nil {
+			event.Message = fmt.Sprintf("Experiment %s injects faults until %s", experiment.ID, experiment.ExpiresAt.Format(time.RFC3339))
+		}
+		saveEvent(client, namespace, releaseID, event)
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.IsConflict(err) {
+			status = http.StatusConflict
+		}
+		RespondWithError(w, status, "Experiment can't be started: "+err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusCreated, experiment)
+}
+
+// DeleteExperiment removes the faults of an experiment before it expires
+func DeleteExperiment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	experimentID := vars["experimentId"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	experiment, err := releases.NewConfigMapExperimentStore(client).Get(namespace, experimentID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if experiment == nil {
+		RespondWithError(w, http.StatusNotFound, fmt.Sprintf("Experiment %s not found in namespace %s", experimentID, namespace))
+		return
+	}
+	changes, err := releases.EndExperiment(client, namespace, *experiment)
+	for _, releaseID := range experiment.Releases {
+		event := releases.NewEvent(releases.ActionFaultsRemoved, requestUser(r), changes, err)
+		if err == nil {
+			event.Message = fmt.Sprintf("Experiment %s ended", experimentID)
+		}
+		saveEvent(client, namespace, releaseID, event)
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Experiment can't be ended: "+err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, experiment)
+}
@@ -12,7 +12,7 @@ func ListGateways(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	namespace := vars["namespace"]
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	client, err := istioclient.NewClient()
+	client, err := istioclient.GetClient()
 
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
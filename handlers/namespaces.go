@@ -10,7 +10,7 @@ import (
 // ServiceList is the API handler to fetch the list of services in a given namespace
 func ListNamespaces(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	client, err := istioclient.NewClient()
+	client, err := istioclient.GetClient()
 
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
@@ -14,7 +14,7 @@ func ListPods(w http.ResponseWriter, r *http.Request) {
 	release := vars["release"]
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	client, err := istioclient.NewClient()
+	client, err := istioclient.GetClient()
 
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
@@ -3,157 +3,81 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"sync"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/devtio/canary/config"
+	"github.com/devtio/canary/jaeger"
 	istioclient "github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/log"
 	models "github.com/devtio/canary/models"
+	"github.com/devtio/canary/releases"
 	"github.com/gorilla/mux"
-	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 )
 
 func ListReleases(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	namespace := vars["namespace"]
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	client, err := istioclient.NewClient()
+	client, err := istioclient.GetClient()
 
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	// first get virtual services
-	fmt.Println("Calling GET virtual services for namespace ", namespace)
-	virtualServices, err2 := client.GetVirtualServices(namespace, "")
-	if err2 != nil {
-		fmt.Println("Error occurred in getting virtual services", err2)
+	managed, err := releases.GetManagedVirtualServices(client, namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	fmt.Println("Virtual services retrieved: ", len(virtualServices))
-	releases := map[string]models.Release{}
-	// iterate over virtual services
-	for _, vs := range virtualServices {
-		// get metadata
-		meta := vs.GetObjectMeta()
-		labels := meta.GetLabels()
-
-		isManagedByDevtio, isManagedByDevtioPresent := labels["io.devtio.canary/managed"]
+	stored, err := releases.NewConfigMapStore(client).List(namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(releases.WithStatus(releases.Releases(managed), stored))
+}
 
-		if !isManagedByDevtioPresent || isManagedByDevtio == "false" {
-			fmt.Println("VirtualService is not managed by devtio, skipping...")
-			continue
-		}
+func GetRelease(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	releaseID := vars["releaseId"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
 
-		// get the object spec
-		spec := vs.GetSpec()
-		// very long nested structure to get the required fields from the virtual service spec
-		hosts := spec["hosts"].([]interface{})
-		var hostsStringArray []string
-		for _, host := range hosts {
-			hostsStringArray = append(hostsStringArray, host.(string))
-		}
-		https, httpsPresent := spec["http"].([]interface{})
-		// first get the release label
-		if httpsPresent {
-			for _, http := range https {
-				httpMap, isHTTPMap := http.(map[string]interface{})
-				if isHTTPMap {
-					// get top-level hosts
-					appendHeaders, appendHeadersPresent := httpMap["appendHeaders"].(map[string]interface{})
-					if appendHeadersPresent {
-						devtioHeader, devtioHeaderPresent := appendHeaders["devtio"].(string)
-						if devtioHeaderPresent {
-							fmt.Println("Top level hosts of release: ", devtioHeader, " are: ", hosts)
-							// add to release map to return
-							release, releasePresent := releases[devtioHeader]
-							fmt.Println(releasePresent)
-							if releasePresent {
-								release.Gateway.Hosts = hostsStringArray
-							} else {
-								release = models.Release{
-									ID:   devtioHeader,
-									Name: devtioHeader,
-									Gateway: models.Gateway{
-										Hosts: hostsStringArray,
-									},
-								}
-							}
-							releases[devtioHeader] = release
-						}
-					}
-
-					// read route section
-					app, version := "", ""
-					routes, routesPresent := httpMap["route"].([]interface{})
-					if routesPresent {
-						for _, route := range routes {
-							routeMap, isRouteMap := route.(map[string]interface{})
-							if isRouteMap {
-								destination, destinationPresent := routeMap["destination"].(map[string]interface{})
-								if destinationPresent {
-									app, _ = destination["host"].(string)
-									version, _ = destination["subset"].(string)
-								}
-							}
-						}
-					}
-
-					// read matches section
-					matches, matchesPresent := httpMap["match"].([]interface{})
-					if matchesPresent {
-						for _, match := range matches {
-							matchMap, isMatchMap := match.(map[string]interface{})
-							if isMatchMap {
-								headers, headersPresent := matchMap["headers"].(map[string]interface{})
-								if headersPresent {
-									devtio, devtioPresent := headers["devtio"].(map[string]interface{})
-									if devtioPresent {
-										headerExact, headerExactPresent := devtio["exact"].(string)
-										if headerExactPresent {
-											fmt.Println("Found release, id: ", headerExact)
-											fmt.Println("Hosts: ", hosts)
-											// get labels
-											fmt.Println("app: ", app, ", version: ", version)
-											// add to release map to return
-											release, releasePresent := releases[headerExact]
-											app := models.App{
-												Hosts: hostsStringArray,
-												Labels: models.Labels{
-													"app":     app,
-													"version": version,
-												},
-											}
-
-											if releasePresent {
-												release.Apps = append(release.Apps, app)
-											} else {
-												release = models.Release{
-													ID:   headerExact,
-													Name: headerExact,
-													Apps: []models.App{app},
-												}
-											}
-											releases[headerExact] = release
-										}
-									}
-								}
-							}
-						}
-					}
-				}
-			}
-		}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
+	managed, err := releases.GetManagedVirtualServices(client, namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
-	json.NewEncoder(w).Encode(releases)
+	stored, err := releases.NewConfigMapStore(client).List(namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	release, ok := releases.WithStatus(releases.Releases(managed), stored)[releaseID]
+	if !ok {
+		RespondWithError(w, http.StatusNotFound, fmt.Sprintf("Release %s not found in namespace %s", releaseID, namespace))
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, release)
 }
 
 func CreateRelease(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	namespace := vars["namespace"]
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	client, err := istioclient.NewClient()
+	client, err := istioclient.GetClient()
 
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
@@ -162,156 +86,659 @@ func CreateRelease(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Println("Decoding request body into Release Object")
 	var release models.Release
-	json.NewDecoder(r.Body).Decode(&release)
+	if err := json.NewDecoder(r.Body).Decode(&release); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Release can't be decoded: "+err.Error())
+		return
+	}
 	fmt.Println("Decoded release: ", release)
+	// the Deployments of a new release are created by canary, the release's rules wait until they are ready
+	deployments := release.Deployments
+	release.Deployments = nil
+	clusters, ok := validateRelease(w, client, namespace, release, true)
+	if !ok {
+		return
+	}
+	if len(deployments) > 0 {
+		if fields := releases.ValidateDeployments(release, deployments); len(fields) > 0 {
+			RespondWithJSON(w, http.StatusBadRequest, models.ValidationError{Error: "Deployments are invalid", Fields: fields})
+			return
+		}
+	}
+	if err := releases.ResolveSegment(releases.NewConfigMapSegmentStore(client), namespace, &release); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	releases.StartRollout(&release, time.Now())
 
-	// We need to modify the existing gateway virtualservice
-	// So for every http route in the existing virtualservice, if the destination host service has a version defined in our release object, then we change the subset to equal that version?
-	// and append the devtio release header
+	if isDryRun(r) {
+		previewRelease(w, clusters, namespace, release, releases.CreateChange(release))
+		return
+	}
+	if !checkMaintenanceWindows(w, r, client, namespace) {
+		return
+	}
+	if len(deployments) > 0 {
+		result, err := releases.Deploy(client, clusters, namespace, release, deployments)
+		saveEvent(client, namespace, release.ID, deployedEvent(r, result, deployments, err))
+		if err != nil {
+			respondWithDeployError(w, err)
+			return
+		}
+		RespondWithJSON(w, http.StatusAccepted, result)
+		return
+	}
+	result, err := releases.Create(client, clusters, namespace, release)
+	recordEvent(client, r, namespace, release.ID, releases.ActionCreated, result.VirtualServices, err)
+	if err != nil {
+		respondWithUpdateError(w, result, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusCreated, result)
+}
 
-	// first get virtual services
-	fmt.Println("Calling GET virtual services for namespace ", namespace)
-	virtualServices, err2 := client.GetVirtualServices(namespace, "")
-	if err2 != nil {
-		fmt.Println("Error occurred in getting virtual services", err2)
+func UpdateRelease(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	releaseID := vars["releaseId"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	fmt.Println("Virtual services retrieved: ", len(virtualServices))
-	// iterate over virtual services
-	for _, vs := range virtualServices {
-		// get metadata
-		meta := vs.GetObjectMeta()
-		labels := meta.GetLabels()
 
-		isManagedByDevtio, isManagedByDevtioPresent := labels["io.devtio.canary/managed"]
+	var release models.Release
+	if err := json.NewDecoder(r.Body).Decode(&release); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Release can't be decoded: "+err.Error())
+		return
+	}
+	if release.ID != "" && release.ID != releaseID {
+		RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Release id %s doesn't match the release %s being updated", release.ID, releaseID))
+		return
+	}
+	release.ID = releaseID
 
-		if !isManagedByDevtioPresent || isManagedByDevtio == "false" {
-			fmt.Println("VirtualService is not managed by devtio, skipping...")
-			continue
+	managed, err := releases.GetManagedVirtualServices(client, namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	stored, err := releases.NewConfigMapStore(client).List(namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// a release applied to other clusters only is only found in the store
+	previous, ok := releases.WithStatus(releases.Releases(managed), stored)[releaseID]
+	if !ok {
+		RespondWithError(w, http.StatusNotFound, fmt.Sprintf("Release %s not found in namespace %s", releaseID, namespace))
+		return
+	}
+	if releases.IsDeploying(previous) {
+		RespondWithError(w, http.StatusConflict, fmt.Sprintf("Release %s waits for its deployments", releaseID))
+		return
+	}
+	// the Deployments canary created are kept, they are only created with CreateReleaseDeployments
+	release.Deployments = previous.Deployments
+	if err := releases.CanUpdateDeployments(previous, release); err != nil {
+		RespondWithError(w, http.StatusConflict, "Release can't be updated: "+err.Error())
+		return
+	}
+	targets, ok := validateRelease(w, client, namespace, release, false)
+	if !ok {
+		return
+	}
+	clusters, err := releases.UpdateClusters(previous, release, client)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := releases.ResolveSegment(releases.NewConfigMapSegmentStore(client), namespace, &release); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	releases.StartRollout(&release, time.Now())
+	// replace the rules of the previous version of the release, restarting its rollout, and keep the faults of a running experiment,
+	// the clusters the release no longer targets only lose the previous rules
+	change := func(cluster releases.Cluster, vs *releases.VirtualService) bool {
+		experimentID, fault := releases.ReleaseFault(vs, releaseID)
+		removed := releases.RemoveReleaseRules(vs, previous)
+		if !releases.Targets(release, cluster) {
+			return removed
 		}
+		added := releases.AddRelease(vs, release)
+		weighted := release.Status != nil && releases.SetWeight(vs, release, release.Status.Weight)
+		if experimentID != "" {
+			releases.AddFault(vs, releaseID, experimentID, fault)
+		}
+		return removed || added || weighted
+	}
+	if isDryRun(r) {
+		previewRelease(w, clusters, namespace, release, change)
+		return
+	}
+	if !checkMaintenanceWindows(w, r, client, namespace) {
+		return
+	}
+	if err := releases.AddClusterSubsets(targets, namespace, release); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	statuses, changes, err := releases.ApplyToClusters(clusters, namespace, change)
+	recordEvent(client, r, namespace, releaseID, releases.ActionUpdated, changes, err)
+	result := releases.NewReleaseResult(release, statuses, changes)
+	if err != nil {
+		releases.RemoveClusterSubsets(targets, namespace, release)
+		respondWithUpdateError(w, result, err)
+		return
+	}
+	releases.RemoveClusterSubsets(clusters, namespace, previous)
+	releases.SetClusterStatuses(&result.Release, statuses)
+	if err := releases.StoreRelease(releases.NewConfigMapStore(client), namespace, result.Release); err != nil {
+		respondWithUpdateError(w, result, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, result)
+}
+
+func DeleteRelease(w http.ResponseWriter, r *http.Request) {
+	removeRelease(w, r, releases.ActionDeleted)
+}
+
+// RollbackRelease sends the release's traffic back to the versions that served it before the release.
+func RollbackRelease(w http.ResponseWriter, r *http.Request) {
+	removeRelease(w, r, releases.ActionRolledBack)
+}
 
-		// get the object spec
-		spec := vs.GetSpec()
-		hosts := spec["hosts"].([]interface{})
-		_, gatewaysPresent := spec["gateways"].([]interface{})
-		var hostsStringArray []string
-		for _, host := range hosts {
-			hostsStringArray = append(hostsStringArray, host.(string))
+// removeRelease removes the rules of a release from every managed virtual service of its clusters, leaving the other rules untouched,
+// stops its rollout and deletes the Deployments canary created for it
+func removeRelease(w http.ResponseWriter, r *http.Request, action string) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	releaseID := vars["releaseId"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	managed, err := releases.GetManagedVirtualServices(client, namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	store := releases.NewConfigMapStore(client)
+	stored, err := store.List(namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// a release rolled back by its analysis is only left in the store
+	release, ok := releases.WithStatus(releases.Releases(managed), stored)[releaseID]
+	if !ok {
+		RespondWithError(w, http.StatusNotFound, fmt.Sprintf("Release %s not found in namespace %s", releaseID, namespace))
+		return
+	}
+	clusters, err := releases.ReleaseClusters(release, client)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	change := func(cluster releases.Cluster, vs *releases.VirtualService) bool {
+		if action == releases.ActionDeleted {
+			return releases.DeleteReleaseRules(vs, release)
 		}
-		https, httpsPresent := spec["http"].([]interface{})
-		// first get the release label
-		if httpsPresent {
-			appsToAddToGatewayVirtualService := map[string]string{}
-			appsToAddToHostVirtualService := map[string]string{}
-			for _, http := range https {
-				httpMap, isHTTPMap := http.(map[string]interface{})
-				if isHTTPMap {
-					// read route section
-					app := ""
-					routes, routesPresent := httpMap["route"].([]interface{})
-					if routesPresent {
-						for _, route := range routes {
-							routeMap, isRouteMap := route.(map[string]interface{})
-							if isRouteMap {
-								destination, destinationPresent := routeMap["destination"].(map[string]interface{})
-								if destinationPresent {
-									app, _ = destination["host"].(string)
-								}
-							}
-						}
-					}
-					for _, appInRelease := range release.Apps {
-						appInReleaseID, appLabelPresent := appInRelease.Labels["app"]
-						versionInRelease := appInRelease.Labels["version"]
-						if appLabelPresent && appInReleaseID == app {
-							// gateway-bound vs has top level gateways in spec
-							if gatewaysPresent && sameStringSlice(hostsStringArray, release.Gateway.Hosts) {
-								fmt.Println("Need to add http rule for app: ", app, " for gateway-bound virtualservice")
-								appsToAddToGatewayVirtualService[app] = versionInRelease
-							}
-
-							// other virtual services - create a match rule for each virtualservice for host that is mentioned in release
-							for _, appInHosts := range hostsStringArray {
-								if appInHosts == appInReleaseID {
-									fmt.Println("Need to add match devtio rule for app: ", appInReleaseID, " for virtualservice bound to ", appInReleaseID)
-									appsToAddToHostVirtualService[appInReleaseID] = versionInRelease
-								}
-							}
-						}
-					}
-				}
-			}
-			// Now modify the virtual services accordingly
-			// Gateway-bound VS
-			for a, v := range appsToAddToGatewayVirtualService {
-				newHTTPRule := map[string]interface{}{
-					"route": []map[string]interface{}{
-						{
-							"destination": map[string]string{
-								"host":   a,
-								"subset": v,
-							},
-						},
-					},
-				}
-				https = append(https, newHTTPRule)
+		return releases.RemoveReleaseRules(vs, release)
+	}
+	if isDryRun(r) {
+		previewRelease(w, clusters, namespace, release, change)
+		return
+	}
+	statuses, changes, err := releases.ApplyToClusters(clusters, namespace, change)
+	recordEvent(client, r, namespace, releaseID, action, changes, err)
+	result := releases.NewReleaseResult(release, statuses, changes)
+	if err != nil {
+		respondWithUpdateError(w, result, err)
+		return
+	}
+	releases.RemoveClusterSubsets(clusters, namespace, release)
+	releases.DeleteDeployments(clusters, namespace, release)
+	if err := store.Delete(namespace, releaseID); err != nil {
+		respondWithUpdateError(w, result, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, result)
+}
+
+// PromoteRelease makes the release's versions the stable versions of its apps in every managed virtual service of its clusters,
+// and removes the release's rules. With ?removeSubsets=true, the subsets of the versions replaced are removed too.
+func PromoteRelease(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	releaseID := vars["releaseId"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	managed, err := releases.GetManagedVirtualServices(client, namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	stored, err := releases.NewConfigMapStore(client).List(namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	release, ok := releases.WithStatus(releases.Releases(managed), stored)[releaseID]
+	if !ok {
+		RespondWithError(w, http.StatusNotFound, fmt.Sprintf("Release %s not found in namespace %s", releaseID, namespace))
+		return
+	}
+	if err := releases.CanPromote(release); err != nil {
+		RespondWithError(w, http.StatusConflict, "Release can't be promoted: "+err.Error())
+		return
+	}
+	clusters, err := releases.ReleaseClusters(release, client)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if isDryRun(r) {
+		previewRelease(w, clusters, namespace, release, releases.PromoteChange(release))
+		return
+	}
+	if !checkDeployments(w, clusters, namespace, release) || !checkMaintenanceWindows(w, r, client, namespace) {
+		return
+	}
+	removeSubsets, _ := strconv.ParseBool(r.URL.Query().Get("removeSubsets"))
+	result, err := releases.Promote(client, clusters, namespace, release, removeSubsets)
+	recordEvent(client, r, namespace, releaseID, releases.ActionPromoted, result.VirtualServices, err)
+	if err != nil {
+		respondWithUpdateError(w, result, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, result)
+}
+
+// SwitchRelease sends all of the traffic of the apps of a blue/green release to the release's versions,
+// once its smoke checks pass on the release's pods
+func SwitchRelease(w http.ResponseWriter, r *http.Request) {
+	switchRelease(w, r, false)
+}
+
+// SwitchBackRelease sends the traffic of the apps of a switched blue/green release back to the versions it was switched from
+func SwitchBackRelease(w http.ResponseWriter, r *http.Request) {
+	switchRelease(w, r, true)
+}
+
+func switchRelease(w http.ResponseWriter, r *http.Request, back bool) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	releaseID := vars["releaseId"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	managed, err := releases.GetManagedVirtualServices(client, namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	store := releases.NewConfigMapStore(client)
+	stored, err := store.List(namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	release, ok := releases.WithStatus(releases.Releases(managed), stored)[releaseID]
+	if !ok {
+		RespondWithError(w, http.StatusNotFound, fmt.Sprintf("Release %s not found in namespace %s", releaseID, namespace))
+		return
+	}
+	if release.Strategy != releases.StrategyBlueGreen || release.Status == nil {
+		RespondWithError(w, http.StatusConflict, fmt.Sprintf("Release %s isn't a %s release", releaseID, releases.StrategyBlueGreen))
+		return
+	}
+	phase, action := releases.PhaseStandby, releases.ActionSwitched
+	if back {
+		phase, action = releases.PhaseSwitched, releases.ActionSwitchedBack
+	}
+	if release.Status.Phase != phase {
+		RespondWithError(w, http.StatusConflict, fmt.Sprintf("Release %s is %s", releaseID, release.Status.Phase))
+		return
+	}
+	clusters, err := releases.ReleaseClusters(release, client)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if isDryRun(r) {
+		previewRelease(w, clusters, namespace, release, func(cluster releases.Cluster, vs *releases.VirtualService) bool {
+			if back {
+				return releases.SwitchBackVersions(vs, release, release.Status.PreviousVersions)
 			}
-			// Host-bound VS
-			for a, v := range appsToAddToHostVirtualService {
-				newHTTPRule := map[string]interface{}{
-					"match": []map[string]interface{}{
-						{
-							"headers": map[string]interface{}{
-								"devtio": map[string]string{
-									"exact": release.ID,
-								},
-							},
-						},
-					},
-					"route": []map[string]interface{}{
-						{
-							"destination": map[string]string{
-								"host":   a,
-								"subset": v,
-							},
-						},
-					},
-				}
-				https = append(https, newHTTPRule)
+			_, changed := releases.SwitchVersions(vs, release)
+			return changed
+		})
+		return
+	}
+	if !back && !checkDeployments(w, clusters, namespace, release) {
+		return
+	}
+	if !checkMaintenanceWindows(w, r, client, namespace) {
+		return
+	}
+
+	if !back {
+		// the checks run against the release's versions while they are idle, before any user reaches them
+		results, passed := releases.RunSmokeChecks(clusters, namespace, release, time.Now())
+		status := *release.Status
+		status.SmokeResults = results
+		release.Status = &status
+		if !passed {
+			err := fmt.Errorf("smoke checks of release %s failed", releaseID)
+			recordEvent(client, r, namespace, releaseID, action, nil, err)
+			if err := store.Put(namespace, release); err != nil {
+				log.Errorf("Release %s/%s smoke checks can't be stored: %v", namespace, releaseID, err)
 			}
+			RespondWithJSON(w, http.StatusPreconditionFailed, models.ReleaseResult{Release: release, Error: err.Error()})
+			return
+		}
+	}
+
+	var result models.ReleaseResult
+	if back {
+		result, err = releases.SwitchBack(client, clusters, namespace, release)
+	} else {
+		result, err = releases.Switch(client, clusters, namespace, release)
+	}
+	recordEvent(client, r, namespace, releaseID, action, result.VirtualServices, err)
+	if err != nil {
+		respondWithUpdateError(w, result, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, result)
+}
+
+// ApproveRelease approves the next step of a release awaiting an approval, and moves the release to it
+func ApproveRelease(w http.ResponseWriter, r *http.Request) {
+	decideRelease(w, r, releases.DecisionApproved)
+}
+
+// RejectRelease rejects the next step of a release awaiting an approval, and rolls the release back
+func RejectRelease(w http.ResponseWriter, r *http.Request) {
+	decideRelease(w, r, releases.DecisionRejected)
+}
+
+// decideRelease records the decision of the user authenticated by the JWT of the request on the next step of a release,
+// and applies it to the release's clusters
+func decideRelease(w http.ResponseWriter, r *http.Request, decision string) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	releaseID := vars["releaseId"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	user, err := tokenUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Approvals need the JWT of the approver: "+err.Error())
+		return
+	}
+	var request models.ApprovalRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		RespondWithError(w, http.StatusBadRequest, "Approval can't be decoded: "+err.Error())
+		return
+	}
+	store := releases.NewConfigMapStore(client)
+	release, err := store.Get(namespace, releaseID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if release == nil {
+		RespondWithError(w, http.StatusNotFound, fmt.Sprintf("Release %s not found in namespace %s", releaseID, namespace))
+		return
+	}
+	if release.Status == nil || release.Status.Phase != releases.PhaseAwaitingApproval {
+		RespondWithError(w, http.StatusConflict, fmt.Sprintf("Release %s isn't awaiting an approval", releaseID))
+		return
+	}
+	if !releases.IsApprover(*release.Rollout, user) {
+		RespondWithError(w, http.StatusForbidden, fmt.Sprintf("User %s isn't an approver of release %s", user, releaseID))
+		return
+	}
+	clusters, err := releases.ReleaseClusters(*release, client)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// approving shifts traffic, so it waits for the end of a maintenance window, rejecting rolls the release back anyway
+	if decision == releases.DecisionApproved && !checkMaintenanceWindows(w, r, client, namespace) {
+		return
+	}
+	if decision == releases.DecisionApproved && !checkDeployments(w, clusters, namespace, *release) {
+		return
+	}
 
+	now := time.Now()
+	step := release.Status.Step + 1
+	action := releases.ActionApproved
+	var statuses []models.ClusterStatus
+	var changes []models.VirtualServiceChange
+	if decision == releases.DecisionApproved {
+		releases.Approve(release, user, request.Comment, now)
+		statuses, changes, err = releases.ApplyWeight(clusters, namespace, *release, release.Status.Weight)
+	} else {
+		action = releases.ActionRejected
+		statuses, changes, err = releases.Rollback(clusters, namespace, *release)
+		releases.Reject(release, user, request.Comment, now)
+		if err == nil {
+			releases.RemoveClusterSubsets(clusters, namespace, *release)
+			releases.DeleteDeployments(clusters, namespace, *release)
+			release.Deployments = nil
 		}
-		spec["http"] = https
-		res, err := putVirtualService(*client, meta, spec, namespace)
-		if err != nil {
-			fmt.Println(w, "Error: ", err.Error())
-		} else {
-			fmt.Println(w, res)
+	}
+	event := releases.NewEvent(action, user, changes, err)
+	if err == nil {
+		event.Message = fmt.Sprintf("Step %d %s", step, strings.ToLower(decision))
+		if request.Comment != "" {
+			event.Message += ": " + request.Comment
 		}
 	}
+	saveEvent(client, namespace, releaseID, event)
+	result := releases.NewReleaseResult(*release, statuses, changes)
+	if err != nil {
+		respondWithUpdateError(w, result, err)
+		return
+	}
+	releases.SetClusterStatuses(&result.Release, statuses)
+	if err := store.Put(namespace, result.Release); err != nil {
+		respondWithUpdateError(w, result, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, result)
+}
+
+// ReleaseHistory returns what happened to a release, including after it was deleted or rolled back
+func ReleaseHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	releaseID := vars["releaseId"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	events, err := releases.NewConfigMapHistory(client).Events(namespace, releaseID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(events) == 0 {
+		RespondWithError(w, http.StatusNotFound, fmt.Sprintf("No history for release %s in namespace %s", releaseID, namespace))
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, events)
 }
 
-func putVirtualService(client istioclient.IstioClient, meta meta_v1.ObjectMeta, spec map[string]interface{}, namespace string) (string, error) {
-	result := "Error"
-	virtualService := (&istioclient.VirtualService{
-		ObjectMeta: meta,
-		Spec:       spec,
-	}).DeepCopyIstioObject()
-	var rrErr error
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if _, rrErr := client.PutVirtualService(namespace, virtualService); rrErr == nil {
-			result = "Success"
-			fmt.Println("Error: ", rrErr)
+// ReleasePropagation reports the hops of the recent requests of a release where the header carrying the release id was dropped,
+// from the traces of the release's apps in Jaeger
+func ReleasePropagation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	releaseID := vars["releaseId"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	lookback := time.Hour
+	if value := r.URL.Query().Get("lookback"); value != "" {
+		if lookback, err = time.ParseDuration(value); err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Lookback can't be read: "+err.Error())
+			return
 		}
-	}()
-	wg.Wait()
-	if rrErr != nil {
-		fmt.Println("Error: ", rrErr)
-	} else {
-		fmt.Println("Virtual service modified successfully: ", virtualService)
 	}
-	return result, rrErr
+	managed, err := releases.GetManagedVirtualServices(client, namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	stored, err := releases.NewConfigMapStore(client).List(namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	release, ok := releases.WithStatus(releases.Releases(managed), stored)[releaseID]
+	if !ok {
+		RespondWithError(w, http.StatusNotFound, fmt.Sprintf("Release %s not found in namespace %s", releaseID, namespace))
+		return
+	}
+	finder := jaeger.NewClient(jaeger.QueryURL(config.Get().Products.Jaeger))
+	report, err := releases.CheckPropagation(finder, namespace, release, lookback)
+	if err != nil {
+		RespondWithError(w, http.StatusBadGateway, "Traces can't be read from Jaeger: "+err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, report)
+}
+
+// validateRelease responds with the invalid fields of a release: with a bad request if the release is incomplete or malformed,
+// with an unprocessable entity if it refers to objects that don't exist in the namespace of one of its clusters.
+// It returns the clusters of the release, or false if the release is invalid and a response was sent.
+func validateRelease(w http.ResponseWriter, client istioclient.IstioClientInterface, namespace string, release models.Release, create bool) ([]releases.Cluster, bool) {
+	if fields := releases.ValidateRelease(release); len(fields) > 0 {
+		RespondWithJSON(w, http.StatusBadRequest, models.ValidationError{Error: "Release is invalid", Fields: fields})
+		return nil, false
+	}
+	clusters, err := releases.ReleaseClusters(release, client)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	fields, err := releases.ValidateReleaseInClusters(client, clusters, namespace, release, create)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	if len(fields) > 0 {
+		RespondWithJSON(w, http.StatusUnprocessableEntity, models.ValidationError{Error: "Release refers to objects that don't exist in namespace " + namespace, Fields: fields})
+		return nil, false
+	}
+	return clusters, true
+}
+
+// respondWithUpdateError responds with the outcome of the changes of a release that failed,
+// as a conflict when objects kept being modified concurrently while canary wrote them
+func respondWithUpdateError(w http.ResponseWriter, result models.ReleaseResult, err error) {
+	status := http.StatusInternalServerError
+	result.Error = err.Error()
+	if errors.IsConflict(err) {
+		status = http.StatusConflict
+		result.Error = "Release can't be changed as it is being changed concurrently, try again: " + err.Error()
+	}
+	RespondWithJSON(w, status, result)
+}
+
+// isDryRun returns true if the request only asks what it would change, with ?dryRun=true
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+	return dryRun
+}
+
+// previewRelease responds with the changes a request would apply to the virtual services of the clusters, without applying them
+func previewRelease(w http.ResponseWriter, clusters []releases.Cluster, namespace string, release models.Release, change func(releases.Cluster, *releases.VirtualService) bool) {
+	previews, err := releases.PreviewClusters(clusters, namespace, change)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, models.ReleasePreview{Release: release, VirtualServices: previews})
+}
+
+// recordEvent appends an action on a release to its history.
+// The action already happened, so failing to record it is logged instead of failing the request.
+func recordEvent(client istioclient.IstioClientInterface, r *http.Request, namespace string, releaseID string, action string, changes []models.VirtualServiceChange, err error) {
+	saveEvent(client, namespace, releaseID, releases.NewEvent(action, requestUser(r), changes, err))
+}
+
+// saveEvent appends an event to the history of a release, failing to do so is logged
+func saveEvent(client istioclient.IstioClientInterface, namespace string, releaseID string, event models.ReleaseEvent) {
+	if err := releases.NewConfigMapHistory(client).Record(namespace, releaseID, event); err != nil {
+		log.Errorf("Release %s/%s history can't be recorded: %v", namespace, releaseID, err)
+	}
+}
+
+// tokenUser returns the user authenticated by the JWT of the request, verified as the server does.
+// It returns an error if the request has no valid JWT.
+func tokenUser(r *http.Request) (string, error) {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return "", fmt.Errorf("the request has no bearer token")
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if err := config.ValidateToken(token); err != nil {
+		return "", err
+	}
+	user, err := config.TokenUser(token)
+	if err == nil && user == "" {
+		err = fmt.Errorf("the token has no username")
+	}
+	return user, err
+}
+
+// requestUser returns the user authenticated by the server, or an empty string if the server isn't secured
+func requestUser(r *http.Request) string {
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		user, err := config.TokenUser(strings.TrimPrefix(authorization, "Bearer "))
+		if err != nil {
+			return ""
+		}
+		return user
+	}
+	user, _, _ := r.BasicAuth()
+	return user
 }
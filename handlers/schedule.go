@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	istioclient "github.com/devtio/canary/kubernetes"
+	models "github.com/devtio/canary/models"
+	"github.com/devtio/canary/releases"
+	"github.com/gorilla/mux"
+)
+
+// ListScheduledActions returns the actions scheduled on the releases of a namespace that didn't run yet, earliest first
+func ListScheduledActions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	actions, err := releases.NewConfigMapScheduleStore(client).List(namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, actions)
+}
+
+// ScheduleAction schedules the start, the next step or the promotion of a release.
+// The release to start is validated as CreateRelease does, a release to advance must have a rollout plan,
+// or be scheduled to start with one before, and a release to promote must exist or be scheduled to start before.
+func ScheduleAction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var action models.ScheduledAction
+	if err := json.NewDecoder(r.Body).Decode(&action); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Scheduled action can't be decoded: "+err.Error())
+		return
+	}
+	if fields := releases.ValidateScheduledAction(action); len(fields) > 0 {
+		RespondWithJSON(w, http.StatusBadRequest, models.ValidationError{Error: "Scheduled action is invalid", Fields: fields})
+		return
+	}
+	schedule := releases.NewConfigMapScheduleStore(client)
+	scheduled, err := schedule.List(namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if action.Action == releases.ScheduleStart {
+		if _, ok := validateRelease(w, client, namespace, *action.Release, true); !ok {
+			return
+		}
+	} else if action.Action == releases.SchedulePromote {
+		managed, err := releases.GetManagedVirtualServices(client, namespace)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if _, ok := releases.Releases(managed)[action.ReleaseID]; !ok && !startsBefore(scheduled, action, false) {
+			RespondWithJSON(w, http.StatusUnprocessableEntity, models.ValidationError{
+				Error:  "Scheduled action refers to a release that doesn't exist in namespace " + namespace,
+				Fields: []models.FieldError{{Field: "releaseId", Message: fmt.Sprintf("release %s doesn't exist and isn't scheduled to start", action.ReleaseID)}},
+			})
+			return
+		}
+	} else {
+		stored, err := releases.NewConfigMapStore(client).Get(namespace, action.ReleaseID)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !hasRollout(stored) && !startsBefore(scheduled, action, true) {
+			RespondWithJSON(w, http.StatusUnprocessableEntity, models.ValidationError{
+				Error:  "Scheduled action refers to a release without rollout plan in namespace " + namespace,
+				Fields: []models.FieldError{{Field: "releaseId", Message: fmt.Sprintf("release %s has no rollout plan and isn't scheduled to start with one", action.ReleaseID)}},
+			})
+			return
+		}
+	}
+
+	action.ID = releases.ScheduledActionID(action)
+	action.User = requestUser(r)
+	for _, existing := range scheduled {
+		if existing.ID == action.ID {
+			RespondWithError(w, http.StatusConflict, fmt.Sprintf("Release %s already has a scheduled %s at %s", action.ReleaseID, action.Action, action.At.Format(time.RFC3339)))
+			return
+		}
+	}
+	if err := schedule.Put(namespace, action); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusCreated, action)
+}
+
+// CancelScheduledAction removes an action from the schedule before it runs
+func CancelScheduledAction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	actionID := vars["actionId"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	schedule := releases.NewConfigMapScheduleStore(client)
+	existing, err := schedule.Get(namespace, actionID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if existing == nil {
+		RespondWithError(w, http.StatusNotFound, fmt.Sprintf("Scheduled action %s not found in namespace %s", actionID, namespace))
+		return
+	}
+	if err := schedule.Delete(namespace, actionID); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, existing)
+}
+
+func ListMaintenanceWindows(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	windows, err := releases.NewConfigMapWindowStore(client).List(namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, windows)
+}
+
+func CreateMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var window models.MaintenanceWindow
+	if err := json.NewDecoder(r.Body).Decode(&window); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Maintenance window can't be decoded: "+err.Error())
+		return
+	}
+	if fields := releases.ValidateMaintenanceWindow(window); len(fields) > 0 {
+		RespondWithJSON(w, http.StatusBadRequest, models.ValidationError{Error: "Maintenance window is invalid", Fields: fields})
+		return
+	}
+	store := releases.NewConfigMapWindowStore(client)
+	existing, err := store.Get(namespace, window.ID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if existing != nil {
+		RespondWithError(w, http.StatusConflict, fmt.Sprintf("Maintenance window %s already exists in namespace %s", window.ID, namespace))
+		return
+	}
+	if err := store.Put(namespace, window); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusCreated, window)
+}
+
+func DeleteMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	windowID := vars["windowId"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	store := releases.NewConfigMapWindowStore(client)
+	existing, err := store.Get(namespace, windowID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if existing == nil {
+		RespondWithError(w, http.StatusNotFound, fmt.Sprintf("Maintenance window %s not found in namespace %s", windowID, namespace))
+		return
+	}
+	if err := store.Delete(namespace, windowID); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, existing)
+}
+
+// checkMaintenanceWindows responds with a conflict if the namespace is in a maintenance window,
+// unless the request is forced with ?force=true.
+// It returns false if a response was sent.
+func checkMaintenanceWindows(w http.ResponseWriter, r *http.Request, client istioclient.IstioClientInterface, namespace string) bool {
+	if force, _ := strconv.ParseBool(r.URL.Query().Get("force")); force {
+		return true
+	}
+	windows, err := releases.NewConfigMapWindowStore(client).List(namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	window, end := releases.ActiveWindow(windows, time.Now())
+	if window == nil {
+		return true
+	}
+	message := fmt.Sprintf("Namespace %s is in maintenance window %s until %s", namespace, window.ID, end.Format(time.RFC3339))
+	if window.Reason != "" {
+		message += " (" + window.Reason + ")"
+	}
+	RespondWithError(w, http.StatusConflict, message+", add ?force=true to change it anyway")
+	return false
+}
+
+// hasRollout returns true if a stored release has a rollout plan
+func hasRollout(stored *models.Release) bool {
+	return stored != nil && stored.Rollout != nil
+}
+
+// startsBefore returns true if the release of an action is scheduled to start before the action,
+// with a rollout plan if withRollout is set
+func startsBefore(scheduled []models.ScheduledAction, action models.ScheduledAction, withRollout bool) bool {
+	for _, s := range scheduled {
+		if s.Action == releases.ScheduleStart && s.ReleaseID == action.ReleaseID && s.At.Before(action.At) && (!withRollout || hasRollout(s.Release)) {
+			return true
+		}
+	}
+	return false
+}
@@ -4,214 +4,259 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 
 	istioclient "github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/log"
 	models "github.com/devtio/canary/models"
+	"github.com/devtio/canary/releases"
 	"github.com/gorilla/mux"
+	"k8s.io/apimachinery/pkg/api/errors"
 )
 
 func ListTrafficSegments(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	namespace := vars["namespace"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
 
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	segments, err := releases.NewConfigMapSegmentStore(client).List(namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, segments)
+}
+
+func GetTrafficSegment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	segmentID := vars["segmentId"]
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	client, err := istioclient.NewClient()
+	client, err := istioclient.GetClient()
 
 	if err != nil {
-		fmt.Errorf("Error occurred", err)
-		return
-	}
-
-	trafficSegments := []models.TrafficSegment{}
-	// first get gateways
-	fmt.Println("Calling GET gateways for namespace ", namespace)
-	gateways, err2 := client.GetGateways(namespace)
-	if err2 != nil {
-		fmt.Println("Error occurred in getting gateways", err2)
-		return
-	}
-	fmt.Println("Gateways retrieved: ", len(gateways))
-	gatewayHosts := map[string][]string{}
-	// iterate over gateways
-	for _, gateway := range gateways {
-		// get metadata
-		spec := gateway.GetSpec()
-		meta := gateway.GetObjectMeta()
-		labels := meta.GetLabels()
-		name := meta.GetName()
-		isManagedByDevtio, isManagedByDevtioPresent := labels["io.devtio.canary/managed"]
-		if !isManagedByDevtioPresent || isManagedByDevtio == "false" {
-			fmt.Println("Gateway is not managed by devtio, skipping...")
-			continue
-		}
-		servers, serversPresent := spec["servers"].([]interface{})
-
-		if serversPresent {
-			for _, server := range servers {
-				serverMap, isServerMap := server.(map[string]interface{})
-				if isServerMap {
-					hosts, hostsPresent := serverMap["hosts"].([]interface{})
-					if hostsPresent {
-						for _, host := range hosts {
-							hostsArray, isHostsArray := gatewayHosts[name]
-							if isHostsArray {
-								hostsArray = append(hostsArray, host.(string))
-							} else {
-								hostsArray = []string{host.(string)}
-							}
-							gatewayHosts[name] = hostsArray
-						}
-					}
-				}
-			}
-		}
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
-	fmt.Println(gatewayHosts)
 
-	// get virtual services that match the host/gateway
-	fmt.Println("Calling GET virtual services for namespace ", namespace)
-	virtualServices, err2 := client.GetVirtualServices(namespace, "")
-	if err2 != nil {
-		fmt.Println("Error occurred in getting virtual services", err2)
+	segment, err := releases.NewConfigMapSegmentStore(client).Get(namespace, segmentID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if segment == nil {
+		RespondWithError(w, http.StatusNotFound, fmt.Sprintf("Traffic segment %s not found in namespace %s", segmentID, namespace))
 		return
 	}
-	fmt.Println("Virtual services retrieved: ", len(virtualServices))
-	// iterate over virtual services
-	for _, vs := range virtualServices {
-		// get metadata
-		meta := vs.GetObjectMeta()
-		labels := meta.GetLabels()
-		isManagedByDevtio, isManagedByDevtioPresent := labels["io.devtio.canary/managed"]
+	RespondWithJSON(w, http.StatusOK, segment)
+}
 
-		if !isManagedByDevtioPresent || isManagedByDevtio == "false" {
-			fmt.Println("VirtualService is not managed by devtio, skipping...")
-			continue
-		}
-		spec := vs.GetSpec()
-		// get hosts
-		hosts := spec["hosts"].([]interface{})
-		var hostsStringArray []string
-		for _, host := range hosts {
-			hostsStringArray = append(hostsStringArray, host.(string))
+func CreateTrafficSegment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var segment models.TrafficSegment
+	if err := json.NewDecoder(r.Body).Decode(&segment); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Traffic segment can't be decoded: "+err.Error())
+		return
+	}
+	if fields := releases.ValidateTrafficSegment(segment); len(fields) > 0 {
+		RespondWithJSON(w, http.StatusBadRequest, models.ValidationError{Error: "Traffic segment is invalid", Fields: fields})
+		return
+	}
+	store := releases.NewConfigMapSegmentStore(client)
+	existing, err := store.Get(namespace, segment.ID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if existing != nil {
+		RespondWithError(w, http.StatusConflict, fmt.Sprintf("Traffic segment %s already exists in namespace %s", segment.ID, namespace))
+		return
+	}
+	if err := store.Put(namespace, segment); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusCreated, segment)
+}
+
+// UpdateTrafficSegment changes a traffic segment and applies its new match to every release targeting it,
+// as a single transaction on the virtual services
+func UpdateTrafficSegment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	segmentID := vars["segmentId"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
+
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var segment models.TrafficSegment
+	if err := json.NewDecoder(r.Body).Decode(&segment); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Traffic segment can't be decoded: "+err.Error())
+		return
+	}
+	if segment.ID != "" && segment.ID != segmentID {
+		RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Traffic segment id %s doesn't match the traffic segment %s being updated", segment.ID, segmentID))
+		return
+	}
+	segment.ID = segmentID
+	if fields := releases.ValidateTrafficSegment(segment); len(fields) > 0 {
+		RespondWithJSON(w, http.StatusBadRequest, models.ValidationError{Error: "Traffic segment is invalid", Fields: fields})
+		return
+	}
+	store := releases.NewConfigMapSegmentStore(client)
+	existing, err := store.Get(namespace, segmentID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if existing == nil {
+		RespondWithError(w, http.StatusNotFound, fmt.Sprintf("Traffic segment %s not found in namespace %s", segmentID, namespace))
+		return
+	}
+
+	targeting, err := segmentReleases(client, namespace, segmentID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	result := models.TrafficSegmentResult{Segment: segment, Releases: []string{}, VirtualServices: []models.VirtualServiceChange{}}
+	for i := range targeting {
+		targeting[i].Match = segment.Match
+		result.Releases = append(result.Releases, targeting[i].ID)
+	}
+	if len(targeting) > 0 {
+		clusters, err := segmentClusters(client, targeting)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
 		}
-		// get the obeject spec
-		// get gateways
-		gateways, gatewaysPresent := spec["gateways"].([]interface{})
-		if gatewaysPresent {
-			for _, gateway := range gateways {
-				hostsArrayFromGateway := gatewayHosts[gateway.(string)]
-				// check hosts match
-				if sameStringSlice(hostsArrayFromGateway, hostsStringArray) {
-					https, httpsPresent := spec["http"].([]interface{})
-					// first get the release label
-					if httpsPresent {
-						for _, http := range https {
-							httpMap, isHTTPMap := http.(map[string]interface{})
-							if isHTTPMap {
-								// get top-level hosts
-								appendHeaders, appendHeadersPresent := httpMap["appendHeaders"].(map[string]interface{})
-								if appendHeadersPresent {
-									devtioHeader, devtioHeaderPresent := appendHeaders["devtio"].(string)
-									if devtioHeaderPresent {
-										// read matches section
-										matches, matchesPresent := httpMap["match"].([]interface{})
-										if matchesPresent {
-											for _, match := range matches {
-												matchMap, isMatchMap := match.(map[string]interface{})
-												if isMatchMap {
-													headers, headersPresent := matchMap["headers"].(map[string]interface{})
-													if headersPresent {
-														headersMap := map[string]*models.StringMatch{}
-														for headerKey, headerValue := range headers {
-															stringMatchMap, isStringMatchMap := headerValue.(map[string]interface{})
-															if isStringMatchMap {
-																stringMatch := models.StringMatch{}
-																stringMatchExact, isStringMatchExactPresent := stringMatchMap["exact"]
-																stringMatchRegex, isStringMatchRegexPresent := stringMatchMap["regex"]
-																stringMatchPrefix, isStringMatchPrefixPresent := stringMatchMap["prefix"]
-																if isStringMatchExactPresent {
-																	stringMatch.Exact = stringMatchExact.(string)
-																}
-																if isStringMatchRegexPresent {
-																	stringMatch.Regex = stringMatchRegex.(string)
-																}
-																if isStringMatchPrefixPresent {
-																	stringMatch.Prefix = stringMatchPrefix.(string)
-																}
-																headersMap[headerKey] = &stringMatch
-																match := models.HttpMatch{
-																	Headers: headersMap,
-																}
-																trafficSegment := models.TrafficSegment{
-																	ID:    devtioHeader,
-																	Name:  devtioHeader,
-																	Match: &match,
-																}
-																trafficSegments = append(trafficSegments, trafficSegment)
-															}
-														}
-													}
-												}
-											}
-										}
-									}
-								}
-
-							}
-						}
-					}
-				} else {
-					fmt.Println("Sorry, hosts don't match between Gateway and VirtualService")
+		change := func(cluster releases.Cluster, vs *releases.VirtualService) bool {
+			changed := false
+			for _, release := range targeting {
+				if releases.Targets(release, cluster) {
+					changed = releases.SetMatch(vs, release) || changed
 				}
 			}
+			return changed
+		}
+		_, result.VirtualServices, err = releases.ApplyToClusters(clusters, namespace, change)
+		for _, release := range targeting {
+			event := releases.NewEvent(releases.ActionUpdated, requestUser(r), result.VirtualServices, err)
+			if err == nil {
+				event.Message = fmt.Sprintf("Traffic segment %s changed", segmentID)
+			}
+			if recordErr := releases.NewConfigMapHistory(client).Record(namespace, release.ID, event); recordErr != nil {
+				log.Errorf("Release %s/%s history can't be recorded: %v", namespace, release.ID, recordErr)
+			}
+		}
+		if err != nil {
+			respondWithSegmentError(w, result, err)
+			return
 		}
-
 	}
-
-	json.NewEncoder(w).Encode(trafficSegments)
+	if err := store.Put(namespace, segment); err != nil {
+		respondWithSegmentError(w, result, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, result)
 }
 
-func CreateTrafficSegment(w http.ResponseWriter, r *http.Request) {
+// DeleteTrafficSegment removes a traffic segment no release targets
+func DeleteTrafficSegment(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	namespace := vars["namespace"]
-	// releaseId, releaseIdPresent := vars["releaseId"]
-	client, err := istioclient.NewClient()
+	segmentID := vars["segmentId"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	client, err := istioclient.GetClient()
 
-	// POST new virtual service
-	var vsd models.VirtualServiceDTO
-	json.NewDecoder(r.Body).Decode(&vsd)
-	fmt.Println("Attempting to create traffic segment service")
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
-	res, err := createVirtualService(*client, vsd, namespace)
+	store := releases.NewConfigMapSegmentStore(client)
+	existing, err := store.Get(namespace, segmentID)
 	if err != nil {
-		fmt.Fprintf(w, "Error: ", err.Error())
-	} else {
-		fmt.Fprintf(w, res)
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if existing == nil {
+		RespondWithError(w, http.StatusNotFound, fmt.Sprintf("Traffic segment %s not found in namespace %s", segmentID, namespace))
+		return
+	}
+	targeting, err := segmentReleases(client, namespace, segmentID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
+	if len(targeting) > 0 {
+		ids := []string{}
+		for _, release := range targeting {
+			ids = append(ids, release.ID)
+		}
+		RespondWithError(w, http.StatusConflict, fmt.Sprintf("Traffic segment %s is targeted by releases %s", segmentID, strings.Join(ids, ", ")))
+		return
+	}
+	if err := store.Delete(namespace, segmentID); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, existing)
 }
 
-func sameStringSlice(x, y []string) bool {
-	if len(x) != len(y) {
-		return false
-	}
-	// create a map of string -> int
-	diff := make(map[string]int, len(x))
-	for _, _x := range x {
-		// 0 value for int is 0, so just increment a counter for the string
-		diff[_x]++
+// segmentReleases returns the releases targeting a traffic segment
+func segmentReleases(client istioclient.IstioClientInterface, namespace string, segmentID string) ([]models.Release, error) {
+	stored, err := releases.NewConfigMapStore(client).List(namespace)
+	if err != nil {
+		return nil, err
 	}
-	for _, _y := range y {
-		// If the string _y is not in diff bail out early
-		if _, ok := diff[_y]; !ok {
-			return false
+	return releases.SegmentReleases(stored, segmentID), nil
+}
+
+// segmentClusters returns the clusters of the releases targeting a traffic segment, without duplicates
+func segmentClusters(client istioclient.IstioClientInterface, targeting []models.Release) ([]releases.Cluster, error) {
+	clusters := []releases.Cluster{}
+	seen := map[string]bool{}
+	for _, release := range targeting {
+		releaseClusters, err := releases.ReleaseClusters(release, client)
+		if err != nil {
+			return nil, err
 		}
-		diff[_y] -= 1
-		if diff[_y] == 0 {
-			delete(diff, _y)
+		for _, cluster := range releaseClusters {
+			if !seen[cluster.Name] {
+				seen[cluster.Name] = true
+				clusters = append(clusters, cluster)
+			}
 		}
 	}
-	if len(diff) == 0 {
-		return true
+	return clusters, nil
+}
+
+func respondWithSegmentError(w http.ResponseWriter, result models.TrafficSegmentResult, err error) {
+	status := http.StatusInternalServerError
+	result.Error = err.Error()
+	if errors.IsConflict(err) {
+		status = http.StatusConflict
+		result.Error = "Traffic segment can't be changed as its releases are being changed concurrently, try again: " + err.Error()
 	}
-	return false
+	RespondWithJSON(w, status, result)
 }
@@ -18,7 +18,7 @@ func ListVirtualServices(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	namespace := vars["namespace"]
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	client, err := istioclient.NewClient()
+	client, err := istioclient.GetClient()
 
 	if err != nil {
 		log.Error("Error occurred at ListVirtualServices while creating new client. Message=", err.Error())
@@ -40,7 +40,7 @@ func CreateVirtualService(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	namespace := vars["namespace"]
 
-	client, err := istioclient.NewClient()
+	client, err := istioclient.GetClient()
 
 	// POST new virtual service
 	var vsd models.VirtualServiceDTO
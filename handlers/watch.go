@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	istioclient "github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/log"
+	"github.com/devtio/canary/releases"
+)
+
+// watchKeepAlive is how often an idle watch stream sends a comment, so proxies don't close it
+const watchKeepAlive = 30 * time.Second
+
+// WatchNamespace streams the changes of the releases and the traffic of a namespace as Server-Sent Events.
+// Each event is named after its type and carries a models.WatchEvent as JSON.
+// The stream ends when the client falls too far behind, EventSource clients reconnect on their own.
+func WatchNamespace(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		RespondWithError(w, http.StatusInternalServerError, "The connection doesn't support streaming")
+		return
+	}
+	client, err := istioclient.GetClient()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	changes, stop, err := client.Watch(namespace)
+	if err != nil {
+		RespondWithError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+			for _, event := range releases.WatchEvents(change, time.Now()) {
+				data, err := json.Marshal(event)
+				if err != nil {
+					log.Errorf("Watch event of namespace %s can't be encoded: %v", namespace, err)
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,107 @@
+package jaeger
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/devtio/canary/config"
+)
+
+// TraceFinder finds the recent traces of a service, it is implemented by Client and can be mocked
+type TraceFinder interface {
+	// Traces returns at most limit traces with a span of the service, started within lookback
+	Traces(service string, lookback time.Duration, limit int) ([]Trace, error)
+}
+
+// Trace is a trace as returned by the Jaeger query API
+type Trace struct {
+	TraceID   string             `json:"traceID"`
+	Spans     []Span             `json:"spans"`
+	Processes map[string]Process `json:"processes"`
+}
+
+// Span is a span of a Trace
+type Span struct {
+	TraceID       string     `json:"traceID"`
+	SpanID        string     `json:"spanID"`
+	OperationName string     `json:"operationName"`
+	Tags          []KeyValue `json:"tags"`
+	ProcessID     string     `json:"processID"`
+}
+
+// KeyValue is a tag of a Span
+type KeyValue struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// Process is the service a Span was recorded by
+type Process struct {
+	ServiceName string `json:"serviceName"`
+}
+
+// Tag returns the value of a tag of the span, or an empty string if the span has no such tag
+func (span Span) Tag(key string) string {
+	for _, tag := range span.Tags {
+		if tag.Key == key {
+			return fmt.Sprint(tag.Value)
+		}
+	}
+	return ""
+}
+
+// Client queries the HTTP API of a Jaeger query service
+type Client struct {
+	url  string
+	http *http.Client
+}
+
+// NewClient returns a client of the Jaeger query service at url, see QueryURL
+func NewClient(url string) *Client {
+	return &Client{
+		url:  url,
+		http: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// QueryURL returns the URL of the Jaeger query service: the configured URL, or the URL of its service in the cluster
+func QueryURL(jaeger config.JaegerConfig) string {
+	if jaeger.URL != "" {
+		return jaeger.URL
+	}
+	return fmt.Sprintf("http://%s.%s:16686", jaeger.Service, jaeger.ServiceNamespace)
+}
+
+type tracesResponse struct {
+	Data   []Trace `json:"data"`
+	Errors []struct {
+		Msg string `json:"msg"`
+	} `json:"errors"`
+}
+
+// Traces returns the recent traces of a service.
+// It returns an error on any problem.
+func (in *Client) Traces(service string, lookback time.Duration, limit int) ([]Trace, error) {
+	params := url.Values{}
+	params.Set("service", service)
+	params.Set("start", strconv.FormatInt(time.Now().Add(-lookback).UnixNano()/1000, 10))
+	params.Set("limit", strconv.Itoa(limit))
+	resp, err := in.http.Get(in.url + "/api/traces?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response tracesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("Jaeger traces of %s can't be read: %v", service, err)
+	}
+	if len(response.Errors) > 0 {
+		return nil, fmt.Errorf("Jaeger traces of %s can't be found: %s", service, response.Errors[0].Msg)
+	}
+	return response.Data, nil
+}
@@ -0,0 +1,426 @@
+package kubernetes
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/api/apps/v1beta1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	apps_listers "k8s.io/client-go/listers/apps/v1beta1"
+	core_listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/devtio/canary/log"
+)
+
+// objectCache keeps the objects canary lists in memory, up to date with the cluster through watches.
+// Objects read from it are shared with the informers, they are always copied before being returned.
+type objectCache struct {
+	virtualServices  cache.Indexer
+	gateways         cache.Indexer
+	destinationRules cache.Indexer
+	services         core_listers.ServiceLister
+	pods             core_listers.PodLister
+	deployments      apps_listers.DeploymentLister
+	namespaces       core_listers.NamespaceLister
+	configMaps       core_listers.ConfigMapLister
+
+	// synced is closed once every informer has listed its objects
+	synced chan struct{}
+
+	// writes are the Istio objects canary wrote that the informers haven't received yet, by indexer and key
+	writesLock sync.Mutex
+	writes     map[cache.Indexer]map[string]pendingWrite
+	// configMapWrites are the resource versions of the config maps canary wrote, by key, until the informer receives them
+	configMapWrites map[string]string
+
+	subscribersLock sync.Mutex
+	subscribers     map[*subscriber]bool
+}
+
+// configMapSelector selects the config maps canary keeps its state in, the only ones it caches
+const configMapSelector = "app=canary"
+
+// pendingWriteTTL is how long an object canary wrote is served instead of the cached one, if the informer doesn't receive it
+const pendingWriteTTL = 30 * time.Second
+
+// pendingWrite is an Istio object as canary wrote it
+type pendingWrite struct {
+	object  IstioObject
+	written time.Time
+}
+
+// ObjectEvent is a change of a watched object: Old is nil when the object was added, New is nil when it was deleted.
+// The objects are shared with the cache and must not be modified.
+type ObjectEvent struct {
+	Old runtime.Object
+	New runtime.Object
+}
+
+// watchBufferSize is the number of events a subscriber can fall behind before its subscription is closed
+const watchBufferSize = 100
+
+type subscriber struct {
+	namespace string
+	events    chan ObjectEvent
+}
+
+// StartCache starts the informers watching the VirtualServices, Gateways, DestinationRules, Services, Deployments
+// and Pods of every namespace, the namespaces and the config maps of canary, until stop is closed.
+// The list methods of the client serve reads from the cache once it is synced, and query the API until then.
+// The VirtualServices and DestinationRules the client writes are read back before the informers receive them,
+// the config maps it writes are read from the API until then.
+// It must be called once, before the client is used by other goroutines.
+func (in *IstioClient) StartCache(stop <-chan struct{}) {
+	virtualServiceInformer := newIstioInformer(in.istioNetworkingApi, virtualServices, &VirtualService{})
+	gatewayInformer := newIstioInformer(in.istioNetworkingApi, gateways, &Gateway{})
+	destinationRuleInformer := newIstioInformer(in.istioNetworkingApi, destinationRules, &DestinationRule{})
+
+	factory := informers.NewSharedInformerFactory(in.k8s, 0)
+	serviceInformer := factory.Core().V1().Services()
+	podInformer := factory.Core().V1().Pods()
+	deploymentInformer := factory.Apps().V1beta1().Deployments()
+	namespaceInformer := factory.Core().V1().Namespaces()
+	configMapFactory := informers.NewFilteredSharedInformerFactory(in.k8s, 0, meta_v1.NamespaceAll, func(options *meta_v1.ListOptions) {
+		options.LabelSelector = configMapSelector
+	})
+	configMapInformer := configMapFactory.Core().V1().ConfigMaps()
+
+	c := &objectCache{
+		virtualServices:  virtualServiceInformer.GetIndexer(),
+		gateways:         gatewayInformer.GetIndexer(),
+		destinationRules: destinationRuleInformer.GetIndexer(),
+		services:         serviceInformer.Lister(),
+		pods:             podInformer.Lister(),
+		deployments:      deploymentInformer.Lister(),
+		namespaces:       namespaceInformer.Lister(),
+		configMaps:       configMapInformer.Lister(),
+		synced:           make(chan struct{}),
+		subscribers:      map[*subscriber]bool{},
+	}
+	for _, informer := range []cache.SharedIndexInformer{
+		virtualServiceInformer,
+		gatewayInformer,
+		destinationRuleInformer,
+		podInformer.Informer(),
+	} {
+		informer.AddEventHandler(c.eventHandler())
+	}
+	hasSynced := []cache.InformerSynced{
+		virtualServiceInformer.HasSynced,
+		gatewayInformer.HasSynced,
+		destinationRuleInformer.HasSynced,
+		serviceInformer.Informer().HasSynced,
+		podInformer.Informer().HasSynced,
+		deploymentInformer.Informer().HasSynced,
+		namespaceInformer.Informer().HasSynced,
+		configMapInformer.Informer().HasSynced,
+	}
+	in.cache = c
+
+	go virtualServiceInformer.Run(stop)
+	go gatewayInformer.Run(stop)
+	go destinationRuleInformer.Run(stop)
+	factory.Start(stop)
+	configMapFactory.Start(stop)
+	go func() {
+		if cache.WaitForCacheSync(stop, hasSynced...) {
+			log.Info("Object cache synced, reads are served from the cache")
+			close(c.synced)
+		}
+	}()
+}
+
+// Watch returns the changes of the VirtualServices, Gateways, DestinationRules and Pods of a namespace as the cache
+// receives them, until stop is called.
+// The channel is closed by stop, or when the receiver falls too far behind.
+// It returns an error if the cache isn't started.
+func (in *IstioClient) Watch(namespace string) (<-chan ObjectEvent, func(), error) {
+	if in.cache == nil {
+		return nil, nil, fmt.Errorf("changes can't be watched, the object cache isn't started")
+	}
+	events, stop := in.cache.subscribe(namespace)
+	return events, stop, nil
+}
+
+func newIstioInformer(client cache.Getter, resource string, objectType runtime.Object) cache.SharedIndexInformer {
+	listWatch := cache.NewListWatchFromClient(client, resource, meta_v1.NamespaceAll, fields.Everything())
+	return cache.NewSharedIndexInformer(listWatch, objectType, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+}
+
+// isSynced returns true if reads can be served from the cache
+func (c *objectCache) isSynced() bool {
+	if c == nil {
+		return false
+	}
+	select {
+	case <-c.synced:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *objectCache) subscribe(namespace string) (<-chan ObjectEvent, func()) {
+	s := &subscriber{namespace: namespace, events: make(chan ObjectEvent, watchBufferSize)}
+	c.subscribersLock.Lock()
+	c.subscribers[s] = true
+	c.subscribersLock.Unlock()
+	stop := func() {
+		c.subscribersLock.Lock()
+		defer c.subscribersLock.Unlock()
+		c.unsubscribe(s)
+	}
+	return s.events, stop
+}
+
+// unsubscribe must be called with the subscribersLock held
+func (c *objectCache) unsubscribe(s *subscriber) {
+	if c.subscribers[s] {
+		delete(c.subscribers, s)
+		close(s.events)
+	}
+}
+
+func (c *objectCache) eventHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.publish(nil, obj)
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			c.publish(old, obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			c.publish(obj, nil)
+		},
+	}
+}
+
+// publish sends a change to the subscribers of the namespace of the object, without waiting for them
+func (c *objectCache) publish(old, obj interface{}) {
+	event := ObjectEvent{}
+	event.Old, _ = old.(runtime.Object)
+	event.New, _ = obj.(runtime.Object)
+	object := event.New
+	if object == nil {
+		object = event.Old
+	}
+	accessor, err := meta.Accessor(object)
+	if err != nil {
+		log.Errorf("Change of a %T can't be published: %v", object, err)
+		return
+	}
+
+	c.subscribersLock.Lock()
+	defer c.subscribersLock.Unlock()
+	for s := range c.subscribers {
+		if s.namespace != accessor.GetNamespace() {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			log.Warningf("Watch of namespace %s fell %d changes behind, it is closed", s.namespace, watchBufferSize)
+			c.unsubscribe(s)
+		}
+	}
+}
+
+// istioObjects returns copies of the cached Istio objects of a namespace, sorted by name as the API lists them.
+// The objects canary wrote replace the cached ones until the informer receives them, see wrote.
+func (c *objectCache) istioObjects(indexer cache.Indexer, namespace string) ([]IstioObject, error) {
+	items, err := indexer.ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]IstioObject, len(items))
+	for _, item := range items {
+		object, ok := item.(IstioObject)
+		if !ok {
+			return nil, fmt.Errorf("the cache of namespace %s holds a %T instead of an Istio object", namespace, item)
+		}
+		byName[object.GetObjectMeta().Name] = object
+	}
+	c.applyWrites(indexer, namespace, byName, time.Now())
+	objects := make([]IstioObject, 0, len(byName))
+	for _, object := range byName {
+		objects = append(objects, copyIstioObject(object))
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].GetObjectMeta().Name < objects[j].GetObjectMeta().Name
+	})
+	return objects, nil
+}
+
+// wrote keeps an Istio object canary created or updated, so the reads that follow see it before the informer
+// of the indexer receives it. It does nothing until the cache is synced, as reads query the API until then.
+func (c *objectCache) wrote(indexer cache.Indexer, object IstioObject) {
+	if !c.isSynced() {
+		return
+	}
+	meta := object.GetObjectMeta()
+	key := meta.Namespace + "/" + meta.Name
+	c.writesLock.Lock()
+	defer c.writesLock.Unlock()
+	if c.writes == nil {
+		c.writes = map[cache.Indexer]map[string]pendingWrite{}
+	}
+	if c.writes[indexer] == nil {
+		c.writes[indexer] = map[string]pendingWrite{}
+	}
+	c.writes[indexer][key] = pendingWrite{object: copyIstioObject(object), written: time.Now()}
+}
+
+func (c *objectCache) wroteVirtualService(virtualService IstioObject) {
+	if c != nil {
+		c.wrote(c.virtualServices, virtualService)
+	}
+}
+
+func (c *objectCache) wroteDestinationRule(destinationRule IstioObject) {
+	if c != nil {
+		c.wrote(c.destinationRules, destinationRule)
+	}
+}
+
+// applyWrites replaces the cached objects of a namespace by the ones canary wrote since,
+// and forgets the writes the informer received, or that are older than pendingWriteTTL
+func (c *objectCache) applyWrites(indexer cache.Indexer, namespace string, objects map[string]IstioObject, now time.Time) {
+	c.writesLock.Lock()
+	defer c.writesLock.Unlock()
+	for key, write := range c.writes[indexer] {
+		meta := write.object.GetObjectMeta()
+		if meta.Namespace != namespace {
+			continue
+		}
+		cached, ok := objects[meta.Name]
+		if (ok && !olderResourceVersion(cached.GetObjectMeta().ResourceVersion, meta.ResourceVersion)) || now.Sub(write.written) > pendingWriteTTL {
+			delete(c.writes[indexer], key)
+			continue
+		}
+		objects[meta.Name] = write.object
+	}
+}
+
+// olderResourceVersion returns true if the resource version is older than the other one.
+// Resource versions are opaque, but etcd's are increasing integers: other versions are never older.
+func olderResourceVersion(version, other string) bool {
+	v, err := strconv.ParseUint(version, 10, 64)
+	if err != nil {
+		return false
+	}
+	o, err := strconv.ParseUint(other, 10, 64)
+	return err == nil && v < o
+}
+
+// copyIstioObject copies the spec too, DeepCopyIstioObject shares it with the original object
+func copyIstioObject(object IstioObject) IstioObject {
+	copied := object.DeepCopyIstioObject()
+	if spec := object.GetSpec(); spec != nil {
+		copied.SetSpec(runtime.DeepCopyJSON(spec))
+	}
+	return copied
+}
+
+func (c *objectCache) serviceList(namespace string) (*v1.ServiceList, error) {
+	services, err := c.services.Services(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	list := &v1.ServiceList{Items: make([]v1.Service, 0, len(services))}
+	for _, service := range services {
+		list.Items = append(list.Items, *service.DeepCopy())
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+	return list, nil
+}
+
+func (c *objectCache) podList(namespace string, selector labels.Selector) (*v1.PodList, error) {
+	pods, err := c.pods.Pods(namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+	list := &v1.PodList{Items: make([]v1.Pod, 0, len(pods))}
+	for _, pod := range pods {
+		list.Items = append(list.Items, *pod.DeepCopy())
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+	return list, nil
+}
+
+func (c *objectCache) deploymentList(namespace string) (*v1beta1.DeploymentList, error) {
+	deployments, err := c.deployments.Deployments(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	list := &v1beta1.DeploymentList{Items: make([]v1beta1.Deployment, 0, len(deployments))}
+	for _, deployment := range deployments {
+		list.Items = append(list.Items, *deployment.DeepCopy())
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+	return list, nil
+}
+
+func (c *objectCache) namespaceList() (*v1.NamespaceList, error) {
+	namespaces, err := c.namespaces.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	list := &v1.NamespaceList{Items: make([]v1.Namespace, 0, len(namespaces))}
+	for _, namespace := range namespaces {
+		list.Items = append(list.Items, *namespace.DeepCopy())
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+	return list, nil
+}
+
+// configMap returns a copy of a cached config map of canary, or a not found error if there is none.
+// It returns false if the config map must be read from the API, as canary wrote a version the informer hasn't received yet.
+func (c *objectCache) configMap(namespace, name string) (*v1.ConfigMap, bool, error) {
+	cached, err := c.configMaps.ConfigMaps(namespace).Get(name)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, true, err
+	}
+	key := namespace + "/" + name
+	c.writesLock.Lock()
+	written, ok := c.configMapWrites[key]
+	if ok && cached != nil && !olderResourceVersion(cached.ResourceVersion, written) {
+		delete(c.configMapWrites, key)
+		ok = false
+	}
+	c.writesLock.Unlock()
+	if ok {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	return cached.DeepCopy(), true, nil
+}
+
+// wroteConfigMap keeps the resource version of a config map canary created or updated, so it is read from the API
+// until the informer receives it. It does nothing until the cache is synced, as reads query the API until then.
+func (c *objectCache) wroteConfigMap(configMap *v1.ConfigMap) {
+	if !c.isSynced() || configMap == nil {
+		return
+	}
+	c.writesLock.Lock()
+	defer c.writesLock.Unlock()
+	if c.configMapWrites == nil {
+		c.configMapWrites = map[string]string{}
+	}
+	c.configMapWrites[configMap.Namespace+"/"+configMap.Name] = configMap.ResourceVersion
+}
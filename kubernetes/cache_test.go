@@ -0,0 +1,164 @@
+package kubernetes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	core_listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newIndexer() cache.Indexer {
+	return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+}
+
+func syncedCache() *objectCache {
+	c := &objectCache{
+		virtualServices: newIndexer(),
+		synced:          make(chan struct{}),
+	}
+	close(c.synced)
+	return c
+}
+
+func TestCachedVirtualServices(t *testing.T) {
+	c := syncedCache()
+	for _, vs := range []*VirtualService{
+		{ObjectMeta: meta_v1.ObjectMeta{Name: "reviews", Namespace: "bookinfo"}, Spec: map[string]interface{}{"hosts": []interface{}{"reviews"}}},
+		{ObjectMeta: meta_v1.ObjectMeta{Name: "bookinfo", Namespace: "bookinfo"}, Spec: map[string]interface{}{"hosts": []interface{}{"*"}}},
+		{ObjectMeta: meta_v1.ObjectMeta{Name: "reviews", Namespace: "other"}, Spec: map[string]interface{}{"hosts": []interface{}{"reviews"}}},
+	} {
+		assert.NoError(t, c.virtualServices.Add(vs))
+	}
+	client := &IstioClient{cache: c}
+
+	virtualServices, err := client.GetVirtualServices("bookinfo", "")
+	assert.NoError(t, err)
+	assert.Len(t, virtualServices, 2)
+	assert.Equal(t, "bookinfo", virtualServices[0].GetObjectMeta().Name)
+	assert.Equal(t, "reviews", virtualServices[1].GetObjectMeta().Name)
+
+	virtualServices, err = client.GetVirtualServices("bookinfo", "reviews")
+	assert.NoError(t, err)
+	assert.Len(t, virtualServices, 1)
+
+	// modifying a returned object leaves the cache untouched
+	virtualServices[0].GetSpec()["hosts"].([]interface{})[0] = "ratings"
+	virtualServices, _ = client.GetVirtualServices("bookinfo", "reviews")
+	assert.Len(t, virtualServices, 1)
+}
+
+func TestCachedWrites(t *testing.T) {
+	c := syncedCache()
+	cached := &VirtualService{ObjectMeta: meta_v1.ObjectMeta{Name: "reviews", Namespace: "bookinfo", ResourceVersion: "1"}, Spec: map[string]interface{}{"hosts": []interface{}{"reviews"}}}
+	assert.NoError(t, c.virtualServices.Add(cached))
+	client := &IstioClient{cache: c}
+
+	// the objects written are read back before the informer receives them
+	updated := cached.DeepCopyIstioObject()
+	updated.SetObjectMeta(meta_v1.ObjectMeta{Name: "reviews", Namespace: "bookinfo", ResourceVersion: "2"})
+	c.wroteVirtualService(updated)
+	created := &VirtualService{ObjectMeta: meta_v1.ObjectMeta{Name: "ratings", Namespace: "bookinfo", ResourceVersion: "3"}}
+	c.wroteVirtualService(created)
+	virtualServices, err := client.GetVirtualServices("bookinfo", "")
+	assert.NoError(t, err)
+	assert.Len(t, virtualServices, 2)
+	assert.Equal(t, "ratings", virtualServices[0].GetObjectMeta().Name)
+	assert.Equal(t, "2", virtualServices[1].GetObjectMeta().ResourceVersion)
+
+	// once the informer receives a write, or a later change, the cached object is read
+	later := cached.DeepCopyIstioObject().(*VirtualService)
+	later.ResourceVersion = "4"
+	assert.NoError(t, c.virtualServices.Update(later))
+	virtualServices, _ = client.GetVirtualServices("bookinfo", "")
+	assert.Equal(t, "4", virtualServices[1].GetObjectMeta().ResourceVersion)
+	assert.Len(t, c.writes[c.virtualServices], 1)
+
+	// writes the informer never receives are forgotten
+	c.applyWrites(c.virtualServices, "bookinfo", map[string]IstioObject{}, time.Now().Add(pendingWriteTTL+time.Second))
+	assert.Empty(t, c.writes[c.virtualServices])
+}
+
+func TestCachedPods(t *testing.T) {
+	indexer := newIndexer()
+	c := syncedCache()
+	c.pods = core_listers.NewPodLister(indexer)
+	for _, pod := range []*v1.Pod{
+		{ObjectMeta: meta_v1.ObjectMeta{Name: "reviews-v1", Namespace: "bookinfo", Labels: map[string]string{"app": "reviews", "version": "v1"}}},
+		{ObjectMeta: meta_v1.ObjectMeta{Name: "reviews-v2", Namespace: "bookinfo", Labels: map[string]string{"app": "reviews", "version": "v2"}}},
+		{ObjectMeta: meta_v1.ObjectMeta{Name: "ratings-v1", Namespace: "bookinfo", Labels: map[string]string{"app": "ratings", "version": "v1"}}},
+	} {
+		assert.NoError(t, indexer.Add(pod))
+	}
+	client := &IstioClient{cache: c}
+
+	pods, err := client.GetPods("bookinfo", "app=reviews")
+	assert.NoError(t, err)
+	assert.Len(t, pods.Items, 2)
+	assert.Equal(t, "reviews-v1", pods.Items[0].Name)
+
+	pods, err = client.GetNamespacePods("bookinfo")
+	assert.NoError(t, err)
+	assert.Len(t, pods.Items, 3)
+
+	_, err = client.GetPods("bookinfo", "app in (")
+	assert.Error(t, err)
+}
+
+func TestCachedConfigMaps(t *testing.T) {
+	indexer := newIndexer()
+	c := syncedCache()
+	c.configMaps = core_listers.NewConfigMapLister(indexer)
+	assert.NoError(t, indexer.Add(&v1.ConfigMap{ObjectMeta: meta_v1.ObjectMeta{Name: "canary-releases", Namespace: "bookinfo", ResourceVersion: "5"}}))
+
+	configMap, cached, err := c.configMap("bookinfo", "canary-releases")
+	assert.NoError(t, err)
+	assert.True(t, cached)
+	assert.Equal(t, "5", configMap.ResourceVersion)
+	_, cached, err = c.configMap("other", "canary-releases")
+	assert.True(t, cached)
+	assert.True(t, errors.IsNotFound(err))
+
+	// a config map canary wrote is read from the API until the informer receives it
+	c.wroteConfigMap(&v1.ConfigMap{ObjectMeta: meta_v1.ObjectMeta{Name: "canary-releases", Namespace: "bookinfo", ResourceVersion: "7"}})
+	_, cached, _ = c.configMap("bookinfo", "canary-releases")
+	assert.False(t, cached)
+	assert.NoError(t, indexer.Update(&v1.ConfigMap{ObjectMeta: meta_v1.ObjectMeta{Name: "canary-releases", Namespace: "bookinfo", ResourceVersion: "7"}}))
+	configMap, cached, _ = c.configMap("bookinfo", "canary-releases")
+	assert.True(t, cached)
+	assert.Equal(t, "7", configMap.ResourceVersion)
+	assert.Empty(t, c.configMapWrites)
+}
+
+func TestWatch(t *testing.T) {
+	c := syncedCache()
+	c.subscribers = map[*subscriber]bool{}
+	client := &IstioClient{cache: c}
+
+	events, stop, err := client.Watch("bookinfo")
+	assert.NoError(t, err)
+	c.publish(nil, &v1.Pod{ObjectMeta: meta_v1.ObjectMeta{Name: "other", Namespace: "other"}})
+	c.publish(nil, &v1.Pod{ObjectMeta: meta_v1.ObjectMeta{Name: "reviews-v1", Namespace: "bookinfo"}})
+	event := <-events
+	assert.Nil(t, event.Old)
+	assert.Equal(t, "reviews-v1", event.New.(*v1.Pod).Name)
+	stop()
+	_, open := <-events
+	assert.False(t, open)
+	stop()
+
+	// a subscriber that falls behind is closed
+	events, _, _ = client.Watch("bookinfo")
+	for i := 0; i <= watchBufferSize; i++ {
+		c.publish(nil, &v1.Pod{ObjectMeta: meta_v1.ObjectMeta{Name: "reviews-v1", Namespace: "bookinfo"}})
+	}
+	assert.Len(t, events, watchBufferSize)
+	assert.Empty(t, c.subscribers)
+
+	_, _, err = (&IstioClient{}).Watch("bookinfo")
+	assert.Error(t, err)
+}
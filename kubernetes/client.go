@@ -4,6 +4,7 @@ import (
 	"flag"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"k8s.io/api/apps/v1beta1"
 	"k8s.io/api/core/v1"
@@ -58,12 +59,22 @@ type IstioClientInterface interface {
 	PutVirtualService(namespace string, virtualservice IstioObject) (IstioObject, error)
 	GetDestinationRules(namespace string, serviceName string) ([]IstioObject, error)
 	GetDestinationRule(namespace string, destinationrule string) (IstioObject, error)
+	CreateDestinationRule(namespace string, destinationrule IstioObject) (IstioObject, error)
+	PutDestinationRule(namespace string, destinationrule IstioObject) (IstioObject, error)
 	GetIstioRules(namespace string) (*IstioRules, error)
 	GetIstioRuleDetails(namespace string, istiorule string) (*IstioRuleDetails, error)
 	GetQuotaSpecs(namespace string) ([]IstioObject, error)
 	GetQuotaSpec(namespace string, quotaSpecName string) (IstioObject, error)
 	GetQuotaSpecBindings(namespace string) ([]IstioObject, error)
 	GetQuotaSpecBinding(namespace string, quotaSpecBindingName string) (IstioObject, error)
+	GetConfigMap(namespace string, name string) (*v1.ConfigMap, error)
+	CreateConfigMap(namespace string, configMap *v1.ConfigMap) (*v1.ConfigMap, error)
+	UpdateConfigMap(namespace string, configMap *v1.ConfigMap) (*v1.ConfigMap, error)
+	GetDeployments(namespace string) (*v1beta1.DeploymentList, error)
+	GetDeployment(namespace string, name string) (*v1beta1.Deployment, error)
+	CreateDeployment(namespace string, deployment *v1beta1.Deployment) (*v1beta1.Deployment, error)
+	DeleteDeployment(namespace string, name string) error
+	ProxyPodGet(namespace string, pod string, port int, path string, headers map[string]string) (int, error)
 }
 
 // IstioClient is the client struct for Kubernetes and Istio APIs
@@ -73,10 +84,16 @@ type IstioClient struct {
 	k8s                *kube.Clientset
 	istioConfigApi     *rest.RESTClient
 	istioNetworkingApi *rest.RESTClient
+	cache              *objectCache
 }
 
-var kubeconfigSet = false
-var kubeconfig *string
+var kubeconfig = flag.String("kubeconfig", defaultKubeconfig(), "(optional) absolute path to the kubeconfig file")
+
+var (
+	// sharedClients are the clients of the cluster canary runs in, keyed by an empty context, and of the contexts of the kubeconfig
+	sharedClients     = map[string]*IstioClient{}
+	sharedClientsLock sync.Mutex
+)
 
 // ConfigClient return a client with the correct configuration
 // Returns configuration if Canary is in Cluster when InCluster is true
@@ -84,25 +101,29 @@ var kubeconfig *string
 // It returns an error on any problem
 func ConfigClient() (*rest.Config, error) {
 
-	// replace with code from https://github.com/kubernetes/client-go/blob/master/examples/out-of-cluster-client-configuration/main.go
-	if !kubeconfigSet {
-		if home := homeDir(); home != "" {
-			kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
-		} else {
-			kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
-		}
-		flag.Parse()
-		kubeconfigSet = true
-	}
 	// use the current context in kubeconfig
 	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
 	if err != nil {
 		return rest.InClusterConfig()
-		panic(err.Error())
 	}
 	return config, nil
 }
 
+// ContextConfig returns the configuration of a context of the kubeconfig.
+// It returns an error on any problem, including a context that doesn't exist.
+func ContextConfig(context string) (*rest.Config, error) {
+	loadingRules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: *kubeconfig}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+}
+
+func defaultKubeconfig() string {
+	if home := homeDir(); home != "" {
+		return filepath.Join(home, ".kube", "config")
+	}
+	return ""
+}
+
 func homeDir() string {
 	if h := os.Getenv("HOME"); h != "" {
 		return h
@@ -110,19 +131,54 @@ func homeDir() string {
 	return os.Getenv("USERPROFILE") // windows
 }
 
+// GetClient returns the client shared by the handlers and controllers of canary, creating it on first use.
+// It returns an error on any problem, the next call tries to create it again.
+func GetClient() (*IstioClient, error) {
+	return GetContextClient("")
+}
+
+// GetContextClient returns the shared client of a context of the kubeconfig, creating it on first use.
+// An empty context is the cluster canary runs in, see GetClient.
+// It returns an error on any problem, the next call tries to create it again.
+func GetContextClient(context string) (*IstioClient, error) {
+	sharedClientsLock.Lock()
+	defer sharedClientsLock.Unlock()
+	if client, ok := sharedClients[context]; ok {
+		return client, nil
+	}
+	var config *rest.Config
+	var err error
+	if context == "" {
+		config, err = ConfigClient()
+	} else {
+		config, err = ContextConfig(context)
+	}
+	if err != nil {
+		return nil, err
+	}
+	client, err := newClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	sharedClients[context] = client
+	return client, nil
+}
+
 // NewClient creates a new client to the Kubernetes and Istio APIs.
 // It takes the assumption that Istio is deployed into the cluster.
 // It hides the access to Kubernetes/Openshift credentials.
 // It hides the low level use of the API of Kubernetes and Istio, it should be considered as an implementation detail.
 // It returns an error on any problem.
 func NewClient() (*IstioClient, error) {
-	client := IstioClient{}
 	config, err := ConfigClient()
-
 	if err != nil {
 		return nil, err
 	}
+	return newClientForConfig(config)
+}
 
+func newClientForConfig(config *rest.Config) (*IstioClient, error) {
+	client := IstioClient{}
 	config.QPS = k8sQPS
 	config.Burst = k8sBurst
 
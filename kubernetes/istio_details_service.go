@@ -7,7 +7,6 @@ import (
 	"github.com/devtio/canary/config"
 	"github.com/devtio/canary/log"
 	"k8s.io/api/core/v1"
-	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // GetIstioDetails returns Istio details for a given namespace,
@@ -81,6 +80,7 @@ func (in *IstioClient) CreateVirtualService(namespace string, virtualServiceToBe
 		log.Error("no virtual service object returned")
 		return nil, fmt.Errorf("%s doesn't return a VirtualService object", namespace)
 	}
+	in.cache.wroteVirtualService(virtualService)
 	return virtualService.DeepCopyIstioObject(), nil
 }
 
@@ -99,6 +99,7 @@ func (in *IstioClient) PutVirtualService(namespace string, virtualServiceToBeCre
 		log.Error("no virtual service object returned")
 		return nil, fmt.Errorf("%s doesn't return a VirtualService object", namespace)
 	}
+	in.cache.wroteVirtualService(virtualService)
 	return virtualService.DeepCopyIstioObject(), nil
 }
 
@@ -184,26 +185,39 @@ func (in *IstioClient) GetDestinationPolicy(namespace string, destinationpolicy
 // If serviceName param is provided it will filter all VirtualServices having a host defined on a particular service.
 // It returns an error on any problem.
 func (in *IstioClient) GetVirtualServices(namespace string, serviceName string) ([]IstioObject, error) {
+	items, err := in.listVirtualServices(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	virtualServices := make([]IstioObject, 0)
+	for _, virtualService := range items {
+		if serviceName == "" || FilterByHost(virtualService.GetSpec(), serviceName) {
+			virtualServices = append(virtualServices, virtualService)
+		}
+	}
+	return virtualServices, nil
+}
+
+// listVirtualServices returns copies of the VirtualServices of a namespace, from the cache once it is synced
+func (in *IstioClient) listVirtualServices(namespace string) ([]IstioObject, error) {
+	if in.cache.isSynced() {
+		return in.cache.istioObjects(in.cache.virtualServices, namespace)
+	}
 	result, err := in.istioNetworkingApi.Get().Namespace(namespace).Resource(virtualServices).Do().Get()
 	if err != nil {
 		return nil, err
 	}
 	virtualServiceList, ok := result.(*VirtualServiceList)
 	if !ok {
-		return nil, fmt.Errorf("%s/%s doesn't return a VirtualService list", namespace, serviceName)
+		return nil, fmt.Errorf("%s doesn't return a VirtualService list", namespace)
 	}
 
-	virtualServices := make([]IstioObject, 0)
+	items := make([]IstioObject, 0, len(virtualServiceList.Items))
 	for _, virtualService := range virtualServiceList.GetItems() {
-		appendVirtualService := serviceName == ""
-		if !appendVirtualService && FilterByHost(virtualService.GetSpec(), serviceName) {
-			appendVirtualService = true
-		}
-		if appendVirtualService {
-			virtualServices = append(virtualServices, virtualService.DeepCopyIstioObject())
-		}
+		items = append(items, virtualService.DeepCopyIstioObject())
 	}
-	return virtualServices, nil
+	return items, nil
 }
 
 func (in *IstioClient) GetVirtualService(namespace string, virtualservice string) (IstioObject, error) {
@@ -223,30 +237,79 @@ func (in *IstioClient) GetVirtualService(namespace string, virtualservice string
 // If serviceName param is provided it will filter all DestinationRules having a host defined on a particular service.
 // It returns an error on any problem.
 func (in *IstioClient) GetDestinationRules(namespace string, serviceName string) ([]IstioObject, error) {
-	result, err := in.istioNetworkingApi.Get().Namespace(namespace).Resource(destinationRules).Do().Get()
+	items, err := in.listDestinationRules(namespace)
 	if err != nil {
 		return nil, err
 	}
-	destinationRuleList, ok := result.(*DestinationRuleList)
-	if !ok {
-		return nil, fmt.Errorf("%s/%s doesn't return a DestinationRule list", namespace, serviceName)
-	}
 
 	destinationRules := make([]IstioObject, 0)
-	for _, destinationRule := range destinationRuleList.Items {
+	for _, destinationRule := range items {
 		appendDestinationRule := serviceName == ""
-		if name, ok := destinationRule.Spec["name"]; ok {
+		if name, ok := destinationRuleService(destinationRule.GetSpec()); ok {
 			if name == serviceName {
 				appendDestinationRule = true
 			}
 		}
 		if appendDestinationRule {
-			destinationRules = append(destinationRules, destinationRule.DeepCopyIstioObject())
+			destinationRules = append(destinationRules, destinationRule)
 		}
 	}
 	return destinationRules, nil
 }
 
+// listDestinationRules returns copies of the DestinationRules of a namespace, from the cache once it is synced
+func (in *IstioClient) listDestinationRules(namespace string) ([]IstioObject, error) {
+	if in.cache.isSynced() {
+		return in.cache.istioObjects(in.cache.destinationRules, namespace)
+	}
+	result, err := in.istioNetworkingApi.Get().Namespace(namespace).Resource(destinationRules).Do().Get()
+	if err != nil {
+		return nil, err
+	}
+	destinationRuleList, ok := result.(*DestinationRuleList)
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't return a DestinationRule list", namespace)
+	}
+
+	items := make([]IstioObject, 0, len(destinationRuleList.Items))
+	for _, destinationRule := range destinationRuleList.GetItems() {
+		items = append(items, destinationRule.DeepCopyIstioObject())
+	}
+	return items, nil
+}
+
+// CreateDestinationRule creates a destination rule.
+// It returns an error on any problem.
+func (in *IstioClient) CreateDestinationRule(namespace string, destinationRuleToBeCreated IstioObject) (IstioObject, error) {
+	result, err := in.istioNetworkingApi.Post().Namespace(namespace).Resource(destinationRules).Body(destinationRuleToBeCreated).Do().Get()
+	if err != nil {
+		return nil, err
+	}
+	destinationRule, ok := result.(*DestinationRule)
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't return a DestinationRule object", namespace)
+	}
+	in.cache.wroteDestinationRule(destinationRule)
+	return destinationRule.DeepCopyIstioObject(), nil
+}
+
+// PutDestinationRule modifies a destination rule.
+// The resourceVersion of the destination rule is checked, so it fails with a conflict if it was modified since it was read.
+// It returns an error on any problem.
+func (in *IstioClient) PutDestinationRule(namespace string, destinationRuleToBeUpdated IstioObject) (IstioObject, error) {
+	name := destinationRuleToBeUpdated.GetObjectMeta().Name
+	result, err := in.istioNetworkingApi.Put().Namespace(namespace).Resource(destinationRules).Body(destinationRuleToBeUpdated).Name(name).Do().Get()
+	if err != nil {
+		return nil, err
+	}
+	destinationRule, ok := result.(*DestinationRule)
+	if !ok {
+		return nil, fmt.Errorf("%s/%s doesn't return a DestinationRule object", namespace, name)
+	}
+	in.cache.wroteDestinationRule(destinationRule)
+	return destinationRule.DeepCopyIstioObject(), nil
+}
+
 func (in *IstioClient) GetDestinationRule(namespace string, destinationrule string) (IstioObject, error) {
 	result, err := in.istioNetworkingApi.Get().Namespace(namespace).Resource(destinationRules).SubResource(destinationrule).Do().Get()
 	if err != nil {
@@ -322,7 +385,7 @@ func GetDestinationRulesSubsets(destinationRules []IstioObject, serviceName, ver
 	cfg := config.Get()
 	foundSubsets := make([]string, 0)
 	for _, destinationRule := range destinationRules {
-		if dName, ok := destinationRule.GetSpec()["name"]; ok && dName == serviceName {
+		if dName, ok := destinationRuleService(destinationRule.GetSpec()); ok && dName == serviceName {
 			if subsets, ok := destinationRule.GetSpec()["subsets"]; ok {
 				if dSubsets, ok := subsets.([]interface{}); ok {
 					for _, subset := range dSubsets {
@@ -344,6 +407,15 @@ func GetDestinationRulesSubsets(destinationRules []IstioObject, serviceName, ver
 	return foundSubsets
 }
 
+// destinationRuleService returns the service of a DestinationRule spec, from host or from name for older DestinationRules
+func destinationRuleService(spec map[string]interface{}) (interface{}, bool) {
+	if host, ok := spec["host"]; ok {
+		return host, true
+	}
+	name, ok := spec["name"]
+	return name, ok
+}
+
 // CheckDestinationRuleCircuitBreaker returns true if the destinationRule object includes a trafficPolicy configuration
 // on connectionPool or outlierDetection.
 // TrafficPolicy configuration can be defined at service level or per subset defined by a version.
@@ -474,6 +546,9 @@ func FilterByHost(spec map[string]interface{}, hostName string) bool {
 // GetGateways return all Gateways for a given namespace.
 // It returns an error on any problem.
 func (in *IstioClient) GetGateways(namespace string) ([]IstioObject, error) {
+	if in.cache.isSynced() {
+		return in.cache.istioObjects(in.cache.gateways, namespace)
+	}
 	result, err := in.istioNetworkingApi.Get().Namespace(namespace).Resource(gateways).Do().Get()
 	if err != nil {
 		return nil, err
@@ -507,10 +582,9 @@ func (in *IstioClient) GetGateway(namespace string, gateway string) (IstioObject
 // It returns an error on any problem.
 func (in *IstioClient) GetNamespacePodsByRelease(namespace string, release string) (*v1.PodList, error) {
 	fmt.Println("Called method GetNamespacePodsByRelease")
-	podList, err := in.k8s.CoreV1().Pods(namespace).List(meta_v1.ListOptions{LabelSelector: "release=" + release})
-	pods := podList.Items
+	podList, err := in.GetPods(namespace, "release="+release)
 	if err == nil {
-		for _, pod := range pods {
+		for _, pod := range podList.Items {
 			fmt.Println("Pod found: ", pod.Name, ", release: ", pod.Labels["release"])
 		}
 	}
@@ -312,6 +312,20 @@ func TestGetDestinationRulesSubsets(t *testing.T) {
 	destinationRules := []IstioObject{&destinationRule1, &destinationRule2}
 
 	assert.Equal(t, []string{"v2", "testversion"}, GetDestinationRulesSubsets(destinationRules, "reviews", "v2"))
+
+	destinationRule3 := MockIstioObject{
+		Spec: map[string]interface{}{
+			"host": "ratings",
+			"subsets": []interface{}{
+				map[string]interface{}{
+					"name":   "v2",
+					"labels": map[string]interface{}{"version": "v2"},
+				},
+			},
+		},
+	}
+	destinationRules = append(destinationRules, &destinationRule3)
+	assert.Equal(t, []string{"v2"}, GetDestinationRulesSubsets(destinationRules, "ratings", "v2"))
 }
 
 func TestCheckDestinationRuleCircuitBreaker(t *testing.T) {
@@ -50,6 +50,9 @@ type podResponse struct {
 // It returns a list of all namespaces of the cluster.
 // It returns an error on any problem.
 func (in *IstioClient) GetNamespaces() (*v1.NamespaceList, error) {
+	if in.cache.isSynced() {
+		return in.cache.namespaceList()
+	}
 	namespaces, err := in.k8s.CoreV1().Namespaces().List(emptyListOptions)
 	if err != nil {
 		return nil, err
@@ -91,28 +94,110 @@ func (in *IstioClient) GetServices(namespace string) (*ServiceList, error) {
 // GetDeployments returns a list of deployments for a given namespace.
 // It returns an error on any problem.
 func (in *IstioClient) GetDeployments(namespace string) (*v1beta1.DeploymentList, error) {
+	if in.cache.isSynced() {
+		return in.cache.deploymentList(namespace)
+	}
 	return in.k8s.AppsV1beta1().Deployments(namespace).List(emptyListOptions)
 }
 
+// GetDeployment returns the definition of a specific deployment.
+// It returns an error on any problem.
+func (in *IstioClient) GetDeployment(namespace, name string) (*v1beta1.Deployment, error) {
+	return in.k8s.AppsV1beta1().Deployments(namespace).Get(name, emptyGetOptions)
+}
+
+// CreateDeployment creates a deployment in the given namespace.
+// It returns an error on any problem.
+func (in *IstioClient) CreateDeployment(namespace string, deployment *v1beta1.Deployment) (*v1beta1.Deployment, error) {
+	return in.k8s.AppsV1beta1().Deployments(namespace).Create(deployment)
+}
+
+// DeleteDeployment deletes a deployment of the given namespace, and its replica sets and pods in the background.
+// It returns an error on any problem.
+func (in *IstioClient) DeleteDeployment(namespace, name string) error {
+	// apps/v1beta1 orphans the replica sets of a deployment by default
+	propagation := meta_v1.DeletePropagationBackground
+	options := &meta_v1.DeleteOptions{PropagationPolicy: &propagation}
+	return in.k8s.AppsV1beta1().Deployments(namespace).Delete(name, options)
+}
+
+// ProxyPodGet sends a GET of the path to a port of a pod through the proxy of the API server,
+// which reaches the pods of its cluster wherever canary runs.
+// It returns the status of the answer of the pod, and an error if the pod can't be reached.
+func (in *IstioClient) ProxyPodGet(namespace string, pod string, port int, path string, headers map[string]string) (int, error) {
+	request := in.k8s.CoreV1().RESTClient().Get().Namespace(namespace).Resource("pods").
+		Name(fmt.Sprintf("%s:%d", pod, port)).SubResource("proxy").Suffix(path)
+	for name, value := range headers {
+		request = request.SetHeader(name, value)
+	}
+	var status int
+	err := request.Do().StatusCode(&status).Error()
+	if status != 0 {
+		// the pod answered, an error status is the outcome of the request
+		return status, nil
+	}
+	return 0, err
+}
+
 // GetService returns the definition of a specific service.
 // It returns an error on any problem.
 func (in *IstioClient) GetService(namespace, serviceName string) (*v1.Service, error) {
 	return in.k8s.CoreV1().Services(namespace).Get(serviceName, emptyGetOptions)
 }
 
+// GetConfigMap returns the definition of a specific config map.
+// Once the cache is synced, it only finds the config maps labeled app=canary, where canary keeps its state.
+// It returns an error on any problem.
+func (in *IstioClient) GetConfigMap(namespace, name string) (*v1.ConfigMap, error) {
+	if in.cache.isSynced() {
+		if configMap, cached, err := in.cache.configMap(namespace, name); cached {
+			return configMap, err
+		}
+	}
+	return in.k8s.CoreV1().ConfigMaps(namespace).Get(name, emptyGetOptions)
+}
+
+// CreateConfigMap creates a config map in the given namespace.
+// It returns an error on any problem.
+func (in *IstioClient) CreateConfigMap(namespace string, configMap *v1.ConfigMap) (*v1.ConfigMap, error) {
+	created, err := in.k8s.CoreV1().ConfigMaps(namespace).Create(configMap)
+	if err == nil {
+		in.cache.wroteConfigMap(created)
+	}
+	return created, err
+}
+
+// UpdateConfigMap replaces a config map in the given namespace.
+// The resourceVersion of the config map is checked, so it fails with a conflict if the config map was modified since it was read.
+// It returns an error on any problem.
+func (in *IstioClient) UpdateConfigMap(namespace string, configMap *v1.ConfigMap) (*v1.ConfigMap, error) {
+	updated, err := in.k8s.CoreV1().ConfigMaps(namespace).Update(configMap)
+	if err == nil {
+		in.cache.wroteConfigMap(updated)
+	}
+	return updated, err
+}
+
 // GetPods returns the pods definitions for a given set of labels.
 // It returns an error on any problem.
 func (in *IstioClient) GetPods(namespace, labelSelector string) (*v1.PodList, error) {
 	// An empty selector is ambiguous in the go client, could mean either "select all" or "select none"
 	// Here we assume empty == select all
 	// (see also https://kubernetes.io/docs/concepts/overview/working-with-objects/labels/#label-selectors)
+	if in.cache.isSynced() {
+		selector, err := labels.Parse(labelSelector)
+		if err != nil {
+			return nil, err
+		}
+		return in.cache.podList(namespace, selector)
+	}
 	return in.k8s.CoreV1().Pods(namespace).List(meta_v1.ListOptions{LabelSelector: labelSelector})
 }
 
 // GetNamespacePods returns the pods definitions for a given namespace
 // It returns an error on any problem.
 func (in *IstioClient) GetNamespacePods(namespace string) (*v1.PodList, error) {
-	return in.k8s.CoreV1().Pods(namespace).List(emptyListOptions)
+	return in.GetPods(namespace, "")
 }
 
 // GetServiceDetails returns full details for a given service, consisting on service description, endpoints and pods.
@@ -216,6 +301,11 @@ func getDeploymentNames(deployments *v1beta1.DeploymentList) []string {
 }
 
 func (in *IstioClient) getServiceList(namespace string, servicesChan chan servicesResponse) {
+	if in.cache.isSynced() {
+		services, err := in.cache.serviceList(namespace)
+		servicesChan <- servicesResponse{services: services, err: err}
+		return
+	}
 	services, err := in.k8s.CoreV1().Services(namespace).List(emptyListOptions)
 	servicesChan <- servicesResponse{services: services, err: err}
 }
@@ -226,6 +316,6 @@ func (in *IstioClient) getPodsList(namespace string, podsChan chan podsResponse)
 }
 
 func (in *IstioClient) getDeployments(namespace string, deploymentsChan chan deploymentsResponse) {
-	deployments, err := in.k8s.AppsV1beta1().Deployments(namespace).List(emptyListOptions)
+	deployments, err := in.GetDeployments(namespace)
 	deploymentsChan <- deploymentsResponse{deployments: deployments, err: err}
 }
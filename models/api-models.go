@@ -7,9 +7,9 @@ type User struct {
 }
 
 type VirtualServiceDTO struct {
-	Name        string `json:name`
-	Host        string `json.host`
-	Subset      string `json.subset`
-	ReleaseID   string `json.releaseId`
-	ReleaseName string `json.releaseName`
+	Name        string `json:"name"`
+	Host        string `json:"host"`
+	Subset      string `json:"subset"`
+	ReleaseID   string `json:"releaseId"`
+	ReleaseName string `json:"releaseName"`
 }
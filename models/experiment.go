@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// Experiment injects faults in the requests of a release, or of the releases targeting a traffic segment,
+// until it expires, TTL after it started, e.g. "30m".
+// Releases are the releases whose rules got the faults.
+type Experiment struct {
+	ID        string      `json:"id"`
+	Release   string      `json:"release,omitempty"`
+	Segment   string      `json:"segment,omitempty"`
+	Delay     *DelayFault `json:"delay,omitempty"`
+	Abort     *AbortFault `json:"abort,omitempty"`
+	TTL       string      `json:"ttl"`
+	Releases  []string    `json:"releases,omitempty"`
+	StartedAt time.Time   `json:"startedAt"`
+	ExpiresAt time.Time   `json:"expiresAt"`
+	User      string      `json:"user,omitempty"`
+}
+
+// DelayFault delays Percent percent of the requests by FixedDelay, e.g. "5s"
+type DelayFault struct {
+	Percent    int    `json:"percent"`
+	FixedDelay string `json:"fixedDelay"`
+}
+
+// AbortFault answers Percent percent of the requests with HTTPStatus
+type AbortFault struct {
+	Percent    int `json:"percent"`
+	HTTPStatus int `json:"httpStatus"`
+}
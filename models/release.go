@@ -1,19 +1,291 @@
 package models
 
+import "time"
+
+// Release is a set of app versions that receive the requests matching the release,
+// in the clusters of the configuration named by Clusters, or the cluster canary runs in when it names none.
+// In "shadow" Mode the versions receive a copy of MirrorPercent percent of the requests of their apps instead,
+// all of them when it is 0, and their responses are dropped; "routed" is the default Mode.
+// With the "bluegreen" Strategy the versions only receive the requests carrying the release id until all of the traffic
+// of their apps is switched to them, once SmokeChecks pass.
+// Deployments are the Deployments of the versions canary created for the release, its traffic isn't shifted until they are ready.
 type Release struct {
-	ID      string  `json:"id"`
-	Name    string  `json:"name"`
-	Gateway Gateway `json:"gateway"`
-	Apps    []App   `json:"apps"`
+	ID            string         `json:"id"`
+	Name          string         `json:"name"`
+	Mode          string         `json:"mode,omitempty"`
+	MirrorPercent int            `json:"mirrorPercent,omitempty"`
+	Strategy      string         `json:"strategy,omitempty"`
+	Gateway       Gateway        `json:"gateway"`
+	Apps          []App          `json:"apps"`
+	Match         *HttpMatch     `json:"match,omitempty"`
+	Segment       string         `json:"segment,omitempty"`
+	Header        string         `json:"header,omitempty"`
+	Clusters      []string       `json:"clusters,omitempty"`
+	Rollout       *RolloutPlan   `json:"rollout,omitempty"`
+	SmokeChecks   []SmokeCheck   `json:"smokeChecks,omitempty"`
+	Deployments   []Deployment   `json:"deployments,omitempty"`
+	Status        *ReleaseStatus `json:"status,omitempty"`
 }
 
 type Gateway struct {
 	Hosts []string `json:"hosts"`
 }
 
+// App is a version of an app the release routes to, selected by its labels.
+// Timeout and Retries apply to the requests the release's rules route to the version, and TrafficPolicy to the
+// connections to its pods, so a risky version can be fenced in more tightly than the stable one.
 type App struct {
-	Hosts  []string `json:"hosts"`
-	Labels Labels   `json:"labels"`
+	Hosts         []string       `json:"hosts"`
+	Labels        Labels         `json:"labels"`
+	Timeout       string         `json:"timeout,omitempty"`
+	Retries       *Retries       `json:"retries,omitempty"`
+	TrafficPolicy *TrafficPolicy `json:"trafficPolicy,omitempty"`
+}
+
+// Retries is the number of times a failed request is retried, and the timeout of each try, e.g. "2s"
+type Retries struct {
+	Attempts      int    `json:"attempts"`
+	PerTryTimeout string `json:"perTryTimeout,omitempty"`
+}
+
+// TrafficPolicy limits the connections and requests sent to the pods of a version,
+// and ejects the pods that keep failing from its load balancing pool.
+// Its fields are named after the trafficPolicy of Istio DestinationRules.
+type TrafficPolicy struct {
+	ConnectionPool   *ConnectionPool   `json:"connectionPool,omitempty"`
+	OutlierDetection *OutlierDetection `json:"outlierDetection,omitempty"`
+}
+
+type ConnectionPool struct {
+	TCP  *TCPSettings  `json:"tcp,omitempty"`
+	HTTP *HTTPSettings `json:"http,omitempty"`
+}
+
+type TCPSettings struct {
+	MaxConnections int    `json:"maxConnections,omitempty"`
+	ConnectTimeout string `json:"connectTimeout,omitempty"`
+}
+
+type HTTPSettings struct {
+	HTTP1MaxPendingRequests  int `json:"http1MaxPendingRequests,omitempty"`
+	HTTP2MaxRequests         int `json:"http2MaxRequests,omitempty"`
+	MaxRequestsPerConnection int `json:"maxRequestsPerConnection,omitempty"`
+	MaxRetries               int `json:"maxRetries,omitempty"`
+}
+
+type OutlierDetection struct {
+	ConsecutiveErrors  int    `json:"consecutiveErrors,omitempty"`
+	Interval           string `json:"interval,omitempty"`
+	BaseEjectionTime   string `json:"baseEjectionTime,omitempty"`
+	MaxEjectionPercent int    `json:"maxEjectionPercent,omitempty"`
 }
 
 type Labels map[string]string
+
+// RolloutPlan shifts the traffic of the release's apps to the release's versions in steps,
+// and can check the health of the release before each step.
+// Approvers are the users who can approve the steps requiring an approval, any authenticated user when empty.
+type RolloutPlan struct {
+	Steps     []RolloutStep `json:"steps"`
+	Analysis  *Analysis     `json:"analysis,omitempty"`
+	Approvers []string      `json:"approvers,omitempty"`
+}
+
+// RolloutStep is the percentage of the traffic sent to the release's versions,
+// and how long it stays so before the next step, e.g. "10m".
+// The rollout waits for a user to approve a step with Approval before moving to it.
+type RolloutStep struct {
+	Weight   int    `json:"weight"`
+	Dwell    string `json:"dwell,omitempty"`
+	Approval bool   `json:"approval,omitempty"`
+}
+
+// ReleaseStatus is the progress of the release through its rollout plan, or its blue/green switch,
+// and the outcome of its last change in each of its clusters.
+// PreviousVersions are the versions of the apps a blue/green release was switched from, by app.
+type ReleaseStatus struct {
+	Phase            string            `json:"phase,omitempty"`
+	Step             int               `json:"step"`
+	Weight           int               `json:"weight"`
+	StepStartedAt    *time.Time        `json:"stepStartedAt,omitempty"`
+	NextStepAt       *time.Time        `json:"nextStepAt,omitempty"`
+	Verdicts         []Verdict         `json:"verdicts,omitempty"`
+	Approvals        []Approval        `json:"approvals,omitempty"`
+	PreviousVersions map[string]string `json:"previousVersions,omitempty"`
+	SmokeResults     []SmokeResult     `json:"smokeResults,omitempty"`
+	Clusters         []ClusterStatus   `json:"clusters,omitempty"`
+}
+
+// Deployment is a Deployment of the release's version of App that canary created, named Name, by cloning the Deployment
+// of the stable version of the app with Image in Container, the first container of its pods when empty.
+type Deployment struct {
+	App       string `json:"app"`
+	Image     string `json:"image"`
+	Container string `json:"container,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+// SmokeCheck is an HTTP GET of Path sent to Port of every ready pod of the release's version of App before a
+// blue/green switch. It passes when the pods answer with Status, or any 2xx status when it is 0.
+type SmokeCheck struct {
+	Name   string `json:"name"`
+	App    string `json:"app"`
+	Port   int    `json:"port"`
+	Path   string `json:"path"`
+	Status int    `json:"status,omitempty"`
+}
+
+// SmokeResult is the outcome of a smoke check on a pod: "Passed" or "Failed"
+type SmokeResult struct {
+	Name    string    `json:"name"`
+	Cluster string    `json:"cluster,omitempty"`
+	Pod     string    `json:"pod,omitempty"`
+	Time    time.Time `json:"time"`
+	Outcome string    `json:"outcome"`
+	Message string    `json:"message,omitempty"`
+}
+
+// Approval is the decision of a user on a step of the rollout requiring an approval: "Approved" or "Rejected"
+type Approval struct {
+	Time     time.Time `json:"time"`
+	Step     int       `json:"step"`
+	Decision string    `json:"decision"`
+	User     string    `json:"user"`
+	Comment  string    `json:"comment,omitempty"`
+}
+
+// ApprovalRequest is the optional body of the approval or rejection of a step
+type ApprovalRequest struct {
+	Comment string `json:"comment,omitempty"`
+}
+
+// Analysis is the set of checks the release's versions must pass, once the dwell time of a step is over,
+// for the rollout to move to the next step. The rollout is rolled back as soon as a check fails.
+// Window is the range of the rates measured by the queries, "5m" by default.
+type Analysis struct {
+	Window string          `json:"window,omitempty"`
+	Checks []AnalysisCheck `json:"checks"`
+}
+
+// AnalysisCheck is a PromQL query evaluated for the release's version and the baseline version of every app.
+// Query is a template of the query, which can use {{.Namespace}}, {{.App}}, {{.Version}} and {{.Window}};
+// it can be left empty for the checks canary knows about: "error-rate" and "latency-p99".
+// The check fails when the value for the release's version is above Max,
+// or is more than MaxIncrease (0.1 for 10%) above the value for the baseline version.
+type AnalysisCheck struct {
+	Name        string   `json:"name"`
+	Query       string   `json:"query,omitempty"`
+	Max         *float64 `json:"max,omitempty"`
+	MaxIncrease *float64 `json:"maxIncrease,omitempty"`
+}
+
+// Verdict is the outcome of the analysis of a step: "Passed", "Failed" or "Inconclusive" when there wasn't enough data
+type Verdict struct {
+	Time    time.Time     `json:"time"`
+	Cluster string        `json:"cluster,omitempty"`
+	Step    int           `json:"step"`
+	Outcome string        `json:"outcome"`
+	Results []CheckResult `json:"results"`
+}
+
+// CheckResult is the outcome of a check for an app, with the values the queries returned
+type CheckResult struct {
+	Name            string   `json:"name"`
+	App             string   `json:"app"`
+	Version         string   `json:"version"`
+	BaselineVersion string   `json:"baselineVersion,omitempty"`
+	Value           *float64 `json:"value,omitempty"`
+	BaselineValue   *float64 `json:"baselineValue,omitempty"`
+	Outcome         string   `json:"outcome"`
+	Message         string   `json:"message,omitempty"`
+}
+
+// ReleaseEvent records a change made to a release, who made it and the changes applied to the VirtualServices
+type ReleaseEvent struct {
+	Time    time.Time              `json:"time"`
+	Action  string                 `json:"action"`
+	User    string                 `json:"user,omitempty"`
+	Outcome string                 `json:"outcome"`
+	Message string                 `json:"message,omitempty"`
+	Changes []VirtualServiceChange `json:"changes,omitempty"`
+}
+
+// VirtualServiceChange is the JSON patch applied to the spec of a VirtualService,
+// and whether it was applied, failed, or restored when the change of another VirtualService failed
+type VirtualServiceChange struct {
+	Name    string           `json:"name"`
+	Cluster string           `json:"cluster,omitempty"`
+	Patch   []PatchOperation `json:"patch,omitempty"`
+	Outcome string           `json:"outcome,omitempty"`
+	Message string           `json:"message,omitempty"`
+}
+
+// ReleaseResult is a release and the outcome of the changes made to the VirtualServices to apply it
+type ReleaseResult struct {
+	Release         Release                `json:"release"`
+	VirtualServices []VirtualServiceChange `json:"virtualServices"`
+	Clusters        []ClusterStatus        `json:"clusters,omitempty"`
+	Error           string                 `json:"error,omitempty"`
+}
+
+// ClusterStatus is the outcome of a change of a release in one of its clusters:
+// "Applied", "Failed", "RolledBack" when the change failed in another cluster, "NotRolledBack" when the roll back failed too,
+// or "Skipped" when the change failed in a cluster before it
+type ClusterStatus struct {
+	Cluster string `json:"cluster"`
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// PatchOperation is an operation of a JSON patch, see https://tools.ietf.org/html/rfc6902
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// ReleasePreview is what a change to a release would do, without applying it
+type ReleasePreview struct {
+	Release         Release                 `json:"release"`
+	VirtualServices []VirtualServicePreview `json:"virtualServices"`
+}
+
+// VirtualServicePreview is the current and the proposed spec of a VirtualService, and the JSON patch between them
+type VirtualServicePreview struct {
+	Name     string                 `json:"name"`
+	Cluster  string                 `json:"cluster,omitempty"`
+	Current  map[string]interface{} `json:"current"`
+	Proposed map[string]interface{} `json:"proposed"`
+	Patch    []PatchOperation       `json:"patch"`
+}
+
+// FieldError is a field of a request that is invalid, and why
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is the response to a request with invalid fields
+type ValidationError struct {
+	Error  string       `json:"error"`
+	Fields []FieldError `json:"fields"`
+}
+
+// PropagationReport lists the hops of the recent requests of a release that reached an app of the release
+// on another version than the release's, as the header carrying the release id was dropped on the way
+type PropagationReport struct {
+	Release string           `json:"release"`
+	Header  string           `json:"header"`
+	Traces  int              `json:"traces"`
+	Hops    []PropagationHop `json:"hops"`
+}
+
+// PropagationHop is a call from a service to an app of a release that didn't reach the release's version
+type PropagationHop struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Subset   string   `json:"subset"`
+	Expected string   `json:"expected"`
+	Count    int      `json:"count"`
+	TraceIDs []string `json:"traceIds"`
+}
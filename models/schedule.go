@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// ScheduledAction is a change canary makes to a release at a given time: starting it, with the release to create,
+// moving its rollout to the next step, or promoting its versions to the stable versions of its apps.
+// Actions due during a maintenance window wait for its end, unless they are forced.
+type ScheduledAction struct {
+	ID        string    `json:"id"`
+	Action    string    `json:"action"`
+	ReleaseID string    `json:"releaseId"`
+	At        time.Time `json:"at"`
+	Release   *Release  `json:"release,omitempty"`
+	Force     bool      `json:"force,omitempty"`
+	User      string    `json:"user,omitempty"`
+}
+
+// MaintenanceWindow is a period during which no release can be created in a namespace and no rollout moves to its next step,
+// unless forced. A window repeated "daily" or "weekly" comes back every day or week after Start.
+type MaintenanceWindow struct {
+	ID     string    `json:"id"`
+	Reason string    `json:"reason,omitempty"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Repeat string    `json:"repeat,omitempty"`
+}
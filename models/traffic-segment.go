@@ -1,13 +1,35 @@
 package models
 
+// TrafficSegment is a named definition of the requests a release targets,
+// it is stored once and can be attached to many releases by id
 type TrafficSegment struct {
 	ID    string     `json:"id"`
 	Name  string     `json:"name"`
 	Match *HttpMatch `json:"match"`
 }
 
+// HttpMatch holds the conditions a request must satisfy, all of them, to be part of a traffic segment,
+// as Istio's HTTPMatchRequest, see https://istio.io/docs/reference/config/istio.networking.v1alpha3/#HTTPMatchRequest
 type HttpMatch struct {
-	Headers map[string]*StringMatch `json:"headers,omitempty"`
+	Headers      map[string]*StringMatch `json:"headers,omitempty"`
+	Cookies      map[string]*StringMatch `json:"cookies,omitempty"`
+	Claims       map[string]*StringMatch `json:"claims,omitempty"`
+	Bucket       *HashBucket             `json:"bucket,omitempty"`
+	Uri          *StringMatch            `json:"uri,omitempty"`
+	Scheme       *StringMatch            `json:"scheme,omitempty"`
+	Method       *StringMatch            `json:"method,omitempty"`
+	Authority    *StringMatch            `json:"authority,omitempty"`
+	QueryParams  map[string]*StringMatch `json:"queryParams,omitempty"`
+	SourceLabels map[string]string       `json:"sourceLabels,omitempty"`
+	Port         uint32                  `json:"port,omitempty"`
+	Gateways     []string                `json:"gateways,omitempty"`
+}
+
+// HashBucket selects a stable share of the users by the last two hex digits of a header identifying them,
+// like a user id that is a UUID or a hash
+type HashBucket struct {
+	Header  string `json:"header"`
+	Percent int    `json:"percent"`
 }
 
 type StringMatch struct {
@@ -15,3 +37,12 @@ type StringMatch struct {
 	Exact  string `json:"exact,omitempty"`
 	Prefix string `json:"prefix,omitempty"`
 }
+
+// TrafficSegmentResult is a traffic segment and the outcome of the changes made to the VirtualServices
+// to apply it to the releases targeting it
+type TrafficSegmentResult struct {
+	Segment         TrafficSegment         `json:"segment"`
+	Releases        []string               `json:"releases"`
+	VirtualServices []VirtualServiceChange `json:"virtualServices"`
+	Error           string                 `json:"error,omitempty"`
+}
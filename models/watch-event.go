@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// WatchEvent is a change of the releases or the traffic of a namespace, pushed to the clients watching it.
+// Kind and Name identify the object the change was read from, the other fields are set when they apply to the type.
+type WatchEvent struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Name    string    `json:"name"`
+	Release string    `json:"release,omitempty"`
+	App     string    `json:"app,omitempty"`
+	Version string    `json:"version,omitempty"`
+	Weight  *int      `json:"weight,omitempty"`
+}
@@ -0,0 +1,111 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Querier evaluates PromQL queries, it is implemented by Client and can be mocked
+type Querier interface {
+	// Query returns the value of an instant query returning a scalar or a vector of a single sample.
+	// It returns false if the query has no result, e.g. because there was no traffic to measure.
+	Query(query string, ts time.Time) (float64, bool, error)
+}
+
+// Client queries the HTTP API of a Prometheus server
+type Client struct {
+	url  string
+	http *http.Client
+}
+
+// NewClient returns a client of the Prometheus server at url, e.g. config.Get().Products.PrometheusServiceURL
+func NewClient(url string) *Client {
+	return &Client{
+		url:  url,
+		http: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type queryResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+type vectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  []interface{}     `json:"value"`
+}
+
+// Query evaluates an instant query at ts.
+// It returns an error on any problem, including a query returning more than one sample.
+func (in *Client) Query(query string, ts time.Time) (float64, bool, error) {
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("time", strconv.FormatFloat(float64(ts.UnixNano())/1e9, 'f', 3, 64))
+	resp, err := in.http.Get(in.url + "/api/v1/query?" + params.Encode())
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	var response queryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return 0, false, fmt.Errorf("Prometheus response to %s can't be read: %v", query, err)
+	}
+	if response.Status != "success" {
+		return 0, false, fmt.Errorf("Prometheus query %s failed: %s %s", query, response.ErrorType, response.Error)
+	}
+
+	var value []interface{}
+	switch response.Data.ResultType {
+	case "scalar":
+		if err := json.Unmarshal(response.Data.Result, &value); err != nil {
+			return 0, false, err
+		}
+	case "vector":
+		var samples []vectorSample
+		if err := json.Unmarshal(response.Data.Result, &samples); err != nil {
+			return 0, false, err
+		}
+		if len(samples) == 0 {
+			return 0, false, nil
+		}
+		if len(samples) > 1 {
+			return 0, false, fmt.Errorf("Prometheus query %s returned %d samples, it must be aggregated to a single one", query, len(samples))
+		}
+		value = samples[0].Value
+	default:
+		return 0, false, fmt.Errorf("Prometheus query %s returned a %s, it must return a scalar or a vector", query, response.Data.ResultType)
+	}
+	return sampleValue(value)
+}
+
+// sampleValue reads a [ <timestamp>, "<value>" ] pair
+func sampleValue(value []interface{}) (float64, bool, error) {
+	if len(value) != 2 {
+		return 0, false, fmt.Errorf("Prometheus sample %v can't be read", value)
+	}
+	s, ok := value[1].(string)
+	if !ok {
+		return 0, false, fmt.Errorf("Prometheus sample %v can't be read", value)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	// NaN comes from ratios with no traffic, like an error rate
+	if math.IsNaN(f) {
+		return 0, false, nil
+	}
+	return f, true, nil
+}
@@ -0,0 +1,217 @@
+package releases
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"text/template"
+	"time"
+
+	"github.com/devtio/canary/models"
+	"github.com/devtio/canary/prometheus"
+)
+
+// Outcomes of the analysis of a rollout step
+const (
+	VerdictPassed       = "Passed"
+	VerdictFailed       = "Failed"
+	VerdictInconclusive = "Inconclusive"
+)
+
+// maxVerdicts is the number of verdicts kept in the status of a release
+const maxVerdicts = 20
+
+const defaultAnalysisWindow = "5m"
+
+// istioQuery selects the requests received by a version of an app in the Istio telemetry
+const istioQuery = `destination_workload_namespace="{{.Namespace}}",destination_app="{{.App}}",destination_version="{{.Version}}",reporter="destination"`
+
+// builtinChecks are the queries of the checks that can be used without a query
+var builtinChecks = map[string]string{
+	"error-rate":  `sum(rate(istio_requests_total{` + istioQuery + `,response_code=~"5.."}[{{.Window}}])) / sum(rate(istio_requests_total{` + istioQuery + `}[{{.Window}}]))`,
+	"latency-p99": `histogram_quantile(0.99, sum(rate(istio_request_duration_seconds_bucket{` + istioQuery + `}[{{.Window}}])) by (le))`,
+}
+
+// queryParams are the values a check query can use
+type queryParams struct {
+	Namespace string
+	App       string
+	Version   string
+	Window    string
+}
+
+func validateAnalysis(analysis *models.Analysis) error {
+	if analysis == nil {
+		return nil
+	}
+	if analysis.Window != "" {
+		if _, err := time.ParseDuration(analysis.Window); err != nil {
+			return fmt.Errorf("analysis has an invalid window: %v", err)
+		}
+	}
+	if len(analysis.Checks) == 0 {
+		return fmt.Errorf("analysis has no checks")
+	}
+	for i, check := range analysis.Checks {
+		if check.Name == "" {
+			return fmt.Errorf("analysis check %d has no name", i)
+		}
+		if check.Max == nil && check.MaxIncrease == nil {
+			return fmt.Errorf("analysis check %s has neither max nor maxIncrease", check.Name)
+		}
+		if _, err := checkQuery(check); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkQuery(check models.AnalysisCheck) (*template.Template, error) {
+	query := check.Query
+	if query == "" {
+		builtin, ok := builtinChecks[check.Name]
+		if !ok {
+			return nil, fmt.Errorf("analysis check %s has no query", check.Name)
+		}
+		query = builtin
+	}
+	t, err := template.New(check.Name).Option("missingkey=error").Parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("analysis check %s has an invalid query: %v", check.Name, err)
+	}
+	return t, nil
+}
+
+// Analyze runs the checks of the release's analysis for every app of the release,
+// comparing the release's version to the baseline version of the app, and records the verdict in the release's status.
+// Failed checks take precedence over checks with no data.
+func Analyze(querier prometheus.Querier, namespace string, release *models.Release, baselines map[string]string, now time.Time) models.Verdict {
+	verdict := analyze(querier, namespace, *release, baselines, now)
+	recordVerdict(release, verdict)
+	return verdict
+}
+
+// AnalyzeClusters runs the analysis of the release in every cluster of the release, with the Prometheus querierFor returns
+// for the cluster, and records the verdict of every cluster in the release's status.
+// It returns the outcome over all the clusters: failed if the release failed in one of them, inconclusive if there
+// wasn't enough data in one of them, passed otherwise, and an error if the VirtualServices of a cluster can't be read.
+func AnalyzeClusters(clusters []Cluster, querierFor func(Cluster) prometheus.Querier, namespace string, release *models.Release, now time.Time) (string, error) {
+	outcome := VerdictPassed
+	for _, cluster := range clusters {
+		managed, err := GetManagedVirtualServices(cluster.Client, namespace)
+		if err != nil {
+			return "", err
+		}
+		verdict := analyze(querierFor(cluster), namespace, *release, BaselineVersions(managed, *release), now)
+		verdict.Cluster = cluster.Name
+		recordVerdict(release, verdict)
+		if verdict.Outcome == VerdictFailed || outcome == VerdictPassed {
+			outcome = verdict.Outcome
+		}
+	}
+	return outcome, nil
+}
+
+func analyze(querier prometheus.Querier, namespace string, release models.Release, baselines map[string]string, now time.Time) models.Verdict {
+	analysis := release.Rollout.Analysis
+	window := analysis.Window
+	if window == "" {
+		window = defaultAnalysisWindow
+	}
+	verdict := models.Verdict{
+		Time:    now,
+		Step:    release.Status.Step,
+		Outcome: VerdictPassed,
+		Results: []models.CheckResult{},
+	}
+	for _, app := range release.Apps {
+		name, version := app.Labels[AppLabel], app.Labels[VersionLabel]
+		if name == "" || version == "" {
+			continue
+		}
+		for _, check := range analysis.Checks {
+			params := queryParams{Namespace: namespace, App: name, Version: version, Window: window}
+			result := runCheck(querier, check, params, baselines[name], now)
+			verdict.Results = append(verdict.Results, result)
+			if result.Outcome == VerdictFailed || verdict.Outcome == VerdictPassed {
+				verdict.Outcome = result.Outcome
+			}
+		}
+	}
+
+	return verdict
+}
+
+// recordVerdict appends a verdict to the release's status, unless it's the same as the last verdict of its cluster,
+// so a release waiting for data isn't rewritten every time it's analyzed
+func recordVerdict(release *models.Release, verdict models.Verdict) {
+	for i := len(release.Status.Verdicts) - 1; i >= 0; i-- {
+		last := release.Status.Verdicts[i]
+		if last.Cluster != verdict.Cluster {
+			continue
+		}
+		if last.Step == verdict.Step && last.Outcome == verdict.Outcome && reflect.DeepEqual(last.Results, verdict.Results) {
+			return
+		}
+		break
+	}
+	verdicts := append(release.Status.Verdicts, verdict)
+	if len(verdicts) > maxVerdicts {
+		verdicts = verdicts[len(verdicts)-maxVerdicts:]
+	}
+	release.Status.Verdicts = verdicts
+}
+
+func runCheck(querier prometheus.Querier, check models.AnalysisCheck, params queryParams, baseline string, now time.Time) models.CheckResult {
+	result := models.CheckResult{
+		Name:            check.Name,
+		App:             params.App,
+		Version:         params.Version,
+		BaselineVersion: baseline,
+		Outcome:         VerdictInconclusive,
+	}
+	value, ok, err := query(querier, check, params, now)
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+	if !ok {
+		result.Message = fmt.Sprintf("no data for version %s", params.Version)
+		return result
+	}
+	result.Value = &value
+
+	if check.MaxIncrease != nil && baseline != "" {
+		params.Version = baseline
+		baselineValue, ok, err := query(querier, check, params, now)
+		if err != nil {
+			result.Message = err.Error()
+			return result
+		}
+		if ok {
+			result.BaselineValue = &baselineValue
+		}
+	}
+
+	result.Outcome = VerdictPassed
+	if check.Max != nil && value > *check.Max {
+		result.Outcome = VerdictFailed
+		result.Message = fmt.Sprintf("%g is above the maximum of %g", value, *check.Max)
+	} else if check.MaxIncrease != nil && result.BaselineValue != nil && value > *result.BaselineValue*(1+*check.MaxIncrease) {
+		result.Outcome = VerdictFailed
+		result.Message = fmt.Sprintf("%g is more than %g%% above the baseline value of %g", value, *check.MaxIncrease*100, *result.BaselineValue)
+	}
+	return result
+}
+
+func query(querier prometheus.Querier, check models.AnalysisCheck, params queryParams, now time.Time) (float64, bool, error) {
+	t, err := checkQuery(check)
+	if err != nil {
+		return 0, false, err
+	}
+	var query bytes.Buffer
+	if err := t.Execute(&query, params); err != nil {
+		return 0, false, fmt.Errorf("analysis check %s query can't be built: %v", check.Name, err)
+	}
+	return querier.Query(query.String(), now)
+}
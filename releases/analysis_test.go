@@ -0,0 +1,67 @@
+package releases
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/devtio/canary/models"
+)
+
+// fakePrometheus returns the value of the version found in the query
+type fakePrometheus map[string]float64
+
+func (in fakePrometheus) Query(query string, ts time.Time) (float64, bool, error) {
+	for version, value := range in {
+		if strings.Contains(query, `destination_version="`+version+`"`) {
+			return value, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func analyzedRelease(checks ...models.AnalysisCheck) models.Release {
+	release := testRelease()
+	release.Rollout = &models.RolloutPlan{
+		Steps:    []models.RolloutStep{{Weight: 10, Dwell: "5m"}, {Weight: 100}},
+		Analysis: &models.Analysis{Checks: checks},
+	}
+	StartRollout(&release, time.Now())
+	return release
+}
+
+func TestAnalyze(t *testing.T) {
+	max, increase := 0.05, 0.1
+	errorRate := models.AnalysisCheck{Name: "error-rate", Max: &max}
+	latency := models.AnalysisCheck{Name: "latency-p99", MaxIncrease: &increase}
+	assert.NoError(t, ValidateRollout(analyzedRelease(errorRate, latency).Rollout))
+	assert.Error(t, ValidateRollout(analyzedRelease(models.AnalysisCheck{Name: "custom", Max: &max}).Rollout))
+
+	release := analyzedRelease(latency)
+	verdict := Analyze(fakePrometheus{"v1": 0.2, "v2": 0.21}, "dummy", &release, map[string]string{"a": "v1"}, time.Now())
+	assert.Equal(t, VerdictPassed, verdict.Outcome)
+	assert.Equal(t, 0.2, *verdict.Results[0].BaselineValue)
+	assert.Len(t, release.Status.Verdicts, 1)
+
+	verdict = Analyze(fakePrometheus{"v1": 0.2, "v2": 0.3}, "dummy", &release, map[string]string{"a": "v1"}, time.Now())
+	assert.Equal(t, VerdictFailed, verdict.Outcome)
+	assert.Len(t, release.Status.Verdicts, 2)
+
+	// no traffic reached the release's version yet
+	release = analyzedRelease(errorRate)
+	verdict = Analyze(fakePrometheus{"v1": 0.01}, "dummy", &release, map[string]string{"a": "v1"}, time.Now())
+	assert.Equal(t, VerdictInconclusive, verdict.Outcome)
+	assert.Len(t, release.Status.Verdicts, 1)
+
+	// the same verdict isn't recorded again
+	Analyze(fakePrometheus{"v1": 0.01}, "dummy", &release, map[string]string{"a": "v1"}, time.Now())
+	assert.Len(t, release.Status.Verdicts, 1)
+}
+
+func TestBaselineVersions(t *testing.T) {
+	app, _ := ParseVirtualService(appVirtualService())
+	AddRelease(app, testRelease())
+	assert.Equal(t, map[string]string{"a": "v1"}, BaselineVersions([]*VirtualService{app}, testRelease()))
+}
@@ -0,0 +1,198 @@
+package releases
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/log"
+	"github.com/devtio/canary/models"
+)
+
+// ConflictBackoff is how often canary writes an object again when it was modified concurrently
+var ConflictBackoff = wait.Backoff{
+	Steps:    5,
+	Duration: 50 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.5,
+}
+
+// GetManagedVirtualServices returns the VirtualServices of the namespace that are managed by canary.
+// It returns an error on any problem, including a managed VirtualService that can't be interpreted.
+func GetManagedVirtualServices(client kubernetes.IstioClientInterface, namespace string) ([]*VirtualService, error) {
+	log.Debugf("Getting virtual services for namespace %s", namespace)
+	virtualServices, err := client.GetVirtualServices(namespace, "")
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Virtual services retrieved: %d", len(virtualServices))
+	return ManagedVirtualServices(virtualServices)
+}
+
+// Outcomes of the change of a VirtualService
+const (
+	ChangeApplied     = "Applied"
+	ChangeFailed      = "Failed"
+	ChangeRestored    = "Restored"
+	ChangeNotRestored = "NotRestored"
+)
+
+// appliedChange is a VirtualService written by UpdateVirtualServices, and what it was before
+type appliedChange struct {
+	before  *VirtualService
+	written kubernetes.IstioObject
+	result  int
+}
+
+// UpdateVirtualServices applies change to every VirtualService and writes back the ones it modified, as a transaction:
+// if a VirtualService can't be written, the ones already written are restored to what they were before.
+// A VirtualService modified by someone else since it was read is read again, and change applied again to it,
+// until it is written or ConflictBackoff runs out. The error is then a conflict error, see errors.IsConflict.
+// It returns the outcome for every VirtualService modified by change, and an error on any problem.
+func UpdateVirtualServices(client kubernetes.IstioClientInterface, namespace string, virtualServices []*VirtualService, change func(*VirtualService) bool) ([]models.VirtualServiceChange, error) {
+	changes, _, err := applyVirtualServices(client, namespace, virtualServices, change)
+	return changes, err
+}
+
+// applyVirtualServices is UpdateVirtualServices, it also returns the VirtualServices written so they can be restored later
+func applyVirtualServices(client kubernetes.IstioClientInterface, namespace string, virtualServices []*VirtualService, change func(*VirtualService) bool) ([]models.VirtualServiceChange, []appliedChange, error) {
+	changes := []models.VirtualServiceChange{}
+	applied := []appliedChange{}
+	for _, vs := range virtualServices {
+		if !change(vs) {
+			continue
+		}
+		before, written, patch, err := updateVirtualService(client, namespace, vs, change)
+		if err != nil {
+			log.Errorf("Virtual service %s/%s can't be updated: %v", namespace, vs.Name, err)
+			changes = append(changes, models.VirtualServiceChange{Name: vs.Name, Outcome: ChangeFailed, Message: err.Error()})
+			restoreVirtualServices(client, namespace, applied, changes)
+			return changes, nil, err
+		}
+		if written != nil {
+			log.Debugf("Virtual service %s/%s updated", namespace, vs.Name)
+			applied = append(applied, appliedChange{before: before, written: written, result: len(changes)})
+			changes = append(changes, models.VirtualServiceChange{Name: vs.Name, Patch: patch, Outcome: ChangeApplied})
+		}
+	}
+	return changes, applied, nil
+}
+
+// updateVirtualService writes a VirtualService change has been applied to, retrying on conflicts.
+// It returns the version of the VirtualService the change was applied to, as written and the patch between them,
+// or nils if change no longer modifies the latest version of the VirtualService.
+func updateVirtualService(client kubernetes.IstioClientInterface, namespace string, vs *VirtualService, change func(*VirtualService) bool) (*VirtualService, kubernetes.IstioObject, []models.PatchOperation, error) {
+	var written kubernetes.IstioObject
+	var patch []models.PatchOperation
+	attempt := 0
+	err := retry.RetryOnConflict(ConflictBackoff, func() error {
+		attempt++
+		written = nil
+		if attempt > 1 {
+			log.Infof("Virtual service %s/%s was modified concurrently, applying the change again to its latest version", namespace, vs.Name)
+			object, err := client.GetVirtualService(namespace, vs.Name)
+			if err != nil {
+				return err
+			}
+			latest, err := ParseVirtualService(object)
+			if err != nil {
+				return err
+			}
+			if !change(latest) {
+				return nil
+			}
+			vs = latest
+		}
+		var err error
+		if patch, err = vs.Diff(); err != nil {
+			return err
+		}
+		virtualService, err := vs.IstioObject()
+		if err != nil {
+			return err
+		}
+		// the object meta holds the resource version the VirtualService was read with,
+		// so the write fails with a conflict if it was modified since
+		if written, err = client.PutVirtualService(namespace, virtualService); err != nil {
+			written = nil
+			return err
+		}
+		return nil
+	})
+	if err != nil || written == nil {
+		return nil, nil, nil, err
+	}
+	return vs, written, patch, nil
+}
+
+// restoreVirtualServices writes back the VirtualServices of a failed transaction as they were before it, latest first,
+// and records the outcome in changes.
+// A VirtualService modified by someone else since it was written is left as it is, so their change isn't lost.
+func restoreVirtualServices(client kubernetes.IstioClientInterface, namespace string, applied []appliedChange, changes []models.VirtualServiceChange) {
+	for i := len(applied) - 1; i >= 0; i-- {
+		a := applied[i]
+		name := a.before.Name
+		err := retry.RetryOnConflict(ConflictBackoff, func() error {
+			latest, err := client.GetVirtualService(namespace, name)
+			if err != nil {
+				return err
+			}
+			same, err := sameSpec(latest, a.written)
+			if err != nil {
+				return err
+			}
+			if !same {
+				return fmt.Errorf("it was modified since canary changed it")
+			}
+			meta := latest.GetObjectMeta()
+			meta.Annotations = a.before.rawAnnotations
+			_, err = client.PutVirtualService(namespace, &kubernetes.VirtualService{
+				ObjectMeta: meta,
+				Spec:       a.before.raw,
+			})
+			return err
+		})
+		if err != nil {
+			log.Errorf("Virtual service %s/%s can't be restored: %v", namespace, name, err)
+			changes[a.result].Outcome = ChangeNotRestored
+			changes[a.result].Message = "Virtual service can't be restored: " + err.Error()
+			continue
+		}
+		log.Infof("Virtual service %s/%s restored", namespace, name)
+		changes[a.result].Outcome = ChangeRestored
+	}
+}
+
+func sameSpec(a, b kubernetes.IstioObject) (bool, error) {
+	specA, err := toJSONObject(a.GetSpec())
+	if err != nil {
+		return false, err
+	}
+	specB, err := toJSONObject(b.GetSpec())
+	if err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(specA, specB), nil
+}
+
+// PreviewVirtualServices applies change to every VirtualService and returns what would be written for the ones it modified,
+// without writing anything.
+// It returns an error on any problem.
+func PreviewVirtualServices(virtualServices []*VirtualService, change func(*VirtualService) bool) ([]models.VirtualServicePreview, error) {
+	previews := []models.VirtualServicePreview{}
+	for _, vs := range virtualServices {
+		if !change(vs) {
+			continue
+		}
+		preview, err := vs.Preview()
+		if err != nil {
+			return nil, err
+		}
+		previews = append(previews, preview)
+	}
+	return previews, nil
+}
@@ -0,0 +1,111 @@
+package releases
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/devtio/canary/kubernetes"
+)
+
+// conflictingClient fails the first conflicts writes of a VirtualService, as if it had been modified concurrently
+type conflictingClient struct {
+	kubernetes.IstioClientInterface
+	latest    *kubernetes.VirtualService
+	conflicts int
+	written   []kubernetes.IstioObject
+}
+
+func (in *conflictingClient) GetVirtualService(namespace string, name string) (kubernetes.IstioObject, error) {
+	return in.latest.DeepCopyIstioObject(), nil
+}
+
+func (in *conflictingClient) PutVirtualService(namespace string, vs kubernetes.IstioObject) (kubernetes.IstioObject, error) {
+	if in.conflicts > 0 {
+		in.conflicts--
+		return nil, errors.NewConflict(schema.GroupResource{Resource: "virtualservices"}, vs.GetObjectMeta().Name, nil)
+	}
+	in.written = append(in.written, vs)
+	return vs, nil
+}
+
+func TestUpdateVirtualServicesRetriesOnConflict(t *testing.T) {
+	backoff := ConflictBackoff
+	defer func() { ConflictBackoff = backoff }()
+	ConflictBackoff.Duration = 0
+
+	// someone else added a release since the VirtualService was read
+	latest := appVirtualService()
+	concurrent, _ := ParseVirtualService(latest)
+	other := testRelease()
+	other.ID = "release2"
+	AddRelease(concurrent, other)
+	object, _ := concurrent.IstioObject()
+	latest.Spec = object.GetSpec()
+
+	client := &conflictingClient{latest: latest, conflicts: 1}
+	stale, _ := ParseVirtualService(appVirtualService())
+	changes, err := UpdateVirtualServices(client, "dummy", []*VirtualService{stale}, func(vs *VirtualService) bool {
+		return AddRelease(vs, testRelease())
+	})
+	assert.NoError(t, err)
+	assert.Len(t, changes, 1)
+	assert.Len(t, client.written, 1)
+	written := Releases([]*VirtualService{mustParse(t, client.written[0])})
+	assert.Contains(t, written, "release1")
+	assert.Contains(t, written, "release2")
+
+	// retries run out
+	client = &conflictingClient{latest: appVirtualService(), conflicts: 100}
+	stale, _ = ParseVirtualService(appVirtualService())
+	_, err = UpdateVirtualServices(client, "dummy", []*VirtualService{stale}, func(vs *VirtualService) bool {
+		return AddRelease(vs, testRelease())
+	})
+	assert.True(t, errors.IsConflict(err))
+}
+
+func mustParse(t *testing.T, object kubernetes.IstioObject) *VirtualService {
+	vs, err := ParseVirtualService(object)
+	assert.NoError(t, err)
+	return vs
+}
+
+// storingClient keeps the VirtualServices written to it, and fails to write the one named fail
+type storingClient struct {
+	kubernetes.IstioClientInterface
+	objects map[string]kubernetes.IstioObject
+	fail    string
+}
+
+func (in *storingClient) GetVirtualService(namespace string, name string) (kubernetes.IstioObject, error) {
+	return in.objects[name].DeepCopyIstioObject(), nil
+}
+
+func (in *storingClient) PutVirtualService(namespace string, vs kubernetes.IstioObject) (kubernetes.IstioObject, error) {
+	name := vs.GetObjectMeta().Name
+	if name == in.fail {
+		return nil, fmt.Errorf("%s can't be written", name)
+	}
+	in.objects[name] = vs.DeepCopyIstioObject()
+	return vs, nil
+}
+
+func TestUpdateVirtualServicesRestoresOnFailure(t *testing.T) {
+	client := &storingClient{
+		objects: map[string]kubernetes.IstioObject{"gateway": gatewayVirtualService(), "a": appVirtualService()},
+		fail:    "a",
+	}
+	gateway, _ := ParseVirtualService(gatewayVirtualService())
+	app, _ := ParseVirtualService(appVirtualService())
+	changes, err := UpdateVirtualServices(client, "dummy", []*VirtualService{gateway, app}, func(vs *VirtualService) bool {
+		return AddRelease(vs, testRelease())
+	})
+	assert.Error(t, err)
+	assert.Len(t, changes, 2)
+	assert.Equal(t, ChangeRestored, changes[0].Outcome)
+	assert.Equal(t, ChangeFailed, changes[1].Outcome)
+	assert.Equal(t, mustJSON(t, gatewayVirtualService().Spec), mustJSON(t, client.objects["gateway"].GetSpec()))
+}
@@ -0,0 +1,49 @@
+package releases
+
+import (
+	"time"
+
+	"github.com/devtio/canary/models"
+)
+
+// Decisions on a step of a rollout requiring an approval
+const (
+	DecisionApproved = "Approved"
+	DecisionRejected = "Rejected"
+)
+
+// NeedsApproval returns true if the next step of the rollout of the release requires an approval
+func NeedsApproval(release models.Release) bool {
+	if release.Rollout == nil || release.Status == nil {
+		return false
+	}
+	next := release.Status.Step + 1
+	return next < len(release.Rollout.Steps) && release.Rollout.Steps[next].Approval
+}
+
+// AwaitApproval pauses the rollout of the release on its current step until its next step is approved or rejected
+func AwaitApproval(release *models.Release) {
+	release.Status.Phase = PhaseAwaitingApproval
+	release.Status.NextStepAt = nil
+}
+
+// IsApprover returns true if a user can approve the steps of a rollout plan: one of its approvers,
+// or any authenticated user when the plan names none, as the step then only needs someone to look at the release.
+func IsApprover(plan models.RolloutPlan, user string) bool {
+	return user != "" && (len(plan.Approvers) == 0 || containsString(plan.Approvers, user))
+}
+
+// Approve records the approval of the next step of a release awaiting it, and moves the release to that step
+func Approve(release *models.Release, user string, comment string, now time.Time) {
+	step := release.Status.Step + 1
+	release.Status.Approvals = append(release.Status.Approvals, models.Approval{Time: now, Step: step, Decision: DecisionApproved, User: user, Comment: comment})
+	setStep(release, step, now)
+}
+
+// Reject records the rejection of the next step of a release awaiting it, and stops its rollout as rolled back
+func Reject(release *models.Release, user string, comment string, now time.Time) {
+	step := release.Status.Step + 1
+	release.Status.Approvals = append(release.Status.Approvals, models.Approval{Time: now, Step: step, Decision: DecisionRejected, User: user, Comment: comment})
+	release.Status.Phase = PhaseRolledBack
+	release.Status.NextStepAt = nil
+}
@@ -0,0 +1,52 @@
+package releases
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/devtio/canary/models"
+)
+
+func TestApproval(t *testing.T) {
+	now := time.Now()
+	release := testRelease()
+	release.Rollout = &models.RolloutPlan{
+		Steps:     []models.RolloutStep{{Weight: 0, Dwell: "1h"}, {Weight: 10, Dwell: "1h", Approval: true}, {Weight: 50, Dwell: "1h"}, {Weight: 100, Approval: true}},
+		Approvers: []string{"alice"},
+	}
+	assert.NoError(t, ValidateRollout(release.Rollout))
+	StartRollout(&release, now)
+	assert.True(t, NeedsApproval(release))
+	_, err := ScheduledStep(release)
+	assert.Error(t, err)
+	assert.Error(t, CanPromote(release))
+
+	AwaitApproval(&release)
+	assert.Equal(t, PhaseAwaitingApproval, release.Status.Phase)
+	assert.False(t, IsDue(release, now.Add(2*time.Hour)))
+	assert.True(t, IsApprover(*release.Rollout, "alice"))
+	assert.False(t, IsApprover(*release.Rollout, "bob"))
+
+	Approve(&release, "alice", "change 42", now)
+	assert.Equal(t, PhaseProgressing, release.Status.Phase)
+	assert.Equal(t, 1, release.Status.Step)
+	assert.Equal(t, 10, release.Status.Weight)
+	assert.False(t, NeedsApproval(release))
+
+	NextStep(&release, now.Add(time.Hour))
+	assert.True(t, NeedsApproval(release))
+	Reject(&release, "alice", "", now.Add(2*time.Hour))
+	assert.Equal(t, PhaseRolledBack, release.Status.Phase)
+	assert.Equal(t, []models.Approval{
+		{Time: now, Step: 1, Decision: DecisionApproved, User: "alice", Comment: "change 42"},
+		{Time: now.Add(2 * time.Hour), Step: 3, Decision: DecisionRejected, User: "alice"},
+	}, release.Status.Approvals)
+
+	release.Rollout.Steps[0].Approval = true
+	assert.Error(t, ValidateRollout(release.Rollout))
+	assert.False(t, IsApprover(models.RolloutPlan{}, ""))
+	// without approvers, any authenticated user can approve
+	assert.True(t, IsApprover(models.RolloutPlan{}, "bob"))
+}
@@ -0,0 +1,142 @@
+package releases
+
+import (
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/models"
+)
+
+// Phases of a blue/green release
+const (
+	PhaseStandby  = "Standby"
+	PhaseSwitched = "Switched"
+)
+
+// SwitchVersions makes the rules of the VirtualService routing to the apps of a blue/green release, other than the rules
+// of releases, route to the release's versions instead of the versions they routed to.
+// It returns the versions the rules routed the apps to before, by app, and false if the VirtualService was left unchanged.
+func SwitchVersions(vs *VirtualService, release models.Release) (map[string]string, bool) {
+	previous := map[string]string{}
+	if !vs.IsManaged() {
+		return previous, false
+	}
+	changed := false
+	for _, app := range release.Apps {
+		name, version := app.Labels[AppLabel], app.Labels[VersionLabel]
+		if name == "" || version == "" {
+			continue
+		}
+		changed = replaceSubsets(vs, name, func(subset string) (string, bool) {
+			if subset == version {
+				return "", false
+			}
+			if _, ok := previous[name]; !ok {
+				previous[name] = subset
+			}
+			return version, true
+		}) || changed
+	}
+	return previous, changed
+}
+
+// SwitchBackVersions makes the rules SwitchVersions changed route to the versions they routed to before, by app.
+// It returns false if the VirtualService was left unchanged.
+func SwitchBackVersions(vs *VirtualService, release models.Release, previous map[string]string) bool {
+	if !vs.IsManaged() {
+		return false
+	}
+	changed := false
+	for _, app := range release.Apps {
+		name, version := app.Labels[AppLabel], app.Labels[VersionLabel]
+		before, ok := previous[name]
+		if name == "" || version == "" || !ok {
+			continue
+		}
+		changed = replaceSubsets(vs, name, func(subset string) (string, bool) {
+			return before, subset == version
+		}) || changed
+	}
+	return changed
+}
+
+// replaceSubsets replaces the subsets of the destinations of an app in the rules of the VirtualService, other than
+// the rules of releases, by the subsets replace returns true for
+func replaceSubsets(vs *VirtualService, app string, replace func(subset string) (string, bool)) bool {
+	changed := false
+	for i, route := range vs.Spec.HTTP {
+		if vs.matchedReleaseID(route) != "" || vs.appendedReleaseID(route) != "" {
+			continue
+		}
+		destinations := make([]DestinationWeight, len(route.Route))
+		copy(destinations, route.Route)
+		replaced := false
+		for j, destination := range destinations {
+			if destination.Destination.Host != app {
+				continue
+			}
+			if subset, ok := replace(destination.Destination.Subset); ok {
+				destinations[j].Destination.Subset = subset
+				replaced = true
+			}
+		}
+		if replaced {
+			vs.Spec.HTTP[i].Route = destinations
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Switch sends all of the traffic of the apps of a blue/green release to the release's versions in its clusters,
+// and stores the versions they were switched from with the store of local, the client of the cluster canary runs in.
+// It returns the outcome of the change, and an error on any problem, the clusters already changed are then restored.
+func Switch(local kubernetes.IstioClientInterface, clusters []Cluster, namespace string, release models.Release) (models.ReleaseResult, error) {
+	previous := map[string]string{}
+	statuses, changes, err := ApplyToClusters(clusters, namespace, func(cluster Cluster, vs *VirtualService) bool {
+		replaced, changed := SwitchVersions(vs, release)
+		for app, version := range replaced {
+			if _, ok := previous[app]; !ok {
+				previous[app] = version
+			}
+		}
+		return changed
+	})
+	if err == nil {
+		setSwitchStatus(&release, PhaseSwitched, previous)
+	}
+	return storeSwitch(local, namespace, release, statuses, changes, err)
+}
+
+// SwitchBack sends the traffic of the apps of a switched blue/green release back to the versions it was switched from.
+// It returns the outcome of the change, and an error on any problem, the clusters already changed are then restored.
+func SwitchBack(local kubernetes.IstioClientInterface, clusters []Cluster, namespace string, release models.Release) (models.ReleaseResult, error) {
+	previous := map[string]string{}
+	if release.Status != nil {
+		previous = release.Status.PreviousVersions
+	}
+	statuses, changes, err := ApplyToClusters(clusters, namespace, func(cluster Cluster, vs *VirtualService) bool {
+		return SwitchBackVersions(vs, release, previous)
+	})
+	if err == nil {
+		setSwitchStatus(&release, PhaseStandby, nil)
+	}
+	return storeSwitch(local, namespace, release, statuses, changes, err)
+}
+
+func setSwitchStatus(release *models.Release, phase string, previous map[string]string) {
+	status := models.ReleaseStatus{}
+	if release.Status != nil {
+		status = *release.Status
+	}
+	status.Phase = phase
+	status.PreviousVersions = previous
+	release.Status = &status
+}
+
+func storeSwitch(local kubernetes.IstioClientInterface, namespace string, release models.Release, statuses []models.ClusterStatus, changes []models.VirtualServiceChange, err error) (models.ReleaseResult, error) {
+	result := NewReleaseResult(release, statuses, changes)
+	if err != nil {
+		return result, err
+	}
+	SetClusterStatuses(&result.Release, statuses)
+	return result, StoreRelease(NewConfigMapStore(local), namespace, result.Release)
+}
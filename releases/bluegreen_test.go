@@ -0,0 +1,103 @@
+package releases
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/models"
+)
+
+func blueGreenRelease() models.Release {
+	release := testRelease()
+	release.Strategy = StrategyBlueGreen
+	release.Match = nil
+	return release
+}
+
+func TestBlueGreenRelease(t *testing.T) {
+	gateway, app := mustParse(t, gatewayVirtualService()), mustParse(t, appVirtualService())
+	release := blueGreenRelease()
+	assert.Empty(t, ValidateRelease(release))
+	assert.True(t, AddRelease(gateway, release))
+	assert.True(t, AddRelease(app, release))
+
+	// until the switch, only the requests carrying the release id reach the release's version
+	gatewayRules := mustEncode(t, gateway)["http"].([]interface{})
+	assert.Equal(t, `[{"headers":{"devtio":{"exact":"release1"}}}]`, mustJSON(t, gatewayRules[0].(map[string]interface{})["match"]))
+	expected := release
+	expected.Mode = ModeRouted
+	assert.Equal(t, expected, Releases([]*VirtualService{reparse(t, gateway), reparse(t, app)})["release1"])
+
+	previous, changed := SwitchVersions(app, release)
+	assert.True(t, changed)
+	assert.Equal(t, map[string]string{"a": "v1"}, previous)
+	appRules := mustEncode(t, app)["http"].([]interface{})
+	assert.Equal(t, `[{"destination":{"host":"a","subset":"v2"}}]`, mustJSON(t, appRules[1].(map[string]interface{})["route"]))
+	_, changed = SwitchVersions(app, release)
+	assert.False(t, changed)
+
+	// switching back restores the previous versions, removing the release switches it back too
+	assert.True(t, SwitchBackVersions(app, release, previous))
+	assert.Equal(t, mustJSON(t, appVirtualService().Spec["http"].([]interface{})[0]), mustJSON(t, mustEncode(t, app)["http"].([]interface{})[1]))
+	SwitchVersions(app, release)
+	release.Status = &models.ReleaseStatus{Phase: PhaseSwitched, PreviousVersions: previous}
+	assert.True(t, RemoveReleaseRules(app, release))
+	assert.Equal(t, mustJSON(t, appVirtualService().Spec), mustJSON(t, mustEncode(t, app)))
+
+	release.Rollout = &models.RolloutPlan{Steps: []models.RolloutStep{{Weight: 100}}}
+	release.SmokeChecks = []models.SmokeCheck{{Name: "health", App: "b", Path: "health"}}
+	fields := []string{}
+	for _, field := range ValidateRelease(release) {
+		fields = append(fields, field.Field)
+	}
+	assert.Equal(t, []string{"rollout", "smokeChecks[0].app", "smokeChecks[0].port", "smokeChecks[0].path"}, fields)
+}
+
+// podsClient serves a ready pod and a pod that isn't ready, whose /health path answers the requests of release1
+type podsClient struct {
+	kubernetes.IstioClientInterface
+	selector string
+	proxied  []string
+}
+
+func (in *podsClient) GetPods(namespace, labelSelector string) (*v1.PodList, error) {
+	in.selector = labelSelector
+	ready := v1.PodStatus{Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}}
+	return &v1.PodList{Items: []v1.Pod{
+		{ObjectMeta: meta_v1.ObjectMeta{Name: "a-v2-1"}, Status: ready},
+		{ObjectMeta: meta_v1.ObjectMeta{Name: "a-v2-2"}},
+	}}, nil
+}
+
+func (in *podsClient) ProxyPodGet(namespace string, pod string, port int, path string, headers map[string]string) (int, error) {
+	in.proxied = append(in.proxied, fmt.Sprintf("%s/%s:%d", namespace, pod, port))
+	if path != "/health" || headers[ReleaseHeader] != "release1" {
+		return http.StatusNotFound, nil
+	}
+	return http.StatusOK, nil
+}
+
+func TestRunSmokeChecks(t *testing.T) {
+	client := &podsClient{}
+	release := blueGreenRelease()
+	release.SmokeChecks = []models.SmokeCheck{{Name: "health", App: "a", Port: 8080, Path: "/health"}}
+	now := time.Now()
+	results, passed := RunSmokeChecks([]Cluster{{Client: client}}, "dummy", release, now)
+	assert.True(t, passed)
+	assert.Equal(t, []models.SmokeResult{{Name: "health", Pod: "a-v2-1", Time: now, Outcome: VerdictPassed}}, results)
+	assert.Equal(t, "app=a,version=v2", client.selector)
+	assert.Equal(t, []string{"dummy/a-v2-1:8080"}, client.proxied)
+
+	release.SmokeChecks[0].Path = "/ready"
+	results, passed = RunSmokeChecks([]Cluster{{Client: client}}, "dummy", release, now)
+	assert.False(t, passed)
+	assert.Equal(t, VerdictFailed, results[0].Outcome)
+	assert.Equal(t, "answered 404 Not Found, expected a 2xx status", results[0].Message)
+}
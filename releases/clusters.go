@@ -0,0 +1,239 @@
+package releases
+
+import (
+	"fmt"
+
+	"github.com/devtio/canary/config"
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/log"
+	"github.com/devtio/canary/models"
+)
+
+// Outcomes of the change of a release in one of its clusters
+const (
+	ClusterApplied       = "Applied"
+	ClusterFailed        = "Failed"
+	ClusterRolledBack    = "RolledBack"
+	ClusterNotRolledBack = "NotRolledBack"
+	ClusterSkipped       = "Skipped"
+)
+
+// Cluster is a cluster a release is applied to.
+// The cluster canary runs in has an empty name when the release doesn't name its clusters.
+type Cluster struct {
+	Name          string
+	Client        kubernetes.IstioClientInterface
+	PrometheusURL string
+}
+
+// ReleaseClusters returns the clusters of the release in the order of the configuration,
+// or the cluster canary runs in, with the local client, when the release names none.
+// It returns an error if a cluster isn't configured or can't be reached.
+func ReleaseClusters(release models.Release, local kubernetes.IstioClientInterface) ([]Cluster, error) {
+	return clustersNamed(release.Clusters, local)
+}
+
+// UpdateClusters returns the clusters of the previous version of a release and of its new version, without duplicates.
+// The clusters no longer targeted by the release are in it, so the rules of the previous version can be removed from them.
+// It returns an error if a cluster isn't configured or can't be reached.
+func UpdateClusters(previous, release models.Release, local kubernetes.IstioClientInterface) ([]Cluster, error) {
+	if len(previous.Clusters) == 0 || len(release.Clusters) == 0 {
+		previousClusters, err := ReleaseClusters(previous, local)
+		if err != nil {
+			return nil, err
+		}
+		clusters, err := ReleaseClusters(release, local)
+		if err != nil {
+			return nil, err
+		}
+		if len(previous.Clusters) == 0 && len(release.Clusters) == 0 {
+			return clusters, nil
+		}
+		// the cluster canary runs in goes first, as it did when releases had no clusters
+		if len(previous.Clusters) == 0 {
+			return append(previousClusters, clusters...), nil
+		}
+		return append(clusters, previousClusters...), nil
+	}
+	names := append(append([]string{}, previous.Clusters...), release.Clusters...)
+	return clustersNamed(names, local)
+}
+
+func clustersNamed(names []string, local kubernetes.IstioClientInterface) ([]Cluster, error) {
+	prometheusURL := config.Get().Products.PrometheusServiceURL
+	if len(names) == 0 {
+		return []Cluster{{Client: local, PrometheusURL: prometheusURL}}, nil
+	}
+	for _, name := range names {
+		if _, ok := clusterConfig(name); !ok {
+			return nil, fmt.Errorf("cluster %s isn't configured", name)
+		}
+	}
+
+	clusters := []Cluster{}
+	for _, c := range config.Get().Clusters {
+		if !containsString(names, c.Name) {
+			continue
+		}
+		cluster := Cluster{Name: c.Name, Client: local, PrometheusURL: prometheusURL}
+		if c.Context != "" {
+			client, err := kubernetes.GetContextClient(c.Context)
+			if err != nil {
+				return nil, fmt.Errorf("cluster %s can't be reached: %v", c.Name, err)
+			}
+			cluster.Client = client
+		}
+		if c.PrometheusServiceURL != "" {
+			cluster.PrometheusURL = c.PrometheusServiceURL
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
+
+func clusterConfig(name string) (config.ClusterConfig, bool) {
+	for _, c := range config.Get().Clusters {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return config.ClusterConfig{}, false
+}
+
+// Targets returns true if the release is applied to the cluster
+func Targets(release models.Release, cluster Cluster) bool {
+	if len(release.Clusters) == 0 {
+		return cluster.Name == ""
+	}
+	return containsString(release.Clusters, cluster.Name)
+}
+
+// ApplyToClusters applies change to the managed VirtualServices of the namespace in every cluster, one cluster after the other,
+// each cluster as a transaction, see UpdateVirtualServices.
+// If a cluster fails, the clusters after it are skipped and the clusters before it are restored, latest first.
+// It returns the outcome for every cluster, the changes of the VirtualServices of every cluster, and the error of the
+// cluster that failed.
+func ApplyToClusters(clusters []Cluster, namespace string, change func(Cluster, *VirtualService) bool) ([]models.ClusterStatus, []models.VirtualServiceChange, error) {
+	statuses := []models.ClusterStatus{}
+	// the changes and the VirtualServices written in each cluster, restoring a cluster updates its changes
+	clusterChanges := [][]models.VirtualServiceChange{}
+	clusterApplied := [][]appliedChange{}
+	var err error
+	for i, cluster := range clusters {
+		cluster := cluster
+		var managed []*VirtualService
+		var changes []models.VirtualServiceChange
+		var applied []appliedChange
+		managed, err = GetManagedVirtualServices(cluster.Client, namespace)
+		if err == nil {
+			changes, applied, err = applyVirtualServices(cluster.Client, namespace, managed, func(vs *VirtualService) bool {
+				return change(cluster, vs)
+			})
+		}
+		for j := range changes {
+			changes[j].Cluster = cluster.Name
+		}
+		clusterChanges = append(clusterChanges, changes)
+		if err != nil {
+			log.Errorf("Release can't be applied to cluster %s: %v", cluster.Name, err)
+			statuses = append(statuses, models.ClusterStatus{Cluster: cluster.Name, Outcome: ClusterFailed, Error: err.Error()})
+			for j := i - 1; j >= 0; j-- {
+				restoreVirtualServices(clusters[j].Client, namespace, clusterApplied[j], clusterChanges[j])
+				statuses[j].Outcome = ClusterRolledBack
+				if !allRestored(clusterChanges[j]) {
+					statuses[j].Outcome = ClusterNotRolledBack
+					statuses[j].Error = "Virtual services of the cluster can't all be restored"
+				}
+			}
+			for _, skipped := range clusters[i+1:] {
+				statuses = append(statuses, models.ClusterStatus{Cluster: skipped.Name, Outcome: ClusterSkipped})
+			}
+			break
+		}
+		statuses = append(statuses, models.ClusterStatus{Cluster: cluster.Name, Outcome: ClusterApplied})
+		clusterApplied = append(clusterApplied, applied)
+	}
+
+	changes := []models.VirtualServiceChange{}
+	for _, c := range clusterChanges {
+		changes = append(changes, c...)
+	}
+	return statuses, changes, err
+}
+
+// NewReleaseResult returns the outcome of a change of a release, with the outcome in each cluster for the releases
+// applied to several clusters
+func NewReleaseResult(release models.Release, statuses []models.ClusterStatus, changes []models.VirtualServiceChange) models.ReleaseResult {
+	result := models.ReleaseResult{Release: release, VirtualServices: changes}
+	if len(release.Clusters) > 0 {
+		result.Clusters = statuses
+	}
+	return result
+}
+
+// AddClusterSubsets adds the DestinationRule subsets the release routes to in each of the clusters, see AddSubsets.
+// It returns an error naming the cluster that failed.
+func AddClusterSubsets(clusters []Cluster, namespace string, release models.Release) error {
+	for _, cluster := range clusters {
+		if err := AddSubsets(cluster.Client, namespace, release); err != nil {
+			if cluster.Name != "" {
+				return fmt.Errorf("in cluster %s, %v", cluster.Name, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveClusterSubsets removes the DestinationRule subsets canary added for the versions of a release that are no longer
+// routed to in the clusters, see RemoveUnusedSubsets.
+// The release's rules are already applied or removed, so failing to clean up is logged instead of returned.
+func RemoveClusterSubsets(clusters []Cluster, namespace string, release models.Release) {
+	for _, cluster := range clusters {
+		if err := RemoveUnusedSubsets(cluster.Client, namespace, release); err != nil {
+			log.Errorf("Destination rule subsets of release %s/%s can't be removed from cluster %s: %v", namespace, release.ID, cluster.Name, err)
+		}
+	}
+}
+
+// SetClusterStatuses records the outcome of the last change of a release in each of its clusters,
+// for the releases applied to several clusters that have a status
+func SetClusterStatuses(release *models.Release, statuses []models.ClusterStatus) {
+	if len(release.Clusters) > 0 && release.Status != nil {
+		release.Status.Clusters = statuses
+	}
+}
+
+func allRestored(changes []models.VirtualServiceChange) bool {
+	for _, change := range changes {
+		if change.Outcome != ChangeRestored {
+			return false
+		}
+	}
+	return true
+}
+
+// PreviewClusters applies change to the managed VirtualServices of the namespace in every cluster and returns
+// what would be written for the ones it modified, without writing anything.
+// It returns an error on any problem.
+func PreviewClusters(clusters []Cluster, namespace string, change func(Cluster, *VirtualService) bool) ([]models.VirtualServicePreview, error) {
+	previews := []models.VirtualServicePreview{}
+	for _, cluster := range clusters {
+		cluster := cluster
+		managed, err := GetManagedVirtualServices(cluster.Client, namespace)
+		if err != nil {
+			return nil, err
+		}
+		clusterPreviews, err := PreviewVirtualServices(managed, func(vs *VirtualService) bool {
+			return change(cluster, vs)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, preview := range clusterPreviews {
+			preview.Cluster = cluster.Name
+			previews = append(previews, preview)
+		}
+	}
+	return previews, nil
+}
@@ -0,0 +1,87 @@
+package releases
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/devtio/canary/config"
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/models"
+)
+
+// listingClient is a storingClient that also lists the VirtualServices written to it
+type listingClient struct {
+	storingClient
+}
+
+func (in *listingClient) GetVirtualServices(namespace string, serviceName string) ([]kubernetes.IstioObject, error) {
+	return []kubernetes.IstioObject{in.objects["gateway"].DeepCopyIstioObject(), in.objects["a"].DeepCopyIstioObject()}, nil
+}
+
+func newListingClient(fail string) *listingClient {
+	return &listingClient{storingClient{
+		objects: map[string]kubernetes.IstioObject{"gateway": gatewayVirtualService(), "a": appVirtualService()},
+		fail:    fail,
+	}}
+}
+
+func TestApplyToClustersRollsBackOnFailure(t *testing.T) {
+	east, west, south := newListingClient(""), newListingClient("a"), newListingClient("")
+	clusters := []Cluster{{Name: "east", Client: east}, {Name: "west", Client: west}, {Name: "south", Client: south}}
+	statuses, changes, err := ApplyToClusters(clusters, "dummy", func(cluster Cluster, vs *VirtualService) bool {
+		return AddRelease(vs, testRelease())
+	})
+	assert.Error(t, err)
+	assert.Equal(t, []models.ClusterStatus{
+		{Cluster: "east", Outcome: ClusterRolledBack},
+		{Cluster: "west", Outcome: ClusterFailed, Error: "a can't be written"},
+		{Cluster: "south", Outcome: ClusterSkipped},
+	}, statuses)
+	assert.Len(t, changes, 4)
+	assert.Equal(t, "east", changes[0].Cluster)
+	assert.Equal(t, ChangeRestored, changes[0].Outcome)
+	assert.Equal(t, ChangeRestored, changes[1].Outcome)
+	assert.Equal(t, mustJSON(t, appVirtualService().Spec), mustJSON(t, east.objects["a"].GetSpec()))
+	assert.Equal(t, mustJSON(t, appVirtualService().Spec), mustJSON(t, south.objects["a"].GetSpec()))
+
+	clusters = []Cluster{{Name: "east", Client: east}, {Name: "south", Client: south}}
+	statuses, _, err = ApplyToClusters(clusters, "dummy", func(cluster Cluster, vs *VirtualService) bool {
+		return AddRelease(vs, testRelease())
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ClusterApplied, statuses[1].Outcome)
+	assert.Contains(t, Releases([]*VirtualService{mustParse(t, south.objects["a"])}), "release1")
+}
+
+func TestReleaseClusters(t *testing.T) {
+	c := config.NewConfig()
+	c.Clusters = []config.ClusterConfig{{Name: "east"}, {Name: "west", PrometheusServiceURL: "http://prometheus.west:9090"}}
+	config.Set(c)
+	defer config.Set(config.NewConfig())
+	local := newListingClient("")
+
+	release := testRelease()
+	release.Clusters = []string{"west", "east"}
+	clusters, err := ReleaseClusters(release, local)
+	assert.NoError(t, err)
+	assert.Len(t, clusters, 2)
+	assert.Equal(t, "east", clusters[0].Name)
+	assert.Equal(t, "http://prometheus.west:9090", clusters[1].PrometheusURL)
+	assert.True(t, Targets(release, clusters[0]))
+
+	// the cluster canary runs in keeps the rules of the release until it is removed from it
+	previous := testRelease()
+	clusters, err = UpdateClusters(previous, release, local)
+	assert.NoError(t, err)
+	assert.Len(t, clusters, 3)
+	assert.Equal(t, "", clusters[0].Name)
+	assert.False(t, Targets(release, clusters[0]))
+
+	release.Clusters = []string{"east", "north", "east"}
+	_, err = ReleaseClusters(release, local)
+	assert.Error(t, err)
+	fields := ValidateRelease(release)
+	assert.Contains(t, fields, models.FieldError{Field: "clusters[1]", Message: "cluster north isn't configured"})
+	assert.Contains(t, fields, models.FieldError{Field: "clusters[2]", Message: "cluster east is listed more than once"})
+}
@@ -0,0 +1,67 @@
+package releases
+
+import (
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/log"
+	"github.com/devtio/canary/models"
+)
+
+// CreateChange returns the change adding a release to the VirtualServices of its clusters: its rules on the gateway-bound
+// and app-bound VirtualServices, and the weight of the first step of its rollout on the rules of its apps
+func CreateChange(release models.Release) func(Cluster, *VirtualService) bool {
+	return func(cluster Cluster, vs *VirtualService) bool {
+		added := AddRelease(vs, release)
+		weighted := release.Status != nil && SetWeight(vs, release, release.Status.Weight)
+		return added || weighted
+	}
+}
+
+// Create adds the DestinationRule subsets of the release's versions to its clusters, applies CreateChange to them,
+// and stores the release with local, the client of the cluster canary runs in.
+// The release must have been validated with ValidateRelease and ValidateReleaseInClusters, its traffic segment resolved
+// and its rollout started.
+// It returns the outcome of the change, and an error on any problem, the clusters already changed are then restored,
+// including when the release can't be stored after changing all of them.
+func Create(local kubernetes.IstioClientInterface, clusters []Cluster, namespace string, release models.Release) (models.ReleaseResult, error) {
+	result := NewReleaseResult(release, nil, []models.VirtualServiceChange{})
+	if err := AddClusterSubsets(clusters, namespace, release); err != nil {
+		return result, err
+	}
+	statuses, changes, err := ApplyToClusters(clusters, namespace, CreateChange(release))
+	result = NewReleaseResult(release, statuses, changes)
+	if err != nil {
+		RemoveClusterSubsets(clusters, namespace, release)
+		return result, err
+	}
+	SetClusterStatuses(&result.Release, statuses)
+	if err := StoreRelease(NewConfigMapStore(local), namespace, result.Release); err != nil {
+		// without its stored state the release can't be rolled out or rolled back, so its rules are removed again
+		if _, _, rollbackErr := Rollback(clusters, namespace, release); rollbackErr != nil {
+			log.Errorf("Release %s/%s can't be removed after failing to store it: %v", namespace, release.ID, rollbackErr)
+		}
+		RemoveClusterSubsets(clusters, namespace, release)
+		return result, err
+	}
+	return result, nil
+}
+
+// StoreRelease keeps the traffic segment, clusters, rollout plan and progress of the release, the blue/green switch,
+// the traffic policies of its apps and its Deployments, as they can't be read back from the VirtualServices,
+// and removes the releases that need none of them from the store
+func StoreRelease(store Store, namespace string, release models.Release) error {
+	if release.Rollout == nil && release.Segment == "" && len(release.Clusters) == 0 && release.Strategy != StrategyBlueGreen &&
+		!hasTrafficPolicy(release) && len(release.Deployments) == 0 {
+		return store.Delete(namespace, release.ID)
+	}
+	return store.Put(namespace, release)
+}
+
+// hasTrafficPolicy returns true if an app of the release sets a traffic policy on the subset of its version
+func hasTrafficPolicy(release models.Release) bool {
+	for _, app := range release.Apps {
+		if app.TrafficPolicy != nil {
+			return true
+		}
+	}
+	return false
+}
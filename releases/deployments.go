@@ -0,0 +1,369 @@
+package releases
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/api/apps/v1beta1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/log"
+	"github.com/devtio/canary/models"
+)
+
+// PhaseDeploying is the phase of a release waiting for the Deployments canary created for it,
+// it has no rules in the VirtualServices of its clusters until they are ready, see StartDeployed
+const PhaseDeploying = "Deploying"
+
+// IsDeploying returns true if the release waits for its Deployments to be ready before its rules are added
+func IsDeploying(release models.Release) bool {
+	return release.Status != nil && release.Status.Phase == PhaseDeploying
+}
+
+// ValidateDeployments checks that the Deployments to create for a release are complete,
+// and that each one deploys the release's version of one of its apps that has no Deployment created by canary yet.
+// It returns the invalid fields, or an empty list if the Deployments are valid.
+func ValidateDeployments(release models.Release, deployments []models.Deployment) []models.FieldError {
+	fields := []models.FieldError{}
+	if len(deployments) == 0 {
+		fields = append(fields, models.FieldError{Field: "deployments", Message: "at least one deployment is required"})
+	}
+	for i, deployment := range deployments {
+		field := fmt.Sprintf("deployments[%d]", i)
+		version := releaseVersion(release, deployment.App)
+		switch {
+		case deployment.App == "":
+			fields = append(fields, models.FieldError{Field: field + ".app", Message: "is required"})
+		case version == "":
+			fields = append(fields, models.FieldError{Field: field + ".app", Message: fmt.Sprintf("app %s isn't part of the release", deployment.App)})
+		case hasDeployment(release.Deployments, deployment.App) || hasDeployment(deployments[:i], deployment.App):
+			fields = append(fields, models.FieldError{Field: field + ".app", Message: fmt.Sprintf("app %s already has a deployment", deployment.App)})
+		default:
+			for _, message := range validation.IsDNS1123Subdomain(deploymentName(deployment.App, version)) {
+				fields = append(fields, models.FieldError{Field: field + ".app", Message: "deployment " + deploymentName(deployment.App, version) + ": " + message})
+			}
+		}
+		if deployment.Image == "" {
+			fields = append(fields, models.FieldError{Field: field + ".image", Message: "is required"})
+		}
+	}
+	return fields
+}
+
+// CanUpdateDeployments returns an error if the update of a release would lose track of the Deployments canary created
+// for its previous version: when it changes the version of an app that has one, drops the app, or changes its clusters.
+func CanUpdateDeployments(previous, release models.Release) error {
+	for _, deployment := range previous.Deployments {
+		version := releaseVersion(release, deployment.App)
+		if version != releaseVersion(previous, deployment.App) {
+			return fmt.Errorf("release %s has deployment %s, the version of app %s can't change", release.ID, deployment.Name, deployment.App)
+		}
+	}
+	if len(previous.Deployments) > 0 && !sameClusters(previous.Clusters, release.Clusters) {
+		return fmt.Errorf("release %s has deployments, its clusters can't change", release.ID)
+	}
+	return nil
+}
+
+// CloneDeployment returns a Deployment of the release's version of an app, cloned from the Deployment of its stable version:
+// its pods get the version and release labels, and the image of the deployment.
+// It returns an error if the stable Deployment doesn't select its pods by version, as it would select the pods of the clone,
+// or if its pods have no container named after the deployment's.
+func CloneDeployment(stable v1beta1.Deployment, release models.Release, deployment models.Deployment) (*v1beta1.Deployment, error) {
+	version := releaseVersion(release, deployment.App)
+	if stable.Spec.Selector == nil || stable.Spec.Selector.MatchLabels[VersionLabel] == "" {
+		return nil, fmt.Errorf("deployment %s doesn't select its pods by their %s label", stable.Name, VersionLabel)
+	}
+	spec := stable.Spec.DeepCopy()
+	spec.Selector.MatchLabels[VersionLabel] = version
+	spec.Template.Labels = withReleaseLabels(spec.Template.Labels, version, release.ID)
+	i := containerIndex(spec.Template.Spec.Containers, deployment.Container)
+	if i == -1 {
+		return nil, fmt.Errorf("deployment %s has no container named %s", stable.Name, deployment.Container)
+	}
+	spec.Template.Spec.Containers[i].Image = deployment.Image
+
+	labels := withReleaseLabels(stable.Labels, version, release.ID)
+	labels[ManagedLabel] = "true"
+	return &v1beta1.Deployment{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      deploymentName(deployment.App, version),
+			Namespace: stable.Namespace,
+			Labels:    labels,
+		},
+		Spec: *spec,
+	}, nil
+}
+
+// CreateDeployments creates the Deployments of the release's versions of apps in every cluster of the release,
+// cloning the Deployments of the stable versions of the apps in each cluster, see CloneDeployment.
+// The stable version of an app is the version the managed VirtualServices route the requests that are not part of the release to.
+// It returns the deployments with their name, and an error naming the cluster that failed on any problem,
+// the Deployments already created are then deleted.
+func CreateDeployments(clusters []Cluster, namespace string, release models.Release, deployments []models.Deployment) ([]models.Deployment, error) {
+	created := []models.Deployment{}
+	for _, deployment := range deployments {
+		deployment.Name = deploymentName(deployment.App, releaseVersion(release, deployment.App))
+		created = append(created, deployment)
+	}
+	for i, cluster := range clusters {
+		if err := createClusterDeployments(cluster, namespace, release, created); err != nil {
+			// the clusters changed before are cleaned up, createClusterDeployments cleans up the one that failed
+			release.Deployments = created
+			DeleteDeployments(clusters[:i], namespace, release)
+			if cluster.Name != "" {
+				return nil, fmt.Errorf("in cluster %s, %v", cluster.Name, err)
+			}
+			return nil, err
+		}
+	}
+	return created, nil
+}
+
+// Deploy creates the Deployments of the release's versions in its clusters, see CreateDeployments, and holds the release
+// until they are ready: the rules the release already has are removed from its clusters, and it's stored in PhaseDeploying
+// with local, the client of the cluster canary runs in, so no traffic is sent to versions that have no pods yet.
+// The release must have been validated with ValidateRelease and ValidateReleaseInClusters and its traffic segment resolved,
+// the deployments with ValidateDeployments.
+// It returns the outcome of the change, and an error on any problem, the Deployments created are then deleted
+// and the release is stored as it was.
+func Deploy(local kubernetes.IstioClientInterface, clusters []Cluster, namespace string, release models.Release, deployments []models.Deployment) (models.ReleaseResult, error) {
+	result := NewReleaseResult(release, nil, []models.VirtualServiceChange{})
+	store := NewConfigMapStore(local)
+	previous, err := store.Get(namespace, release.ID)
+	if err != nil {
+		return result, err
+	}
+	created, err := CreateDeployments(clusters, namespace, release, deployments)
+	if err != nil {
+		return result, err
+	}
+	held := release
+	held.Deployments = append(append([]models.Deployment{}, release.Deployments...), created...)
+	held.Status = &models.ReleaseStatus{Phase: PhaseDeploying}
+	// the release is held before its rules are removed, so the controller doesn't advance it in between
+	if err := store.Put(namespace, held); err != nil {
+		DeleteDeployments(clusters, namespace, models.Release{ID: release.ID, Deployments: created})
+		return result, err
+	}
+	statuses, changes, err := Rollback(clusters, namespace, release)
+	result = NewReleaseResult(held, statuses, changes)
+	if err != nil {
+		restoreErr := store.Delete(namespace, release.ID)
+		if previous != nil {
+			restoreErr = store.Put(namespace, *previous)
+		}
+		if restoreErr != nil {
+			log.Errorf("Release %s/%s can't be restored after failing to remove its rules: %v", namespace, release.ID, restoreErr)
+		}
+		DeleteDeployments(clusters, namespace, models.Release{ID: release.ID, Deployments: created})
+		return result, err
+	}
+	RemoveClusterSubsets(clusters, namespace, release)
+	return result, nil
+}
+
+// StartDeployed starts the rollout of a release held in PhaseDeploying and creates it, see Create,
+// once DeploymentsReady reports its Deployments ready.
+// It returns the outcome of the change, and an error on any problem, the release is then still held.
+func StartDeployed(local kubernetes.IstioClientInterface, clusters []Cluster, namespace string, release models.Release, now time.Time) (models.ReleaseResult, error) {
+	release.Status = nil
+	StartRollout(&release, now)
+	return Create(local, clusters, namespace, release)
+}
+
+// createClusterDeployments creates the Deployments in a cluster, it deletes the ones it created when one fails
+func createClusterDeployments(cluster Cluster, namespace string, release models.Release, deployments []models.Deployment) error {
+	managed, err := GetManagedVirtualServices(cluster.Client, namespace)
+	if err != nil {
+		return err
+	}
+	baselines := BaselineVersions(managed, release)
+	pods, err := cluster.Client.GetNamespacePods(namespace)
+	if err != nil {
+		return err
+	}
+	all, err := cluster.Client.GetDeployments(namespace)
+	if err != nil {
+		return err
+	}
+	created := models.Release{ID: release.ID}
+	for _, deployment := range deployments {
+		err := func() error {
+			service, err := cluster.Client.GetService(namespace, deployment.App)
+			if err != nil {
+				return err
+			}
+			stable, err := stableDeployment(kubernetes.FilterDeploymentsForService(service, pods, all), deployment.App,
+				releaseVersion(release, deployment.App), baselines[deployment.App])
+			if err != nil {
+				return err
+			}
+			clone, err := CloneDeployment(*stable, release, deployment)
+			if err != nil {
+				return err
+			}
+			log.Infof("Creating deployment %s/%s from deployment %s with image %s", namespace, clone.Name, stable.Name, deployment.Image)
+			_, err = cluster.Client.CreateDeployment(namespace, clone)
+			return err
+		}()
+		if err != nil {
+			DeleteDeployments([]Cluster{cluster}, namespace, created)
+			return err
+		}
+		created.Deployments = append(created.Deployments, deployment)
+	}
+	return nil
+}
+
+// stableDeployment returns the Deployment of the stable version of an app among the Deployments of its service,
+// the first Deployment of another version than the release's when the stable version isn't known.
+// It returns an error if a Deployment of the release's version already exists, or if there is no stable Deployment.
+func stableDeployment(deployments []v1beta1.Deployment, app, version, stableVersion string) (*v1beta1.Deployment, error) {
+	var stable *v1beta1.Deployment
+	for i, deployment := range deployments {
+		deploymentVersion := deployment.Spec.Template.Labels[VersionLabel]
+		if deploymentVersion == version {
+			return nil, errors.NewAlreadyExists(schema.GroupResource{Group: "apps", Resource: "deployments"}, deployment.Name)
+		}
+		if deploymentVersion == "" || (stableVersion != "" && deploymentVersion != stableVersion) {
+			continue
+		}
+		if stable == nil {
+			stable = &deployments[i]
+		}
+	}
+	if stable == nil {
+		return nil, fmt.Errorf("no deployment of the stable version of %s found", app)
+	}
+	return stable, nil
+}
+
+// DeploymentsReady returns why the Deployments canary created for the release aren't all rolled out and available
+// in the clusters of the release yet, or an empty string if they are.
+// It returns an error on any problem.
+func DeploymentsReady(clusters []Cluster, namespace string, release models.Release) (string, error) {
+	for _, cluster := range clusters {
+		for _, deployment := range release.Deployments {
+			object, err := cluster.Client.GetDeployment(namespace, deployment.Name)
+			if errors.IsNotFound(err) {
+				return inCluster(cluster, fmt.Sprintf("deployment %s not found", deployment.Name)), nil
+			}
+			if err != nil {
+				return "", err
+			}
+			if reason := deploymentReady(object); reason != "" {
+				return inCluster(cluster, reason), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// deploymentReady returns why the pods of the Deployment aren't all updated and available yet,
+// or an empty string if they are
+func deploymentReady(deployment *v1beta1.Deployment) string {
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+	if status.ObservedGeneration < deployment.Generation {
+		return fmt.Sprintf("deployment %s isn't rolled out yet", deployment.Name)
+	}
+	if status.UpdatedReplicas < replicas || status.AvailableReplicas < replicas {
+		return fmt.Sprintf("deployment %s has %d of %d replicas available", deployment.Name, status.AvailableReplicas, replicas)
+	}
+	return ""
+}
+
+// DeleteDeployments deletes the Deployments canary created for the release from its clusters,
+// a Deployment that doesn't carry the release label with the release id is left alone.
+// The release's rules are already removed, so failing to clean up is logged instead of returned.
+func DeleteDeployments(clusters []Cluster, namespace string, release models.Release) {
+	for _, cluster := range clusters {
+		for _, deployment := range release.Deployments {
+			object, err := cluster.Client.GetDeployment(namespace, deployment.Name)
+			if err == nil && object.Labels[ReleaseLabel] != release.ID {
+				continue
+			}
+			if err == nil {
+				log.Infof("Deleting deployment %s/%s of release %s", namespace, deployment.Name, release.ID)
+				err = cluster.Client.DeleteDeployment(namespace, deployment.Name)
+			}
+			if err != nil && !errors.IsNotFound(err) {
+				log.Errorf("Deployment %s/%s of release %s can't be deleted from cluster %s: %v", namespace, deployment.Name, release.ID, cluster.Name, err)
+			}
+		}
+	}
+}
+
+// releaseVersion returns the release's version of an app, or an empty string if the app isn't part of the release
+func releaseVersion(release models.Release, app string) string {
+	for _, releaseApp := range release.Apps {
+		if releaseApp.Labels[AppLabel] == app {
+			return releaseApp.Labels[VersionLabel]
+		}
+	}
+	return ""
+}
+
+func sameClusters(previous, clusters []string) bool {
+	names := map[string]bool{}
+	for _, name := range previous {
+		names[name] = true
+	}
+	for _, name := range clusters {
+		if !names[name] {
+			return false
+		}
+		delete(names, name)
+	}
+	return len(names) == 0
+}
+
+func hasDeployment(deployments []models.Deployment, app string) bool {
+	for _, deployment := range deployments {
+		if deployment.App == app {
+			return true
+		}
+	}
+	return false
+}
+
+// containerIndex returns the index of the container with the name, of the first container when the name is empty,
+// or -1 if there is none
+func containerIndex(containers []v1.Container, name string) int {
+	for i, container := range containers {
+		if name == "" || container.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func deploymentName(app, version string) string {
+	return app + "-" + version
+}
+
+func withReleaseLabels(labels map[string]string, version, releaseID string) map[string]string {
+	result := map[string]string{}
+	for k, v := range labels {
+		result[k] = v
+	}
+	result[VersionLabel] = version
+	result[ReleaseLabel] = releaseID
+	return result
+}
+
+func inCluster(cluster Cluster, message string) string {
+	if cluster.Name == "" {
+		return message
+	}
+	return fmt.Sprintf("in cluster %s, %s", cluster.Name, message)
+}
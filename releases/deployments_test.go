@@ -0,0 +1,108 @@
+package releases
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/apps/v1beta1"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/devtio/canary/models"
+)
+
+func stableDeploymentOf(version string) v1beta1.Deployment {
+	replicas := int32(2)
+	labels := map[string]string{AppLabel: "a", VersionLabel: version}
+	return v1beta1.Deployment{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "a-" + version, Namespace: "dummy", Labels: labels, ResourceVersion: "42"},
+		Spec: v1beta1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &meta_v1.LabelSelector{MatchLabels: map[string]string{AppLabel: "a", VersionLabel: version}},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: meta_v1.ObjectMeta{Labels: labels},
+				Spec: v1.PodSpec{Containers: []v1.Container{
+					{Name: "a", Image: "a:1.0"},
+					{Name: "sidecar", Image: "sidecar:1.0"},
+				}},
+			},
+		},
+	}
+}
+
+func TestValidateDeployments(t *testing.T) {
+	release := testRelease()
+	assert.Empty(t, ValidateDeployments(release, []models.Deployment{{App: "a", Image: "a:2.0"}}))
+
+	release.Deployments = []models.Deployment{{App: "a", Image: "a:2.0", Name: "a-v2"}}
+	assert.Equal(t, []models.FieldError{
+		{Field: "deployments[0].app", Message: "app a already has a deployment"},
+		{Field: "deployments[1].app", Message: "app b isn't part of the release"},
+		{Field: "deployments[1].image", Message: "is required"},
+	}, ValidateDeployments(release, []models.Deployment{{App: "a", Image: "a:3.0"}, {App: "b"}}))
+	assert.Equal(t, []models.FieldError{{Field: "deployments", Message: "at least one deployment is required"}}, ValidateDeployments(release, nil))
+}
+
+func TestCanUpdateDeployments(t *testing.T) {
+	previous := testRelease()
+	previous.Deployments = []models.Deployment{{App: "a", Image: "a:2.0", Name: "a-v2"}}
+	release := testRelease()
+	assert.NoError(t, CanUpdateDeployments(previous, release))
+
+	release.Apps[0].Labels[VersionLabel] = "v3"
+	assert.Error(t, CanUpdateDeployments(previous, release))
+	release = testRelease()
+	release.Clusters = []string{"west"}
+	assert.Error(t, CanUpdateDeployments(previous, release))
+	previous.Deployments = nil
+	assert.NoError(t, CanUpdateDeployments(previous, release))
+}
+
+func TestCloneDeployment(t *testing.T) {
+	stable := stableDeploymentOf("v1")
+	clone, err := CloneDeployment(stable, testRelease(), models.Deployment{App: "a", Image: "a:2.0", Container: "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, "a-v2", clone.Name)
+	assert.Empty(t, clone.ResourceVersion)
+	assert.Equal(t, map[string]string{AppLabel: "a", VersionLabel: "v2", ReleaseLabel: "release1", ManagedLabel: "true"}, clone.Labels)
+	assert.Equal(t, map[string]string{AppLabel: "a", VersionLabel: "v2"}, clone.Spec.Selector.MatchLabels)
+	assert.Equal(t, map[string]string{AppLabel: "a", VersionLabel: "v2", ReleaseLabel: "release1"}, clone.Spec.Template.Labels)
+	assert.Equal(t, "a:2.0", clone.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, "sidecar:1.0", clone.Spec.Template.Spec.Containers[1].Image)
+	assert.Equal(t, int32(2), *clone.Spec.Replicas)
+
+	// the stable deployment is left untouched
+	assert.Equal(t, stableDeploymentOf("v1"), stable)
+
+	_, err = CloneDeployment(stable, testRelease(), models.Deployment{App: "a", Image: "a:2.0", Container: "other"})
+	assert.Error(t, err)
+	delete(stable.Spec.Selector.MatchLabels, VersionLabel)
+	_, err = CloneDeployment(stable, testRelease(), models.Deployment{App: "a", Image: "a:2.0"})
+	assert.Error(t, err)
+}
+
+func TestStableDeployment(t *testing.T) {
+	deployments := []v1beta1.Deployment{stableDeploymentOf("v0"), stableDeploymentOf("v1")}
+	stable, err := stableDeployment(deployments, "a", "v2", "v1")
+	assert.NoError(t, err)
+	assert.Equal(t, "a-v1", stable.Name)
+	stable, err = stableDeployment(deployments, "a", "v2", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "a-v0", stable.Name)
+
+	_, err = stableDeployment(append(deployments, stableDeploymentOf("v2")), "a", "v2", "v1")
+	assert.Error(t, err)
+	_, err = stableDeployment(deployments, "a", "v2", "v3")
+	assert.Error(t, err)
+}
+
+func TestDeploymentReady(t *testing.T) {
+	deployment := stableDeploymentOf("v2")
+	deployment.Generation = 2
+	deployment.Status = v1beta1.DeploymentStatus{ObservedGeneration: 1}
+	assert.Equal(t, "deployment a-v2 isn't rolled out yet", deploymentReady(&deployment))
+	deployment.Status = v1beta1.DeploymentStatus{ObservedGeneration: 2, UpdatedReplicas: 2, AvailableReplicas: 1}
+	assert.Equal(t, "deployment a-v2 has 1 of 2 replicas available", deploymentReady(&deployment))
+	deployment.Status.AvailableReplicas = 2
+	assert.Empty(t, deploymentReady(&deployment))
+}
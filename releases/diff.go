@@ -0,0 +1,140 @@
+package releases
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/devtio/canary/models"
+)
+
+// Diff returns the JSON patch turning the spec the VirtualService was read with into its current spec.
+// It returns an error if the spec can't be encoded.
+func (vs *VirtualService) Diff() ([]models.PatchOperation, error) {
+	preview, err := vs.Preview()
+	if err != nil {
+		return nil, err
+	}
+	return preview.Patch, nil
+}
+
+// Preview returns the spec the VirtualService was read with, its current spec and the JSON patch between them.
+// It returns an error if the spec can't be encoded.
+func (vs *VirtualService) Preview() (models.VirtualServicePreview, error) {
+	object, err := vs.IstioObject()
+	if err != nil {
+		return models.VirtualServicePreview{}, err
+	}
+	proposed, err := toJSONObject(object.GetSpec())
+	if err != nil {
+		return models.VirtualServicePreview{}, specError("VirtualService", vs.ObjectMeta, err)
+	}
+	return models.VirtualServicePreview{
+		Name:     vs.Name,
+		Current:  vs.raw,
+		Proposed: proposed,
+		Patch:    diffJSON("", vs.raw, proposed),
+	}, nil
+}
+
+// diffJSON compares two JSON values, as decoded by encoding/json, and returns the operations turning before into after.
+// Arrays are aligned with the fewest additions, removals and modifications of elements, so inserting a rule
+// is a single add operation instead of a rewrite of every following rule.
+func diffJSON(path string, before, after interface{}) []models.PatchOperation {
+	patch := []models.PatchOperation{}
+	switch b := before.(type) {
+	case map[string]interface{}:
+		if a, ok := after.(map[string]interface{}); ok {
+			return append(patch, diffObjects(path, b, a)...)
+		}
+	case []interface{}:
+		if a, ok := after.([]interface{}); ok {
+			return append(patch, diffArrays(path, b, a)...)
+		}
+	}
+	if !reflect.DeepEqual(before, after) {
+		patch = append(patch, models.PatchOperation{Op: "replace", Path: path, Value: after})
+	}
+	return patch
+}
+
+func diffObjects(path string, before, after map[string]interface{}) []models.PatchOperation {
+	patch := []models.PatchOperation{}
+	for _, key := range sortedKeys(before) {
+		if _, ok := after[key]; !ok {
+			patch = append(patch, models.PatchOperation{Op: "remove", Path: path + "/" + escapePointer(key)})
+		}
+	}
+	for _, key := range sortedKeys(after) {
+		if b, ok := before[key]; ok {
+			patch = append(patch, diffJSON(path+"/"+escapePointer(key), b, after[key])...)
+		} else {
+			patch = append(patch, models.PatchOperation{Op: "add", Path: path + "/" + escapePointer(key), Value: after[key]})
+		}
+	}
+	return patch
+}
+
+func diffArrays(path string, before, after []interface{}) []models.PatchOperation {
+	// distance[i][j] is the number of operations turning before[i:] into after[j:],
+	// where a modified element costs the operations of its own patch
+	distance := make([][]int, len(before)+1)
+	modified := make([][][]models.PatchOperation, len(before)+1)
+	for i := range distance {
+		distance[i] = make([]int, len(after)+1)
+		modified[i] = make([][]models.PatchOperation, len(after)+1)
+	}
+	for i := len(before); i >= 0; i-- {
+		for j := len(after); j >= 0; j-- {
+			switch {
+			case i == len(before):
+				distance[i][j] = len(after) - j
+			case j == len(after):
+				distance[i][j] = len(before) - i
+			default:
+				modified[i][j] = diffJSON(path+"/"+strconv.Itoa(j), before[i], after[j])
+				distance[i][j] = min(len(modified[i][j])+distance[i+1][j+1], 1+min(distance[i+1][j], distance[i][j+1]))
+			}
+		}
+	}
+
+	patch := []models.PatchOperation{}
+	i, j := 0, 0
+	for i < len(before) || j < len(after) {
+		// j is the index of the element in the array being patched, as every previous element is already patched
+		switch {
+		case i < len(before) && j < len(after) && distance[i][j] == len(modified[i][j])+distance[i+1][j+1]:
+			patch = append(patch, modified[i][j]...)
+			i, j = i+1, j+1
+		case j < len(after) && (i == len(before) || distance[i][j] == 1+distance[i][j+1]):
+			patch = append(patch, models.PatchOperation{Op: "add", Path: path + "/" + strconv.Itoa(j), Value: after[j]})
+			j++
+		default:
+			patch = append(patch, models.PatchOperation{Op: "remove", Path: path + "/" + strconv.Itoa(j)})
+			i++
+		}
+	}
+	return patch
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escapePointer escapes a key for a JSON pointer, see https://tools.ietf.org/html/rfc6901
+func escapePointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,293 @@
+package releases
+
+import (
+	"sort"
+	"time"
+
+	"k8s.io/api/core/v1"
+
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/models"
+)
+
+// ReleaseLabel is the label of the pods naming the release they belong to
+const ReleaseLabel = "release"
+
+// Types of the events of a watch
+const (
+	EventReleaseCreated    = "ReleaseCreated"
+	EventReleaseRolledBack = "ReleaseRolledBack"
+	EventReleaseDeleted    = "ReleaseDeleted"
+	EventReleasePromoted   = "ReleasePromoted"
+	EventWeightShifted     = "WeightShifted"
+	EventPodReady          = "PodReady"
+	EventPodNotReady       = "PodNotReady"
+	EventObjectAdded       = "ObjectAdded"
+	EventObjectUpdated     = "ObjectUpdated"
+	EventObjectDeleted     = "ObjectDeleted"
+)
+
+// WatchEvents interprets the change of a watched object as the events of the releases of its namespace.
+// Changes of managed VirtualServices, Gateways and DestinationRules give an event for the object itself, followed,
+// for VirtualServices, by the releases whose rules were added or removed and the rollout weights that moved.
+// Removing the rules of a release is reported as a rollback, as a deletion when the DeletedReleaseAnnotation names it,
+// or as a promotion when the rules without a match now route to its versions.
+// Changes of release-labelled pods give an event when their readiness changes.
+// Other changes give no event.
+func WatchEvents(change kubernetes.ObjectEvent, now time.Time) []models.WatchEvent {
+	var events []models.WatchEvent
+	switch object := changedObject(change).(type) {
+	case *v1.Pod:
+		old, _ := change.Old.(*v1.Pod)
+		current, _ := change.New.(*v1.Pod)
+		events = podEvents(old, current)
+	case kubernetes.IstioObject:
+		old, _ := change.Old.(kubernetes.IstioObject)
+		current, _ := change.New.(kubernetes.IstioObject)
+		if !isWatched(old) && !isWatched(current) {
+			return nil
+		}
+		// informers report every object as updated when they list them again
+		if old != nil && current != nil && old.GetObjectMeta().ResourceVersion == current.GetObjectMeta().ResourceVersion {
+			return nil
+		}
+		events = append(events, objectEvent(object, old, current))
+		if _, ok := object.(*kubernetes.VirtualService); ok {
+			events = append(events, releaseEvents(old, current)...)
+		}
+	}
+	for i := range events {
+		events[i].Time = now
+	}
+	return events
+}
+
+func changedObject(change kubernetes.ObjectEvent) interface{} {
+	if change.New != nil {
+		return change.New
+	}
+	return change.Old
+}
+
+// isWatched returns true for the objects canary manages, or has added subsets to
+func isWatched(object kubernetes.IstioObject) bool {
+	if object == nil {
+		return false
+	}
+	meta := object.GetObjectMeta()
+	return IsManaged(meta) || meta.Annotations[ManagedSubsetsAnnotation] != ""
+}
+
+func objectEvent(object, old, current kubernetes.IstioObject) models.WatchEvent {
+	event := models.WatchEvent{
+		Type: EventObjectUpdated,
+		Kind: kindOf(object),
+		Name: object.GetObjectMeta().Name,
+	}
+	switch {
+	case old == nil:
+		event.Type = EventObjectAdded
+	case current == nil:
+		event.Type = EventObjectDeleted
+	}
+	return event
+}
+
+func kindOf(object kubernetes.IstioObject) string {
+	switch object.(type) {
+	case *kubernetes.VirtualService:
+		return "VirtualService"
+	case *kubernetes.Gateway:
+		return "Gateway"
+	case *kubernetes.DestinationRule:
+		return "DestinationRule"
+	}
+	return ""
+}
+
+// releaseState is what a VirtualService encodes of a release: the release and the rollout weight of each of its apps
+type releaseState struct {
+	release models.Release
+	weights map[string]int
+}
+
+func releaseEvents(old, current kubernetes.IstioObject) []models.WatchEvent {
+	object := current
+	if object == nil {
+		object = old
+	}
+	name := object.GetObjectMeta().Name
+	before, after := releaseStates(old), releaseStates(current)
+
+	events := []models.WatchEvent{}
+	for _, id := range sortedReleaseIDs(before) {
+		if _, ok := after[id]; !ok {
+			event := models.WatchEvent{Type: EventReleaseRolledBack, Kind: "VirtualService", Name: name, Release: id}
+			if isPromoted(old, current, id) {
+				event.Type = EventReleasePromoted
+			} else if current != nil && current.GetObjectMeta().Annotations[DeletedReleaseAnnotation] == id {
+				event.Type = EventReleaseDeleted
+			}
+			events = append(events, event)
+		}
+	}
+	for _, id := range sortedReleaseIDs(after) {
+		state := after[id]
+		previous, existed := before[id]
+		if !existed {
+			events = append(events, models.WatchEvent{Type: EventReleaseCreated, Kind: "VirtualService", Name: name, Release: id})
+		}
+		for _, app := range state.release.Apps {
+			appName := app.Labels[AppLabel]
+			weight, weighted := state.weights[appName]
+			previousWeight, previouslyWeighted := previous.weights[appName]
+			if weighted == previouslyWeighted && weight == previousWeight {
+				continue
+			}
+			events = append(events, models.WatchEvent{
+				Type:    EventWeightShifted,
+				Kind:    "VirtualService",
+				Name:    name,
+				Release: id,
+				App:     appName,
+				Version: app.Labels[VersionLabel],
+				Weight:  &weight,
+			})
+		}
+	}
+	return events
+}
+
+// releaseStates returns the releases encoded in a VirtualService, keyed by release id.
+// VirtualServices that can't be interpreted encode no release.
+func releaseStates(object kubernetes.IstioObject) map[string]releaseState {
+	states := map[string]releaseState{}
+	if object == nil {
+		return states
+	}
+	vs, err := ParseVirtualService(object)
+	if err != nil {
+		return states
+	}
+	for id, release := range Releases([]*VirtualService{vs}) {
+		states[id] = releaseState{release: release, weights: rolloutWeights(vs, release)}
+	}
+	return states
+}
+
+// rolloutWeights returns, for every app of the release, the share of the traffic of the app SetWeight sends to
+// the release's version. Apps with no share are left out.
+func rolloutWeights(vs *VirtualService, release models.Release) map[string]int {
+	weights := map[string]int{}
+	for _, app := range release.Apps {
+		name, version := app.Labels[AppLabel], app.Labels[VersionLabel]
+		for _, route := range vs.Spec.HTTP {
+			if vs.isReleaseRoute(route, release.ID) {
+				continue
+			}
+			for _, destination := range route.Route {
+				if destination.Destination.Host == name && destination.Destination.Subset == version && destination.Weight != nil {
+					weights[name] = *destination.Weight
+				}
+			}
+		}
+	}
+	return weights
+}
+
+// isPromoted returns true if a rule without a match of the current VirtualService routes an app only to a version
+// the rules of the release routed it to in the old one
+func isPromoted(old, current kubernetes.IstioObject, releaseID string) bool {
+	if current == nil {
+		return false
+	}
+	before, err := ParseVirtualService(old)
+	if err != nil {
+		return false
+	}
+	after, err := ParseVirtualService(current)
+	if err != nil {
+		return false
+	}
+	for _, route := range before.Spec.HTTP {
+		if !before.isReleaseRoute(route, releaseID) {
+			continue
+		}
+		for _, destination := range route.Route {
+			if routesOnlyTo(after, destination.Destination) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// routesOnlyTo returns true if a rule without a match, other than the rules of releases, routes the host of
+// the destination to its subset alone
+func routesOnlyTo(vs *VirtualService, destination Destination) bool {
+	for _, route := range vs.Spec.HTTP {
+		if len(route.Match) > 0 || vs.appendedReleaseID(route) != "" || vs.matchedReleaseID(route) != "" {
+			continue
+		}
+		found, others := false, false
+		for _, d := range route.Route {
+			if d.Destination.Host != destination.Host {
+				continue
+			}
+			if d.Destination.Subset == destination.Subset {
+				found = true
+			} else {
+				others = true
+			}
+		}
+		if found && !others {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedReleaseIDs(states map[string]releaseState) []string {
+	ids := make([]string, 0, len(states))
+	for id := range states {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func podEvents(old, current *v1.Pod) []models.WatchEvent {
+	pod := current
+	if pod == nil {
+		pod = old
+	}
+	release := pod.Labels[ReleaseLabel]
+	ready := isPodReady(current)
+	if release == "" || ready == isPodReady(old) {
+		return nil
+	}
+	event := models.WatchEvent{
+		Type:    EventPodNotReady,
+		Kind:    "Pod",
+		Name:    pod.Name,
+		Release: release,
+		App:     pod.Labels[AppLabel],
+		Version: pod.Labels[VersionLabel],
+	}
+	if ready {
+		event.Type = EventPodReady
+	}
+	return []models.WatchEvent{event}
+}
+
+func isPodReady(pod *v1.Pod) bool {
+	if pod == nil {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
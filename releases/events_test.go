@@ -0,0 +1,94 @@
+package releases
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/models"
+)
+
+func eventTypes(events []models.WatchEvent) []string {
+	types := []string{}
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestWatchEvents(t *testing.T) {
+	now := time.Now()
+	release := testRelease()
+	original := appVirtualService()
+	original.ResourceVersion = "1"
+
+	step := func(previous kubernetes.IstioObject, version string, change func(*VirtualService)) kubernetes.IstioObject {
+		vs := mustParse(t, previous)
+		change(vs)
+		vs.ResourceVersion = version
+		object, err := vs.IstioObject()
+		assert.NoError(t, err)
+		return object
+	}
+	created := step(original, "2", func(vs *VirtualService) { AddRelease(vs, release) })
+	weighted := step(created, "3", func(vs *VirtualService) { SetWeight(vs, release, 20) })
+	rolledBack := step(weighted, "4", func(vs *VirtualService) { RemoveReleaseRules(vs, release) })
+
+	events := WatchEvents(kubernetes.ObjectEvent{Old: original, New: created}, now)
+	assert.Equal(t, []string{EventObjectUpdated, EventReleaseCreated}, eventTypes(events))
+	assert.Equal(t, "release1", events[1].Release)
+	assert.Equal(t, now, events[1].Time)
+
+	events = WatchEvents(kubernetes.ObjectEvent{Old: created, New: weighted}, now)
+	assert.Equal(t, []string{EventObjectUpdated, EventWeightShifted}, eventTypes(events))
+	assert.Equal(t, "a", events[1].App)
+	assert.Equal(t, "v2", events[1].Version)
+	assert.Equal(t, 20, *events[1].Weight)
+
+	events = WatchEvents(kubernetes.ObjectEvent{Old: weighted, New: rolledBack}, now)
+	assert.Equal(t, []string{EventObjectUpdated, EventReleaseRolledBack}, eventTypes(events))
+
+	deleted := step(weighted, "6", func(vs *VirtualService) { DeleteReleaseRules(vs, release) })
+	events = WatchEvents(kubernetes.ObjectEvent{Old: weighted, New: deleted}, now)
+	assert.Equal(t, []string{EventObjectUpdated, EventReleaseDeleted}, eventTypes(events))
+
+	// the release created again and rolled back is no longer reported as deleted
+	recreated := step(deleted, "7", func(vs *VirtualService) { AddRelease(vs, release) })
+	rolledBackAgain := step(recreated, "8", func(vs *VirtualService) { RemoveReleaseRules(vs, release) })
+	assert.Equal(t, []string{EventObjectUpdated, EventReleaseRolledBack}, eventTypes(WatchEvents(kubernetes.ObjectEvent{Old: recreated, New: rolledBackAgain}, now)))
+
+	promoted := step(weighted, "5", func(vs *VirtualService) { PromoteVersions(vs, release) })
+	events = WatchEvents(kubernetes.ObjectEvent{Old: weighted, New: promoted}, now)
+	assert.Equal(t, []string{EventObjectUpdated, EventReleasePromoted}, eventTypes(events))
+
+	// relisted objects and objects canary doesn't manage give no event
+	assert.Empty(t, WatchEvents(kubernetes.ObjectEvent{Old: weighted, New: weighted}, now))
+	assert.Empty(t, WatchEvents(kubernetes.ObjectEvent{New: &kubernetes.VirtualService{}}, now))
+	assert.Equal(t, []string{EventObjectDeleted, EventReleaseRolledBack}, eventTypes(WatchEvents(kubernetes.ObjectEvent{Old: created}, now)))
+}
+
+func TestWatchPodEvents(t *testing.T) {
+	now := time.Now()
+	pod := func(ready v1.ConditionStatus) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "a-v2", Labels: map[string]string{ReleaseLabel: "release1", AppLabel: "a", VersionLabel: "v2"}},
+			Status:     v1.PodStatus{Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: ready}}},
+		}
+	}
+	assert.Empty(t, WatchEvents(kubernetes.ObjectEvent{New: pod(v1.ConditionFalse)}, now))
+
+	events := WatchEvents(kubernetes.ObjectEvent{Old: pod(v1.ConditionFalse), New: pod(v1.ConditionTrue)}, now)
+	assert.Equal(t, []models.WatchEvent{
+		{Type: EventPodReady, Time: now, Kind: "Pod", Name: "a-v2", Release: "release1", App: "a", Version: "v2"},
+	}, events)
+
+	assert.Equal(t, []string{EventPodNotReady}, eventTypes(WatchEvents(kubernetes.ObjectEvent{Old: pod(v1.ConditionTrue)}, now)))
+
+	unlabelled := pod(v1.ConditionTrue)
+	unlabelled.Labels = nil
+	assert.Empty(t, WatchEvents(kubernetes.ObjectEvent{New: unlabelled}, now))
+}
@@ -0,0 +1,337 @@
+package releases
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/log"
+	"github.com/devtio/canary/models"
+)
+
+// ExperimentConfigMap is the name of the config map holding the experiments of a namespace
+const ExperimentConfigMap = "canary-experiments"
+
+// MaxExperimentTTL is the longest an experiment can inject faults
+const MaxExperimentTTL = 24 * time.Hour
+
+// ExperimentStore persists the experiments of a namespace until they end
+type ExperimentStore interface {
+	// List returns the experiments of a namespace, sorted by id
+	List(namespace string) ([]models.Experiment, error)
+	// Get returns an experiment, or nil if there is no such experiment
+	Get(namespace string, experimentID string) (*models.Experiment, error)
+	// Put stores an experiment, replacing any previous version of it
+	Put(namespace string, experiment models.Experiment) error
+	// Delete removes an experiment, it doesn't fail if there is no such experiment
+	Delete(namespace string, experimentID string) error
+}
+
+// configMapExperimentStore keeps every experiment of a namespace as a JSON entry of the ExperimentConfigMap config map
+type configMapExperimentStore struct {
+	entries configMapEntries
+}
+
+// NewConfigMapExperimentStore returns an ExperimentStore backed by a config map per namespace
+func NewConfigMapExperimentStore(client kubernetes.IstioClientInterface) ExperimentStore {
+	return &configMapExperimentStore{entries: configMapEntries{client: client, name: ExperimentConfigMap, kind: "Experiment"}}
+}
+
+func (in *configMapExperimentStore) List(namespace string) ([]models.Experiment, error) {
+	experiments := []models.Experiment{}
+	err := in.entries.list(namespace, func(data []byte) error {
+		var experiment models.Experiment
+		if err := json.Unmarshal(data, &experiment); err != nil {
+			return err
+		}
+		experiments = append(experiments, experiment)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return experiments, nil
+}
+
+func (in *configMapExperimentStore) Get(namespace string, experimentID string) (*models.Experiment, error) {
+	var experiment models.Experiment
+	if found, err := in.entries.get(namespace, experimentID, &experiment); err != nil || !found {
+		return nil, err
+	}
+	return &experiment, nil
+}
+
+func (in *configMapExperimentStore) Put(namespace string, experiment models.Experiment) error {
+	return in.entries.put(namespace, experiment.ID, experiment)
+}
+
+func (in *configMapExperimentStore) Delete(namespace string, experimentID string) error {
+	return in.entries.delete(namespace, experimentID)
+}
+
+// ValidateExperiment checks that an experiment targets either a release or a traffic segment, injects well formed faults,
+// and ends within MaxExperimentTTL.
+// It returns the invalid fields, or an empty list if the experiment is valid.
+func ValidateExperiment(experiment models.Experiment) []models.FieldError {
+	fields := []models.FieldError{}
+	if experiment.ID == "" {
+		fields = append(fields, models.FieldError{Field: "id", Message: "is required"})
+	} else {
+		for _, message := range validation.IsDNS1123Label(experiment.ID) {
+			fields = append(fields, models.FieldError{Field: "id", Message: message})
+		}
+	}
+	if (experiment.Release == "") == (experiment.Segment == "") {
+		fields = append(fields, models.FieldError{Field: "release", Message: "an experiment targets either a release or a traffic segment"})
+	}
+	if experiment.Delay == nil && experiment.Abort == nil {
+		fields = append(fields, models.FieldError{Field: "delay", Message: "a delay or an abort is required"})
+	}
+	if delay := experiment.Delay; delay != nil {
+		fields = append(fields, validatePercent("delay.percent", delay.Percent)...)
+		if duration, err := time.ParseDuration(delay.FixedDelay); err != nil || duration <= 0 {
+			fields = append(fields, models.FieldError{Field: "delay.fixedDelay", Message: "must be a positive duration, e.g. 5s"})
+		}
+	}
+	if abort := experiment.Abort; abort != nil {
+		fields = append(fields, validatePercent("abort.percent", abort.Percent)...)
+		if abort.HTTPStatus < 200 || abort.HTTPStatus > 599 {
+			fields = append(fields, models.FieldError{Field: "abort.httpStatus", Message: "must be an HTTP status between 200 and 599"})
+		}
+	}
+	if ttl, err := time.ParseDuration(experiment.TTL); err != nil || ttl <= 0 || ttl > MaxExperimentTTL {
+		fields = append(fields, models.FieldError{Field: "ttl", Message: fmt.Sprintf("must be a positive duration of at most %s, e.g. 30m", MaxExperimentTTL)})
+	}
+	return fields
+}
+
+func validatePercent(field string, percent int) []models.FieldError {
+	if percent < 1 || percent > 100 {
+		return []models.FieldError{{Field: field, Message: "must be between 1 and 100"}}
+	}
+	return nil
+}
+
+// StartExperiment sets the start and the expiry of an experiment, TTL apart
+func StartExperiment(experiment *models.Experiment, now time.Time) {
+	ttl, _ := time.ParseDuration(experiment.TTL)
+	experiment.StartedAt = now
+	experiment.ExpiresAt = now.Add(ttl)
+}
+
+// ExpiredExperiments returns the experiments that are over
+func ExpiredExperiments(experiments []models.Experiment, now time.Time) []models.Experiment {
+	expired := []models.Experiment{}
+	for _, experiment := range experiments {
+		if !now.Before(experiment.ExpiresAt) {
+			expired = append(expired, experiment)
+		}
+	}
+	return expired
+}
+
+// ExperimentTargets returns the releases an experiment injects faults in, sorted by id:
+// the release it names, or the releases targeting the traffic segment it names.
+// Releases in shadow mode are left out, as they have no rule of their own.
+func ExperimentTargets(releases map[string]models.Release, experiment models.Experiment) []models.Release {
+	targets := []models.Release{}
+	for _, release := range releases {
+		if release.Mode == ModeShadow {
+			continue
+		}
+		if (experiment.Release != "" && release.ID == experiment.Release) || (experiment.Segment != "" && release.Segment == experiment.Segment) {
+			targets = append(targets, release)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].ID < targets[j].ID })
+	return targets
+}
+
+// ExperimentClusters returns the clusters of the releases an experiment injects faults in, without duplicates.
+// It returns an error if a cluster isn't configured or can't be reached.
+func ExperimentClusters(targets []models.Release, local kubernetes.IstioClientInterface) ([]Cluster, error) {
+	clusters := []Cluster{}
+	for _, release := range targets {
+		releaseClusters, err := ReleaseClusters(release, local)
+		if err != nil {
+			return nil, err
+		}
+		for _, cluster := range releaseClusters {
+			if !hasCluster(clusters, cluster.Name) {
+				clusters = append(clusters, cluster)
+			}
+		}
+	}
+	return clusters, nil
+}
+
+func hasCluster(clusters []Cluster, name string) bool {
+	for _, cluster := range clusters {
+		if cluster.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// FaultOf returns the fault injection of the rules an experiment changes
+func FaultOf(experiment models.Experiment) *HTTPFaultInjection {
+	fault := &HTTPFaultInjection{}
+	if delay := experiment.Delay; delay != nil {
+		fault.Delay = &FaultDelay{Percent: delay.Percent, FixedDelay: delay.FixedDelay}
+	}
+	if abort := experiment.Abort; abort != nil {
+		fault.Abort = &FaultAbort{Percent: abort.Percent, HTTPStatus: abort.HTTPStatus}
+	}
+	return fault
+}
+
+// AddFault injects the fault of an experiment in the rules of a release in the VirtualService.
+// Rules already injecting a fault are left alone, see FaultingExperiment.
+// It returns false if the VirtualService was left unchanged.
+func AddFault(vs *VirtualService, releaseID string, experimentID string, fault *HTTPFaultInjection) bool {
+	if !vs.IsManaged() {
+		return false
+	}
+	changed := false
+	for i, route := range vs.Spec.HTTP {
+		if !vs.isReleaseRoute(route, releaseID) || route.Fault != nil {
+			continue
+		}
+		injected := *fault
+		vs.Spec.HTTP[i].Fault = &injected
+		changed = true
+	}
+	if changed {
+		vs.setAnnotationEntries(ExperimentsAnnotation, releaseID, []string{experimentID})
+	}
+	return changed
+}
+
+// RemoveFaults removes the faults an experiment injected in the rules of releases in the VirtualService.
+// It returns false if the VirtualService was left unchanged.
+func RemoveFaults(vs *VirtualService, experimentID string) bool {
+	if !vs.IsManaged() {
+		return false
+	}
+	changed := false
+	for _, releaseID := range vs.faultedReleaseIDs(experimentID) {
+		for i, route := range vs.Spec.HTTP {
+			if vs.isReleaseRoute(route, releaseID) && route.Fault != nil {
+				vs.Spec.HTTP[i].Fault = nil
+				changed = true
+			}
+		}
+		vs.setAnnotationEntries(ExperimentsAnnotation, releaseID, nil)
+	}
+	return changed
+}
+
+// FaultingExperiment returns the experiment injecting faults in the rules of a release in the VirtualServices,
+// or an empty string
+func FaultingExperiment(virtualServices []*VirtualService, releaseID string) string {
+	for _, vs := range virtualServices {
+		for _, entry := range strings.Split(vs.Annotations[ExperimentsAnnotation], ",") {
+			if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 && parts[0] == releaseID {
+				return parts[1]
+			}
+		}
+	}
+	return ""
+}
+
+// ReleaseFault returns the experiment injecting faults in the rules of a release in the VirtualService with its fault,
+// so rules replaced while the experiment runs get it again with AddFault, or an empty string if there is none
+func ReleaseFault(vs *VirtualService, releaseID string) (string, *HTTPFaultInjection) {
+	experimentID := FaultingExperiment([]*VirtualService{vs}, releaseID)
+	if experimentID == "" {
+		return "", nil
+	}
+	for _, route := range vs.Spec.HTTP {
+		if vs.isReleaseRoute(route, releaseID) && route.Fault != nil {
+			return experimentID, route.Fault
+		}
+	}
+	return "", nil
+}
+
+// faultedReleaseIDs returns the releases an experiment injected faults in the rules of
+func (vs *VirtualService) faultedReleaseIDs(experimentID string) []string {
+	ids := []string{}
+	for _, entry := range strings.Split(vs.Annotations[ExperimentsAnnotation], ",") {
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 && parts[1] == experimentID {
+			ids = append(ids, parts[0])
+		}
+	}
+	return ids
+}
+
+// ApplyExperiment stores the experiment with the store of local, the client of the cluster canary runs in,
+// so its faults are removed once it expires, then injects them in the rules of its releases in the clusters of its releases.
+// It returns the changes of the VirtualServices, and an error on any problem, the clusters already changed are then restored
+// and the experiment removed from the store.
+func ApplyExperiment(local kubernetes.IstioClientInterface, clusters []Cluster, namespace string, experiment models.Experiment) ([]models.VirtualServiceChange, error) {
+	store := NewConfigMapExperimentStore(local)
+	if err := store.Put(namespace, experiment); err != nil {
+		return []models.VirtualServiceChange{}, err
+	}
+	fault := FaultOf(experiment)
+	_, changes, err := ApplyToClusters(clusters, namespace, func(cluster Cluster, vs *VirtualService) bool {
+		changed := false
+		for _, releaseID := range experiment.Releases {
+			changed = AddFault(vs, releaseID, experiment.ID, fault) || changed
+		}
+		return changed
+	})
+	if err != nil {
+		if deleteErr := store.Delete(namespace, experiment.ID); deleteErr != nil {
+			log.Errorf("Experiment %s/%s can't be removed after failing to inject its faults: %v", namespace, experiment.ID, deleteErr)
+		}
+		return changes, err
+	}
+	return changes, nil
+}
+
+// EndExperiment removes the faults of an experiment from the clusters of its releases and removes it from the store of local.
+// The releases removed since it started lost their faults with their rules.
+// It returns the changes of the VirtualServices, and an error on any problem.
+func EndExperiment(local kubernetes.IstioClientInterface, namespace string, experiment models.Experiment) ([]models.VirtualServiceChange, error) {
+	managed, err := GetManagedVirtualServices(local, namespace)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := NewConfigMapStore(local).List(namespace)
+	if err != nil {
+		return nil, err
+	}
+	current := WithStatus(Releases(managed), stored)
+	targets := []models.Release{}
+	for _, id := range experiment.Releases {
+		if release, ok := current[id]; ok {
+			targets = append(targets, release)
+		}
+	}
+	changes := []models.VirtualServiceChange{}
+	if len(targets) > 0 {
+		clusters, err := ExperimentClusters(targets, local)
+		if err != nil {
+			return nil, err
+		}
+		_, changes, err = ApplyToClusters(clusters, namespace, func(cluster Cluster, vs *VirtualService) bool {
+			return RemoveFaults(vs, experiment.ID)
+		})
+		if err != nil {
+			return changes, err
+		}
+	}
+	if err := NewConfigMapExperimentStore(local).Delete(namespace, experiment.ID); err != nil {
+		return changes, err
+	}
+	log.Infof("Experiment %s/%s ended, its faults were removed", namespace, experiment.ID)
+	return changes, nil
+}
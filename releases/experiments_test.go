@@ -0,0 +1,77 @@
+package releases
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/devtio/canary/models"
+)
+
+func TestValidateExperiment(t *testing.T) {
+	experiment := models.Experiment{
+		ID:      "slow-a",
+		Release: "release1",
+		Delay:   &models.DelayFault{Percent: 50, FixedDelay: "2s"},
+		TTL:     "30m",
+	}
+	assert.Empty(t, ValidateExperiment(experiment))
+
+	experiment.Segment = "beta-users"
+	experiment.Abort = &models.AbortFault{Percent: 0, HTTPStatus: 700}
+	experiment.TTL = "48h"
+	fields := []string{}
+	for _, field := range ValidateExperiment(experiment) {
+		fields = append(fields, field.Field)
+	}
+	assert.Equal(t, []string{"release", "abort.percent", "abort.httpStatus", "ttl"}, fields)
+}
+
+func TestExperimentTargets(t *testing.T) {
+	release, shadow, other := testRelease(), testRelease(), testRelease()
+	release.Segment = "beta-users"
+	shadow.ID, shadow.Mode, shadow.Segment = "shadow", ModeShadow, "beta-users"
+	other.ID = "other"
+	releases := map[string]models.Release{release.ID: release, shadow.ID: shadow, other.ID: other}
+
+	assert.Equal(t, []models.Release{release}, ExperimentTargets(releases, models.Experiment{Segment: "beta-users"}))
+	assert.Equal(t, []models.Release{other}, ExperimentTargets(releases, models.Experiment{Release: "other"}))
+	assert.Empty(t, ExperimentTargets(releases, models.Experiment{Release: "shadow"}))
+
+	now := time.Now()
+	experiment := models.Experiment{ID: "slow-a", TTL: "30m"}
+	StartExperiment(&experiment, now)
+	assert.Equal(t, now.Add(30*time.Minute), experiment.ExpiresAt)
+	assert.Empty(t, ExpiredExperiments([]models.Experiment{experiment}, now.Add(29*time.Minute)))
+	assert.Len(t, ExpiredExperiments([]models.Experiment{experiment}, now.Add(30*time.Minute)), 1)
+}
+
+func TestFaults(t *testing.T) {
+	app := mustParse(t, appVirtualService())
+	release := testRelease()
+	AddRelease(app, release)
+	experiment := models.Experiment{ID: "slow-a", Delay: &models.DelayFault{Percent: 50, FixedDelay: "2s"}, Abort: &models.AbortFault{Percent: 10, HTTPStatus: 503}}
+
+	assert.True(t, AddFault(app, release.ID, experiment.ID, FaultOf(experiment)))
+	rules := mustEncode(t, reparse(t, app))["http"].([]interface{})
+	assert.Equal(t, `{"abort":{"httpStatus":503,"percent":10},"delay":{"fixedDelay":"2s","percent":50}}`, mustJSON(t, rules[0].(map[string]interface{})["fault"]))
+	// the stable rule is left alone
+	assert.Nil(t, rules[1].(map[string]interface{})["fault"])
+	assert.Equal(t, "slow-a", FaultingExperiment([]*VirtualService{app}, release.ID))
+
+	// a rule injects a single fault
+	assert.False(t, AddFault(app, release.ID, "other", FaultOf(experiment)))
+	assert.False(t, RemoveFaults(app, "other"))
+
+	withRelease := mustParse(t, appVirtualService())
+	AddRelease(withRelease, release)
+	assert.True(t, RemoveFaults(app, experiment.ID))
+	assert.Equal(t, mustJSON(t, mustEncode(t, withRelease)), mustJSON(t, mustEncode(t, app)))
+	assert.Empty(t, FaultingExperiment([]*VirtualService{app}, release.ID))
+
+	// removing the release removes its faults
+	AddFault(app, release.ID, experiment.ID, FaultOf(experiment))
+	assert.True(t, RemoveRelease(app, release.ID))
+	assert.Empty(t, app.Annotations)
+}
@@ -0,0 +1,105 @@
+package releases
+
+import (
+	"encoding/json"
+	"time"
+
+	"k8s.io/client-go/util/retry"
+
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/models"
+)
+
+// HistoryConfigMap is the name of the config map holding the history of the releases of a namespace
+const HistoryConfigMap = "canary-release-history"
+
+// maxEvents is the number of events kept for a release, older ones are dropped
+const maxEvents = 100
+
+// Actions recorded in the history of a release
+const (
+	ActionCreated        = "Created"
+	ActionUpdated        = "Updated"
+	ActionDeleted        = "Deleted"
+	ActionRolledBack     = "RolledBack"
+	ActionAdvanced       = "Advanced"
+	ActionPaused         = "Paused"
+	ActionApproved       = "Approved"
+	ActionRejected       = "Rejected"
+	ActionPromoted       = "Promoted"
+	ActionSwitched       = "Switched"
+	ActionSwitchedBack   = "SwitchedBack"
+	ActionFaultsInjected = "FaultsInjected"
+	ActionFaultsRemoved  = "FaultsRemoved"
+	ActionDeployed       = "Deployed"
+)
+
+// Outcomes of the actions recorded in the history of a release
+const (
+	OutcomeSucceeded = "Succeeded"
+	OutcomeFailed    = "Failed"
+)
+
+// ControllerUser is the user of the actions canary takes on its own, like advancing a rollout
+const ControllerUser = "canary"
+
+// History records what happened to the releases of a namespace.
+// Unlike the Store, it keeps the releases once they are deleted or rolled back.
+type History interface {
+	// Record appends an event to the history of a release
+	Record(namespace string, releaseID string, event models.ReleaseEvent) error
+	// Events returns the history of a release, oldest event first, or an empty list if nothing was recorded
+	Events(namespace string, releaseID string) ([]models.ReleaseEvent, error)
+}
+
+// configMapHistory keeps the events of every release of a namespace as a JSON list entry of the HistoryConfigMap config map
+type configMapHistory struct {
+	entries configMapEntries
+}
+
+// NewConfigMapHistory returns a History backed by a config map per namespace
+func NewConfigMapHistory(client kubernetes.IstioClientInterface) History {
+	return &configMapHistory{entries: configMapEntries{client: client, name: HistoryConfigMap, kind: "History of release"}}
+}
+
+func (in *configMapHistory) Record(namespace string, releaseID string, event models.ReleaseEvent) error {
+	return retry.RetryOnConflict(ConflictBackoff, func() error {
+		events, err := in.Events(namespace, releaseID)
+		if err != nil {
+			return err
+		}
+		events = append(events, event)
+		if len(events) > maxEvents {
+			events = events[len(events)-maxEvents:]
+		}
+		data, err := json.Marshal(events)
+		if err != nil {
+			return err
+		}
+		return putConfigMapEntry(in.entries.client, namespace, HistoryConfigMap, releaseID, string(data))
+	})
+}
+
+func (in *configMapHistory) Events(namespace string, releaseID string) ([]models.ReleaseEvent, error) {
+	events := []models.ReleaseEvent{}
+	if _, err := in.entries.get(namespace, releaseID, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// NewEvent returns the event of an action on a release, with the VirtualService changes it applied and its error if it failed
+func NewEvent(action string, user string, changes []models.VirtualServiceChange, err error) models.ReleaseEvent {
+	event := models.ReleaseEvent{
+		Time:    time.Now(),
+		Action:  action,
+		User:    user,
+		Outcome: OutcomeSucceeded,
+		Changes: changes,
+	}
+	if err != nil {
+		event.Outcome = OutcomeFailed
+		event.Message = err.Error()
+	}
+	return event
+}
@@ -0,0 +1,252 @@
+package releases
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/devtio/canary/models"
+)
+
+// CookieHeader is the header Istio matches cookies on: a VirtualService can't match a cookie by name,
+// so a cookie match is encoded as a regular expression on the whole header
+const CookieHeader = "cookie"
+
+// ClaimHeaderPrefix prefixes the claims of the JWT authenticating a request, when matched as headers.
+// Istio only matches them on the VirtualServices bound to a gateway, once a RequestAuthentication validated the JWT.
+const ClaimHeaderPrefix = "@request.auth.claims."
+
+// cookieRegex matches the regular expressions cookieMatch encodes a cookie match to,
+// capturing the name of the cookie and the expression its value is matched with
+var cookieRegex = regexp.MustCompile(`^\^\(\.\*\?; \?\)\?([^=]+)=(.*)\(;\.\*\)\?\$$`)
+
+// IsEmptyMatch returns true if a match has no condition, and so matches every request
+func IsEmptyMatch(match models.HttpMatch) bool {
+	return len(match.Headers)+len(match.Cookies)+len(match.Claims)+len(match.QueryParams)+len(match.SourceLabels)+len(match.Gateways) == 0 &&
+		match.Bucket == nil && match.Uri == nil && match.Scheme == nil && match.Method == nil && match.Authority == nil && match.Port == 0
+}
+
+func toHttpMatch(match HTTPMatchRequest) *models.HttpMatch {
+	httpMatch := &models.HttpMatch{
+		Headers:      map[string]*models.StringMatch{},
+		Uri:          toStringMatch(match.URI),
+		Scheme:       toStringMatch(match.Scheme),
+		Method:       toStringMatch(match.Method),
+		Authority:    toStringMatch(match.Authority),
+		QueryParams:  toStringMatches(match.QueryParams),
+		SourceLabels: match.SourceLabels,
+		Port:         match.Port,
+		Gateways:     match.Gateways,
+	}
+	for name, header := range match.Headers {
+		if name == CookieHeader {
+			if cookie, value, ok := parseCookieMatch(header); ok {
+				httpMatch.Cookies = map[string]*models.StringMatch{cookie: value}
+				continue
+			}
+		}
+		if strings.HasPrefix(name, ClaimHeaderPrefix) {
+			if httpMatch.Claims == nil {
+				httpMatch.Claims = map[string]*models.StringMatch{}
+			}
+			httpMatch.Claims[strings.TrimPrefix(name, ClaimHeaderPrefix)] = toStringMatch(&header)
+			continue
+		}
+		if percent, ok := parseBucketMatch(header); ok {
+			httpMatch.Bucket = &models.HashBucket{Header: name, Percent: percent}
+			continue
+		}
+		httpMatch.Headers[name] = toStringMatch(&header)
+	}
+	if len(httpMatch.Headers) == 0 {
+		httpMatch.Headers = nil
+	}
+	return httpMatch
+}
+
+func fromHttpMatch(match models.HttpMatch) HTTPMatchRequest {
+	headers := fromStringMatches(match.Headers)
+	for name, cookie := range match.Cookies {
+		if cookie != nil {
+			headers[CookieHeader] = cookieMatch(name, *cookie)
+		}
+	}
+	for claim, value := range fromStringMatches(match.Claims) {
+		headers[ClaimHeaderPrefix+claim] = value
+	}
+	if match.Bucket != nil {
+		headers[match.Bucket.Header] = bucketMatch(match.Bucket.Percent)
+	}
+	request := HTTPMatchRequest{
+		Headers:      headers,
+		URI:          fromOptionalStringMatch(match.Uri),
+		Scheme:       fromOptionalStringMatch(match.Scheme),
+		Method:       fromOptionalStringMatch(match.Method),
+		Authority:    fromOptionalStringMatch(match.Authority),
+		QueryParams:  fromStringMatches(match.QueryParams),
+		SourceLabels: match.SourceLabels,
+		Port:         match.Port,
+		Gateways:     match.Gateways,
+	}
+	if len(request.QueryParams) == 0 {
+		request.QueryParams = nil
+	}
+	return request
+}
+
+// cookieMatch returns the match of the cookie header of the requests carrying the cookie with a matching value
+func cookieMatch(name string, value models.StringMatch) StringMatch {
+	var expression string
+	switch {
+	case value.Exact != "":
+		expression = regexp.QuoteMeta(value.Exact)
+	case value.Prefix != "":
+		expression = regexp.QuoteMeta(value.Prefix) + `[^;]*`
+	default:
+		expression = "(?:" + value.Regex + ")"
+	}
+	return StringMatch{Regex: `^(.*?; ?)?` + regexp.QuoteMeta(name) + "=" + expression + `(;.*)?$`}
+}
+
+// parseCookieMatch returns the cookie and the value matched by a cookie header match encoded by cookieMatch
+func parseCookieMatch(header StringMatch) (string, *models.StringMatch, bool) {
+	groups := cookieRegex.FindStringSubmatch(header.Regex)
+	if groups == nil {
+		return "", nil, false
+	}
+	name, ok := unquoteMeta(groups[1])
+	if !ok {
+		return "", nil, false
+	}
+	expression := groups[2]
+	if value, ok := unquoteMeta(expression); ok {
+		return name, &models.StringMatch{Exact: value}, true
+	}
+	if value, ok := unquoteMeta(strings.TrimSuffix(expression, `[^;]*`)); ok && strings.HasSuffix(expression, `[^;]*`) {
+		return name, &models.StringMatch{Prefix: value}, true
+	}
+	if strings.HasPrefix(expression, "(?:") && strings.HasSuffix(expression, ")") {
+		return name, &models.StringMatch{Regex: expression[3 : len(expression)-1]}, true
+	}
+	return "", nil, false
+}
+
+// bucketMatch returns the match of the header values ending with one of the lowest percent of the 256 pairs of hex digits,
+// so that the same values always match, and percent of uniformly distributed values match
+func bucketMatch(percent int) StringMatch {
+	buckets := (percent*256 + 50) / 100
+	high, low := buckets/16, buckets%16
+	alternatives := []string{}
+	if high > 0 {
+		alternatives = append(alternatives, hexClass(high)+hexClass(16))
+	}
+	if low > 0 {
+		alternatives = append(alternatives, hexDigit(high)+hexClass(low))
+	}
+	return StringMatch{Regex: "^.*(?:" + strings.Join(alternatives, "|") + ")$"}
+}
+
+// parseBucketMatch returns the percent of a header match encoded by bucketMatch
+func parseBucketMatch(header StringMatch) (int, bool) {
+	if !strings.HasPrefix(header.Regex, "^.*(?:") {
+		return 0, false
+	}
+	for percent := 1; percent <= 100; percent++ {
+		if bucketMatch(percent) == header {
+			return percent, true
+		}
+	}
+	return 0, false
+}
+
+// hexClass returns a character class matching the first count hex digits, in lower or upper case
+func hexClass(count int) string {
+	digits, letters := count, count-10
+	if digits > 10 {
+		digits = 10
+	}
+	class := hexRange('0', digits)
+	if letters > 0 {
+		class += hexRange('a', letters) + hexRange('A', letters)
+	}
+	return "[" + class + "]"
+}
+
+// hexDigit returns an expression matching the hex digit of value i, in lower or upper case
+func hexDigit(i int) string {
+	if i < 10 {
+		return string('0' + rune(i))
+	}
+	return "[" + string('a'+rune(i-10)) + string('A'+rune(i-10)) + "]"
+}
+
+func hexRange(first rune, count int) string {
+	if count == 1 {
+		return string(first)
+	}
+	return string(first) + "-" + string(first+rune(count-1))
+}
+
+// unquoteMeta reverses regexp.QuoteMeta, it returns false if the expression isn't a quoted literal
+func unquoteMeta(expression string) (string, bool) {
+	var literal strings.Builder
+	escaped := false
+	for _, c := range expression {
+		if !escaped && c == '\\' {
+			escaped = true
+			continue
+		}
+		escaped = false
+		literal.WriteRune(c)
+	}
+	value := literal.String()
+	return value, !escaped && regexp.QuoteMeta(value) == expression
+}
+
+func toStringMatch(match *StringMatch) *models.StringMatch {
+	if match == nil {
+		return nil
+	}
+	return &models.StringMatch{
+		Exact:  match.Exact,
+		Prefix: match.Prefix,
+		Regex:  match.Regex,
+	}
+}
+
+func toStringMatches(matches map[string]StringMatch) map[string]*models.StringMatch {
+	if len(matches) == 0 {
+		return nil
+	}
+	result := map[string]*models.StringMatch{}
+	for name, match := range matches {
+		result[name] = toStringMatch(&match)
+	}
+	return result
+}
+
+func fromStringMatch(match models.StringMatch) StringMatch {
+	return StringMatch{
+		Exact:  match.Exact,
+		Prefix: match.Prefix,
+		Regex:  match.Regex,
+	}
+}
+
+func fromOptionalStringMatch(match *models.StringMatch) *StringMatch {
+	if match == nil {
+		return nil
+	}
+	result := fromStringMatch(*match)
+	return &result
+}
+
+func fromStringMatches(matches map[string]*models.StringMatch) map[string]StringMatch {
+	result := map[string]StringMatch{}
+	for name, match := range matches {
+		if match == nil {
+			continue
+		}
+		result[name] = fromStringMatch(*match)
+	}
+	return result
+}
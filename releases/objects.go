@@ -0,0 +1,284 @@
+package releases
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/devtio/canary/kubernetes"
+)
+
+const (
+	// ManagedLabel marks the Istio objects canary reads releases from and writes releases to
+	ManagedLabel = "io.devtio.canary/managed"
+	// ReleaseHeader carries the release id of a request from the gateway to every service it reaches,
+	// unless the release declares another header
+	ReleaseHeader = "devtio"
+	// ReleaseHeadersAnnotation records the releases of a VirtualService that declare their own header, as release=header pairs
+	ReleaseHeadersAnnotation = "io.devtio.canary/release-headers"
+	// MirrorsAnnotation records the mirrors of the rules of a VirtualService set by shadow releases, as release=app/version pairs
+	MirrorsAnnotation = "io.devtio.canary/mirrors"
+	// ExperimentsAnnotation records the experiments that injected faults in the rules of releases, as release=experiment pairs
+	ExperimentsAnnotation = "io.devtio.canary/experiments"
+	// DeletedReleaseAnnotation records the last release deleted from a VirtualService, so watches tell it from a rollback
+	DeletedReleaseAnnotation = "io.devtio.canary/deleted-release"
+	// AppLabel and VersionLabel are the keys of models.App labels
+	AppLabel     = "app"
+	VersionLabel = "version"
+)
+
+// VirtualService is a VirtualService with a typed spec.
+// Use ParseVirtualService to read it from an IstioObject and IstioObject to write it back.
+type VirtualService struct {
+	meta_v1.ObjectMeta
+	Spec VirtualServiceSpec
+
+	raw map[string]interface{}
+	// rawAnnotations are the annotations as read from the cluster, canary replaces the map instead of modifying it
+	rawAnnotations map[string]string
+}
+
+// Gateway is a Gateway with a typed spec
+type Gateway struct {
+	meta_v1.ObjectMeta
+	Spec GatewaySpec
+}
+
+// DestinationRule is a DestinationRule with a typed spec
+type DestinationRule struct {
+	meta_v1.ObjectMeta
+	Spec DestinationRuleSpec
+}
+
+// ParseVirtualService reads the spec of a VirtualService into its typed form.
+// It returns an error if the spec doesn't follow the VirtualService schema.
+func ParseVirtualService(object kubernetes.IstioObject) (*VirtualService, error) {
+	vs := VirtualService{ObjectMeta: object.GetObjectMeta()}
+	raw, err := toJSONObject(object.GetSpec())
+	if err != nil {
+		return nil, specError("VirtualService", vs.ObjectMeta, err)
+	}
+	if err := fromJSONValue(raw, &vs.Spec); err != nil {
+		return nil, specError("VirtualService", vs.ObjectMeta, err)
+	}
+	vs.raw = raw
+	vs.rawAnnotations = vs.Annotations
+	return &vs, nil
+}
+
+// ParseGateway reads the spec of a Gateway into its typed form.
+// It returns an error if the spec doesn't follow the Gateway schema.
+func ParseGateway(object kubernetes.IstioObject) (*Gateway, error) {
+	gateway := Gateway{ObjectMeta: object.GetObjectMeta()}
+	if err := fromJSONValue(object.GetSpec(), &gateway.Spec); err != nil {
+		return nil, specError("Gateway", gateway.ObjectMeta, err)
+	}
+	return &gateway, nil
+}
+
+// ParseDestinationRule reads the spec of a DestinationRule into its typed form.
+// It returns an error if the spec doesn't follow the DestinationRule schema.
+func ParseDestinationRule(object kubernetes.IstioObject) (*DestinationRule, error) {
+	destinationRule := DestinationRule{ObjectMeta: object.GetObjectMeta()}
+	if err := fromJSONValue(object.GetSpec(), &destinationRule.Spec); err != nil {
+		return nil, specError("DestinationRule", destinationRule.ObjectMeta, err)
+	}
+	return &destinationRule, nil
+}
+
+// ManagedVirtualServices parses the VirtualServices managed by canary and skips the others.
+// It returns an error if any managed VirtualService can't be interpreted.
+func ManagedVirtualServices(objects []kubernetes.IstioObject) ([]*VirtualService, error) {
+	virtualServices := make([]*VirtualService, 0, len(objects))
+	for _, object := range objects {
+		if !IsManaged(object.GetObjectMeta()) {
+			continue
+		}
+		vs, err := ParseVirtualService(object)
+		if err != nil {
+			return nil, err
+		}
+		virtualServices = append(virtualServices, vs)
+	}
+	return virtualServices, nil
+}
+
+// ManagedGateways parses the Gateways managed by canary and skips the others.
+// It returns an error if any managed Gateway can't be interpreted.
+func ManagedGateways(objects []kubernetes.IstioObject) ([]*Gateway, error) {
+	gateways := make([]*Gateway, 0, len(objects))
+	for _, object := range objects {
+		if !IsManaged(object.GetObjectMeta()) {
+			continue
+		}
+		gateway, err := ParseGateway(object)
+		if err != nil {
+			return nil, err
+		}
+		gateways = append(gateways, gateway)
+	}
+	return gateways, nil
+}
+
+// IsManaged returns true if the object is labelled as managed by canary
+func IsManaged(meta meta_v1.ObjectMeta) bool {
+	managed, ok := meta.Labels[ManagedLabel]
+	return ok && managed != "false"
+}
+
+// IsManaged returns true if the VirtualService is labelled as managed by canary
+func (vs *VirtualService) IsManaged() bool {
+	return IsManaged(vs.ObjectMeta)
+}
+
+// IstioObject encodes the VirtualService back into an IstioObject.
+// Fields canary doesn't model, and rules it didn't modify, are written exactly as they were read.
+func (vs *VirtualService) IstioObject() (kubernetes.IstioObject, error) {
+	var orig VirtualServiceSpec
+	if err := fromJSONValue(vs.raw, &orig); err != nil {
+		return nil, specError("VirtualService", vs.ObjectMeta, err)
+	}
+	spec, err := merge(vs.raw, orig, vs.Spec)
+	if err != nil {
+		return nil, specError("VirtualService", vs.ObjectMeta, err)
+	}
+	return &kubernetes.VirtualService{
+		ObjectMeta: vs.ObjectMeta,
+		Spec:       spec,
+	}, nil
+}
+
+// httpRoute has the fields of HTTPRoute without its JSON methods
+type httpRoute HTTPRoute
+
+// UnmarshalJSON decodes a rule and keeps its original form, so it can be written back untouched
+func (r *HTTPRoute) UnmarshalJSON(data []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	var route httpRoute
+	if err := json.Unmarshal(data, &route); err != nil {
+		return err
+	}
+	*r = HTTPRoute(route)
+	r.raw = raw
+	return nil
+}
+
+// MarshalJSON encodes a rule on top of its original form, replacing only the fields that were modified
+func (r HTTPRoute) MarshalJSON() ([]byte, error) {
+	if r.raw == nil {
+		return json.Marshal(httpRoute(r))
+	}
+	var orig HTTPRoute
+	if err := fromJSONValue(r.raw, &orig); err != nil {
+		return nil, err
+	}
+	route, err := merge(r.raw, httpRoute(orig), httpRoute(r))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(route)
+}
+
+// merge returns a copy of raw where every field of current that differs from orig is replaced by its JSON value.
+// orig must be the decoded form of raw, and orig and current structs of the same type.
+func merge(raw map[string]interface{}, orig, current interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		out[k] = v
+	}
+	origValue, currentValue := reflect.ValueOf(orig), reflect.ValueOf(current)
+	for i := 0; i < currentValue.NumField(); i++ {
+		name := jsonName(currentValue.Type().Field(i))
+		if name == "" {
+			continue
+		}
+		field := currentValue.Field(i)
+		if reflect.DeepEqual(origValue.Field(i).Interface(), field.Interface()) {
+			continue
+		}
+		if isEmptyValue(field) {
+			delete(out, name)
+			continue
+		}
+		value, err := toJSONValue(field.Interface())
+		if err != nil {
+			return nil, err
+		}
+		out[name] = value
+	}
+	return out, nil
+}
+
+func jsonName(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// isEmptyValue follows the omitempty rules of encoding/json
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+func toJSONValue(in interface{}) (interface{}, error) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	err = json.Unmarshal(data, &out)
+	return out, err
+}
+
+func toJSONObject(in map[string]interface{}) (map[string]interface{}, error) {
+	if in == nil {
+		return map[string]interface{}{}, nil
+	}
+	data, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]interface{}
+	err = json.Unmarshal(data, &out)
+	return out, err
+}
+
+func fromJSONValue(in interface{}, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+func specError(kind string, meta meta_v1.ObjectMeta, err error) error {
+	return fmt.Errorf("%s %s/%s has a spec canary can't interpret: %v", kind, meta.Namespace, meta.Name, err)
+}
@@ -0,0 +1,158 @@
+package releases
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/log"
+	"github.com/devtio/canary/models"
+)
+
+// PhasePromoted is the phase of a release whose versions became the stable versions of its apps
+const PhasePromoted = "Promoted"
+
+// CanPromote returns an error if the release was rolled back or waits for its deployments,
+// or if steps of its rollout are still to be approved
+func CanPromote(release models.Release) error {
+	if IsDeploying(release) {
+		return fmt.Errorf("release %s waits for its deployments", release.ID)
+	}
+	if release.Rollout == nil || release.Status == nil {
+		return nil
+	}
+	if release.Status.Phase == PhaseRolledBack {
+		return fmt.Errorf("release %s was rolled back", release.ID)
+	}
+	for i := release.Status.Step + 1; i < len(release.Rollout.Steps); i++ {
+		if release.Rollout.Steps[i].Approval {
+			return fmt.Errorf("release %s rollout step %d requires an approval", release.ID, i)
+		}
+	}
+	return nil
+}
+
+// PromoteVersions makes the release's versions the stable versions of its apps in the VirtualService: the rules
+// without a match route the requests of the apps to the release's versions, with all of their traffic,
+// and the rules AddRelease added for the release are removed.
+// It returns the versions the rules without a match routed the apps to before, by app, and false if the VirtualService
+// was left unchanged.
+func PromoteVersions(vs *VirtualService, release models.Release) (map[string][]string, bool) {
+	replaced := map[string][]string{}
+	if !vs.IsManaged() {
+		return replaced, false
+	}
+	changed := RemoveRelease(vs, release.ID)
+	for _, app := range release.Apps {
+		name, version := app.Labels[AppLabel], app.Labels[VersionLabel]
+		if name == "" || version == "" {
+			continue
+		}
+		for i, route := range vs.Spec.HTTP {
+			// the rules of other releases without a match keep routing to their versions
+			if len(route.Match) > 0 || vs.appendedReleaseID(route) != "" || vs.matchedReleaseID(route) != "" {
+				continue
+			}
+			promoted, previous := promotedDestinations(route.Route, name, version)
+			if !reflect.DeepEqual(promoted, route.Route) {
+				vs.Spec.HTTP[i].Route = promoted
+				changed = true
+			}
+			for _, subset := range previous {
+				if !containsString(replaced[name], subset) {
+					replaced[name] = append(replaced[name], subset)
+				}
+			}
+		}
+	}
+	return replaced, changed
+}
+
+// promotedDestinations returns the destinations of a rule with the traffic of the app going to a single destination,
+// the release's version, and the other versions of the app the rule routed to
+func promotedDestinations(destinations []DestinationWeight, app, version string) ([]DestinationWeight, []string) {
+	promoted := []DestinationWeight{}
+	previous := []string{}
+	appIndex := -1
+	for _, destination := range destinations {
+		if destination.Destination.Host != app {
+			promoted = append(promoted, destination)
+			continue
+		}
+		if subset := destination.Destination.Subset; subset != "" && subset != version {
+			previous = append(previous, subset)
+		}
+		if appIndex == -1 {
+			appIndex = len(promoted)
+			destination.Destination.Subset = version
+			promoted = append(promoted, destination)
+			continue
+		}
+		// the app keeps the share of the traffic of all of its versions
+		if destination.Weight != nil && promoted[appIndex].Weight != nil {
+			weight := *promoted[appIndex].Weight + *destination.Weight
+			promoted[appIndex].Weight = &weight
+		}
+	}
+	if appIndex == -1 {
+		return destinations, previous
+	}
+	if len(promoted) == 1 {
+		promoted[0].Weight = nil
+	}
+	return promoted, previous
+}
+
+// PromoteChange returns the change promoting a release in the VirtualServices of its clusters, see PromoteVersions
+func PromoteChange(release models.Release) func(Cluster, *VirtualService) bool {
+	return func(cluster Cluster, vs *VirtualService) bool {
+		_, changed := PromoteVersions(vs, release)
+		return changed
+	}
+}
+
+// Promote applies PromoteChange to the clusters of the release, and removes the release from the store of local,
+// the client of the cluster canary runs in, as its versions are now the stable versions.
+// With removeSubsets, the DestinationRule subsets of the versions the apps routed to before, which no VirtualService
+// routes to anymore, are removed too.
+// It returns the outcome of the change, and an error on any problem, the clusters already changed are then restored.
+func Promote(local kubernetes.IstioClientInterface, clusters []Cluster, namespace string, release models.Release, removeSubsets bool) (models.ReleaseResult, error) {
+	// the versions replaced in each cluster, by app, and the VirtualServices as they were written, by name
+	replaced := map[string]map[string][]string{}
+	written := map[string]map[string]*VirtualService{}
+	statuses, changes, err := ApplyToClusters(clusters, namespace, func(cluster Cluster, vs *VirtualService) bool {
+		previous, changed := PromoteVersions(vs, release)
+		if replaced[cluster.Name] == nil {
+			replaced[cluster.Name] = map[string][]string{}
+			written[cluster.Name] = map[string]*VirtualService{}
+		}
+		written[cluster.Name][vs.Name] = vs
+		for app, versions := range previous {
+			for _, version := range versions {
+				if !containsString(replaced[cluster.Name][app], version) {
+					replaced[cluster.Name][app] = append(replaced[cluster.Name][app], version)
+				}
+			}
+		}
+		return changed
+	})
+	if err == nil && release.Status != nil {
+		status := *release.Status
+		status.Phase = PhasePromoted
+		status.NextStepAt = nil
+		release.Status = &status
+	}
+	result := NewReleaseResult(release, statuses, changes)
+	if err != nil {
+		return result, err
+	}
+	SetClusterStatuses(&result.Release, statuses)
+	if removeSubsets {
+		for _, cluster := range clusters {
+			if err := RemoveSubsets(cluster.Client, namespace, replaced[cluster.Name], written[cluster.Name]); err != nil {
+				log.Errorf("Replaced subsets of release %s/%s can't be removed from cluster %s: %v", namespace, release.ID, cluster.Name, err)
+			}
+		}
+	}
+	return result, NewConfigMapStore(local).Delete(namespace, release.ID)
+}
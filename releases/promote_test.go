@@ -0,0 +1,62 @@
+package releases
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/devtio/canary/models"
+)
+
+func TestPromoteVersions(t *testing.T) {
+	gateway, _ := ParseVirtualService(gatewayVirtualService())
+	app, _ := ParseVirtualService(appVirtualService())
+	release := testRelease()
+	AddRelease(gateway, release)
+	AddRelease(app, release)
+	SetWeight(app, release, 25)
+
+	other := testRelease()
+	other.ID = "release2"
+	other.Apps[0].Labels[VersionLabel] = "v3"
+	AddRelease(app, other)
+
+	replaced, changed := PromoteVersions(app, release)
+	assert.True(t, changed)
+	assert.Equal(t, map[string][]string{"a": {"v1"}}, replaced)
+	rules := mustEncode(t, reparse(t, app))["http"].([]interface{})
+	// the rules of the other release are kept, the default rule routes all of the traffic to the release's version
+	assert.Len(t, rules, 2)
+	assert.Equal(t, `[{"destination":{"host":"a","subset":"v2"}}]`, mustJSON(t, rules[1].(map[string]interface{})["route"]))
+	_, ok := Releases([]*VirtualService{app})["release2"]
+	assert.True(t, ok)
+	_, ok = Releases([]*VirtualService{app})["release1"]
+	assert.False(t, ok)
+
+	// the rules of the gateway all have a match, only the release's rules are removed
+	_, changed = PromoteVersions(gateway, release)
+	assert.True(t, changed)
+	assert.Equal(t, mustJSON(t, gatewayVirtualService().Spec), mustJSON(t, mustEncode(t, gateway)))
+
+	_, changed = PromoteVersions(app, release)
+	assert.False(t, changed)
+}
+
+func TestCanPromote(t *testing.T) {
+	release := testRelease()
+	assert.NoError(t, CanPromote(release))
+
+	release.Rollout = &models.RolloutPlan{Steps: []models.RolloutStep{{Weight: 5, Dwell: "1h"}, {Weight: 50, Dwell: "1h"}, {Weight: 100, Approval: true}}}
+	StartRollout(&release, time.Now())
+	assert.Error(t, CanPromote(release))
+	release.Rollout.Steps[2].Approval = false
+	assert.NoError(t, CanPromote(release))
+
+	release.Status.Phase = PhaseRolledBack
+	assert.Error(t, CanPromote(release))
+
+	release.Status.Phase = PhaseDeploying
+	assert.True(t, IsDeploying(release))
+	assert.Error(t, CanPromote(release))
+}
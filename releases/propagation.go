@@ -0,0 +1,112 @@
+package releases
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/devtio/canary/jaeger"
+	"github.com/devtio/canary/models"
+)
+
+// maxTraces is the number of traces of each app of a release CheckPropagation reads
+const maxTraces = 100
+
+// maxTraceIDs is the number of traces reported as examples of each dropped hop
+const maxTraceIDs = 5
+
+// CheckPropagation finds the recent traces of the requests of a release, and reports the hops where the header
+// carrying the release id was dropped: the calls to an app of the release that reached another version than the release's.
+// The requests of a release are told apart by reaching one of the release's versions, Envoy doesn't trace headers:
+// while a rollout sends a share of every request to the release's versions, some of the hops reported belong to other requests.
+// It returns an error on any problem.
+func CheckPropagation(finder jaeger.TraceFinder, namespace string, release models.Release, lookback time.Duration) (models.PropagationReport, error) {
+	report := models.PropagationReport{Release: release.ID, Header: ReleaseHeaderOf(release), Hops: []models.PropagationHop{}}
+	versions := map[string]string{}
+	for _, app := range release.Apps {
+		if name, version := app.Labels[AppLabel], app.Labels[VersionLabel]; name != "" && version != "" {
+			versions[name] = version
+		}
+	}
+
+	traces := map[string]jaeger.Trace{}
+	for name := range versions {
+		// Istio names the services of the traces after the app, or the app and its namespace
+		for _, service := range []string{name, name + "." + namespace} {
+			found, err := finder.Traces(service, lookback, maxTraces)
+			if err != nil {
+				return report, err
+			}
+			for _, trace := range found {
+				traces[trace.TraceID] = trace
+			}
+			if len(found) > 0 {
+				break
+			}
+		}
+	}
+
+	hops := map[outboundCall]*models.PropagationHop{}
+	for _, trace := range traces {
+		calls := []outboundCall{}
+		released := false
+		for _, span := range trace.Spans {
+			call, ok := parseOutboundCall(span, namespace)
+			if !ok || versions[call.app] == "" {
+				continue
+			}
+			call.from = trace.Processes[span.ProcessID].ServiceName
+			calls = append(calls, call)
+			released = released || call.subset == versions[call.app]
+		}
+		if !released {
+			continue
+		}
+		report.Traces++
+		for _, call := range calls {
+			if call.subset == versions[call.app] {
+				continue
+			}
+			hop, ok := hops[call]
+			if !ok {
+				hop = &models.PropagationHop{From: call.from, To: call.app, Subset: call.subset, Expected: versions[call.app], TraceIDs: []string{}}
+				hops[call] = hop
+			}
+			hop.Count++
+			if len(hop.TraceIDs) < maxTraceIDs && !containsString(hop.TraceIDs, trace.TraceID) {
+				hop.TraceIDs = append(hop.TraceIDs, trace.TraceID)
+			}
+		}
+	}
+	for _, hop := range hops {
+		report.Hops = append(report.Hops, *hop)
+	}
+	sort.Slice(report.Hops, func(i, j int) bool {
+		if report.Hops[i].Count != report.Hops[j].Count {
+			return report.Hops[i].Count > report.Hops[j].Count
+		}
+		return report.Hops[i].From+report.Hops[i].To < report.Hops[j].From+report.Hops[j].To
+	})
+	return report, nil
+}
+
+// outboundCall is a call traced by the sidecar of the caller
+type outboundCall struct {
+	from   string
+	app    string
+	subset string
+}
+
+// parseOutboundCall reads the app and subset a span called from the upstream cluster Envoy tags it with,
+// e.g. outbound|9080|v2|reviews.bookinfo.svc.cluster.local
+func parseOutboundCall(span jaeger.Span, namespace string) (outboundCall, bool) {
+	parts := strings.Split(span.Tag("upstream_cluster"), "|")
+	if len(parts) != 4 || parts[0] != "outbound" {
+		return outboundCall{}, false
+	}
+	app, appNamespace, ok := serviceOfHost(parts[3], namespace)
+	if !ok || appNamespace != namespace {
+		return outboundCall{}, false
+	}
+	return outboundCall{app: app, subset: parts[2]}, true
+}
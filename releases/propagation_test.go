@@ -0,0 +1,52 @@
+package releases
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/devtio/canary/jaeger"
+	"github.com/devtio/canary/models"
+)
+
+// fakeJaeger returns the traces of each service
+type fakeJaeger map[string][]jaeger.Trace
+
+func (in fakeJaeger) Traces(service string, lookback time.Duration, limit int) ([]jaeger.Trace, error) {
+	return in[service], nil
+}
+
+func call(process string, upstream string) jaeger.Span {
+	return jaeger.Span{ProcessID: process, Tags: []jaeger.KeyValue{{Key: "upstream_cluster", Value: upstream}}}
+}
+
+func TestCheckPropagation(t *testing.T) {
+	release := testRelease()
+	release.Header = "x-release"
+	release.Apps = append(release.Apps, models.App{Hosts: []string{"b"}, Labels: models.Labels{AppLabel: "b", VersionLabel: "v2"}})
+	processes := map[string]jaeger.Process{"gateway": {ServiceName: "istio-ingressgateway"}, "a": {ServiceName: "a"}}
+	finder := fakeJaeger{"a.dummy": {
+		// the release's request reached a v2 but not b v2
+		{TraceID: "1", Processes: processes, Spans: []jaeger.Span{
+			call("gateway", "outbound|8080|v2|a.dummy.svc.cluster.local"),
+			call("a", "outbound|8080|v1|b.dummy.svc.cluster.local"),
+		}},
+		// not a request of the release
+		{TraceID: "2", Processes: processes, Spans: []jaeger.Span{
+			call("gateway", "outbound|8080|v1|a.dummy.svc.cluster.local"),
+			call("a", "outbound|8080|v1|b.dummy.svc.cluster.local"),
+		}},
+	}}
+
+	report, err := CheckPropagation(finder, "dummy", release, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, models.PropagationReport{
+		Release: "release1",
+		Header:  "x-release",
+		Traces:  1,
+		Hops: []models.PropagationHop{
+			{From: "a", To: "b", Subset: "v1", Expected: "v2", Count: 1, TraceIDs: []string{"1"}},
+		},
+	}, report)
+}
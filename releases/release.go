@@ -0,0 +1,483 @@
+package releases
+
+import (
+	"strings"
+
+	"github.com/devtio/canary/models"
+)
+
+// A release has no object of its own, it is encoded in the VirtualServices managed by canary:
+//   - the VirtualService bound to the release's gateway hosts gets, per app, a rule that routes the
+//     release's match to the release's version and appends the release's header with the release id.
+//   - the VirtualService of each app gets a rule that routes requests carrying the release's header
+//     with the release id to the release's version.
+// The release's header is the ReleaseHeader, unless the release declares another one: the
+// ReleaseHeadersAnnotation of the VirtualServices then records it, so the rules can be read back.
+// A blue/green release matches the requests carrying its id on the gateway, until it is switched: the rules
+// routing to its apps then route to its versions, see SwitchVersions.
+// A release in shadow mode adds no rule: the rules of the gateway hosts and of each app that route to the app
+// mirror its requests to the release's version, and the MirrorsAnnotation records which mirrors are the release's.
+// The timeout and retries of an app of the release are set on both of its rules, its traffic policy on the subset
+// of its version, see AddSubsets.
+// This file is the only place that knows that encoding.
+
+// Modes of a release
+const (
+	ModeRouted = "routed"
+	ModeShadow = "shadow"
+)
+
+// StrategyBlueGreen is the strategy of a release switching all of the traffic of its apps at once
+const StrategyBlueGreen = "bluegreen"
+
+// Releases returns the releases encoded in the given VirtualServices, keyed by release id.
+// VirtualServices not managed by canary are ignored.
+func Releases(virtualServices []*VirtualService) map[string]models.Release {
+	releases := map[string]models.Release{}
+	for _, vs := range virtualServices {
+		if !vs.IsManaged() {
+			continue
+		}
+		for _, route := range vs.Spec.HTTP {
+			if id := vs.appendedReleaseID(route); id != "" {
+				release := newRelease(releases, id)
+				release.Mode = ModeRouted
+				release.Gateway.Hosts = vs.Spec.Hosts
+				if header := vs.releaseHeader(id); header != ReleaseHeader {
+					release.Header = header
+				}
+				if len(route.Match) > 0 {
+					if match := toHttpMatch(route.Match[0]); vs.isOwnHeaderMatch(*match, id) {
+						release.Strategy = StrategyBlueGreen
+					} else {
+						release.Match = match
+					}
+				}
+				releases[id] = release
+			} else if id := vs.matchedReleaseID(route); id != "" {
+				destination, ok := lastDestination(route)
+				if !ok {
+					continue
+				}
+				release := newRelease(releases, id)
+				release.Mode = ModeRouted
+				app := models.App{
+					Hosts: vs.Spec.Hosts,
+					Labels: models.Labels{
+						AppLabel:     destination.Host,
+						VersionLabel: destination.Subset,
+					},
+					Timeout: route.Timeout,
+				}
+				if route.Retries != nil {
+					app.Retries = &models.Retries{Attempts: route.Retries.Attempts, PerTryTimeout: route.Retries.PerTryTimeout}
+				}
+				release.Apps = append(release.Apps, app)
+				releases[id] = release
+			}
+			if id := vs.mirroredReleaseID(route); id != "" {
+				release := newRelease(releases, id)
+				release.Mode = ModeShadow
+				if route.MirrorPercent != nil {
+					release.MirrorPercent = *route.MirrorPercent
+				}
+				if len(vs.Spec.Gateways) > 0 {
+					release.Gateway.Hosts = vs.Spec.Hosts
+				}
+				app := models.App{
+					Hosts: vs.Spec.Hosts,
+					Labels: models.Labels{
+						AppLabel:     route.Mirror.Host,
+						VersionLabel: route.Mirror.Subset,
+					},
+				}
+				if containsString(vs.Spec.Hosts, route.Mirror.Host) && !hasApp(release.Apps, app) {
+					release.Apps = append(release.Apps, app)
+				}
+				releases[id] = release
+			}
+		}
+	}
+	return releases
+}
+
+// AddRelease adds to the VirtualService the rules that route the release's traffic to the release's versions.
+// Only apps the VirtualService already routes to are considered.
+// It returns false if the VirtualService was left unchanged.
+func AddRelease(vs *VirtualService, release models.Release) bool {
+	if !vs.IsManaged() {
+		return false
+	}
+	routed := map[string]bool{}
+	for _, route := range vs.Spec.HTTP {
+		for _, destination := range route.Route {
+			routed[destination.Destination.Host] = true
+		}
+	}
+	gatewayBound := len(vs.Spec.Gateways) > 0 && sameStringSlice(vs.Spec.Hosts, release.Gateway.Hosts)
+
+	versions := map[string]string{}
+	byName := map[string]models.App{}
+	apps := []string{}
+	for _, app := range release.Apps {
+		name, ok := app.Labels[AppLabel]
+		if !ok || !routed[name] {
+			continue
+		}
+		if _, seen := versions[name]; !seen {
+			apps = append(apps, name)
+		}
+		versions[name] = app.Labels[VersionLabel]
+		byName[name] = app
+	}
+
+	if release.Mode == ModeShadow {
+		return addMirrors(vs, release, apps, versions, gatewayBound)
+	}
+	if release.Strategy == StrategyBlueGreen {
+		// only the requests carrying the release id reach the release's versions until it is switched
+		release.Match = ownHeaderMatch(release)
+	}
+	changed := false
+	for _, app := range apps {
+		if gatewayBound || containsString(vs.Spec.Hosts, app) {
+			vs.setReleaseHeader(release.ID, ReleaseHeaderOf(release))
+		}
+		if gatewayBound {
+			vs.Spec.HTTP = insertRoute(vs.Spec.HTTP, gatewayRoute(release, byName[app]))
+			changed = true
+		}
+		if containsString(vs.Spec.Hosts, app) {
+			vs.Spec.HTTP = insertRoute(vs.Spec.HTTP, hostRoute(release, byName[app]))
+			changed = true
+		}
+	}
+	return changed
+}
+
+// RemoveRelease removes from the VirtualService the rules AddRelease added for the release.
+// Every other rule is left exactly as it was.
+// It returns false if the VirtualService was left unchanged.
+func RemoveRelease(vs *VirtualService, releaseID string) bool {
+	if !vs.IsManaged() || releaseID == "" {
+		return false
+	}
+	mirrored := false
+	routes := make([]HTTPRoute, 0, len(vs.Spec.HTTP))
+	for _, route := range vs.Spec.HTTP {
+		if vs.isReleaseRoute(route, releaseID) {
+			continue
+		}
+		if vs.mirroredReleaseID(route) == releaseID {
+			route.Mirror = nil
+			route.MirrorPercent = nil
+			mirrored = true
+		}
+		routes = append(routes, route)
+	}
+	if len(routes) == len(vs.Spec.HTTP) && !mirrored {
+		return false
+	}
+	vs.Spec.HTTP = routes
+	vs.setReleaseHeader(releaseID, "")
+	vs.setAnnotationEntries(MirrorsAnnotation, releaseID, nil)
+	vs.setAnnotationEntries(ExperimentsAnnotation, releaseID, nil)
+	return true
+}
+
+// addMirrors mirrors the requests the rules of the VirtualService route to the apps of a shadow release
+// to the release's versions. The rules of releases, and the rules already mirroring their requests, are left alone.
+func addMirrors(vs *VirtualService, release models.Release, apps []string, versions map[string]string, gatewayBound bool) bool {
+	mirrors := []string{}
+	for _, app := range apps {
+		if !gatewayBound && !containsString(vs.Spec.Hosts, app) {
+			continue
+		}
+		mirrored := false
+		for i, route := range vs.Spec.HTTP {
+			if route.Mirror != nil || vs.matchedReleaseID(route) != "" || vs.appendedReleaseID(route) != "" {
+				continue
+			}
+			for _, destination := range route.Route {
+				if destination.Destination.Host != app {
+					continue
+				}
+				// the mirror keeps the port of the stable version
+				mirror := destination.Destination
+				mirror.Subset = versions[app]
+				vs.Spec.HTTP[i].Mirror = &mirror
+				if release.MirrorPercent > 0 {
+					percent := release.MirrorPercent
+					vs.Spec.HTTP[i].MirrorPercent = &percent
+				}
+				mirrored = true
+				break
+			}
+		}
+		if mirrored {
+			mirrors = append(mirrors, app+"/"+versions[app])
+		}
+	}
+	if len(mirrors) == 0 {
+		return false
+	}
+	vs.setAnnotationEntries(MirrorsAnnotation, release.ID, mirrors)
+	return true
+}
+
+// isReleaseRoute returns true if the rule is one of the rules AddRelease adds for the release
+func (vs *VirtualService) isReleaseRoute(route HTTPRoute, releaseID string) bool {
+	return vs.appendedReleaseID(route) == releaseID || vs.matchedReleaseID(route) == releaseID
+}
+
+func gatewayRoute(release models.Release, app models.App) HTTPRoute {
+	route := HTTPRoute{
+		Route: []DestinationWeight{
+			{Destination: Destination{Host: app.Labels[AppLabel], Subset: app.Labels[VersionLabel]}},
+		},
+		AppendHeaders: map[string]string{
+			ReleaseHeaderOf(release): release.ID,
+		},
+	}
+	setRetries(&route, app)
+	if release.Match != nil {
+		route.Match = []HTTPMatchRequest{fromHttpMatch(*release.Match)}
+	}
+	return route
+}
+
+func hostRoute(release models.Release, app models.App) HTTPRoute {
+	route := HTTPRoute{
+		Match: []HTTPMatchRequest{
+			{Headers: map[string]StringMatch{ReleaseHeaderOf(release): {Exact: release.ID}}},
+		},
+		Route: []DestinationWeight{
+			{Destination: Destination{Host: app.Labels[AppLabel], Subset: app.Labels[VersionLabel]}},
+		},
+	}
+	setRetries(&route, app)
+	return route
+}
+
+// setRetries sets the timeout and the retries of the app's version on a rule of the release
+func setRetries(route *HTTPRoute, app models.App) {
+	route.Timeout = app.Timeout
+	if app.Retries != nil {
+		route.Retries = &HTTPRetry{Attempts: app.Retries.Attempts, PerTryTimeout: app.Retries.PerTryTimeout}
+	}
+}
+
+// insertRoute places a rule with a match before the first rule matching every request, as Istio would never
+// reach it otherwise. Rules without a match are appended.
+func insertRoute(routes []HTTPRoute, route HTTPRoute) []HTTPRoute {
+	if len(route.Match) > 0 {
+		for i, existing := range routes {
+			if matchesEveryRequest(existing) {
+				routes = append(routes, HTTPRoute{})
+				copy(routes[i+1:], routes[i:])
+				routes[i] = route
+				return routes
+			}
+		}
+	}
+	return append(routes, route)
+}
+
+// matchesEveryRequest returns true if a rule has no match, or a match whose only condition is an empty URI
+// or the "/" URI prefix, like the catch-all rules of gateway-bound VirtualServices
+func matchesEveryRequest(route HTTPRoute) bool {
+	if len(route.Match) == 0 {
+		return true
+	}
+	for _, match := range route.Match {
+		uri := StringMatch{}
+		if match.URI != nil {
+			uri = *match.URI
+		}
+		if len(match.Headers) == 0 && match.Scheme == nil && match.Method == nil && match.Authority == nil &&
+			len(match.QueryParams) == 0 && len(match.SourceLabels) == 0 && match.Port == 0 && len(match.Gateways) == 0 &&
+			(uri == StringMatch{} || uri == StringMatch{Prefix: "/"}) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchedReleaseID returns the release id a rule matches on with the release's header, or an empty string
+func (vs *VirtualService) matchedReleaseID(route HTTPRoute) string {
+	for _, match := range route.Match {
+		for name, header := range match.Headers {
+			if header.Exact != "" && vs.releaseHeader(header.Exact) == name {
+				return header.Exact
+			}
+		}
+	}
+	return ""
+}
+
+// appendedReleaseID returns the release id a rule appends with the release's header, or an empty string
+func (vs *VirtualService) appendedReleaseID(route HTTPRoute) string {
+	for name, id := range route.AppendHeaders {
+		if id != "" && vs.releaseHeader(id) == name {
+			return id
+		}
+	}
+	return ""
+}
+
+// ownHeaderMatch returns the match of the requests carrying the release id in the release's header
+func ownHeaderMatch(release models.Release) *models.HttpMatch {
+	return &models.HttpMatch{Headers: map[string]*models.StringMatch{ReleaseHeaderOf(release): {Exact: release.ID}}}
+}
+
+// isOwnHeaderMatch returns true if a match of a rule of the release only matches the release id in the release's header
+func (vs *VirtualService) isOwnHeaderMatch(match models.HttpMatch, releaseID string) bool {
+	header, ok := match.Headers[vs.releaseHeader(releaseID)]
+	if !ok || header.Exact != releaseID || len(match.Headers) != 1 {
+		return false
+	}
+	match.Headers = nil
+	return IsEmptyMatch(match)
+}
+
+// mirroredReleaseID returns the id of the shadow release a rule mirrors its requests for, or an empty string
+func (vs *VirtualService) mirroredReleaseID(route HTTPRoute) string {
+	if route.Mirror == nil {
+		return ""
+	}
+	mirror := route.Mirror.Host + "/" + route.Mirror.Subset
+	for _, entry := range strings.Split(vs.Annotations[MirrorsAnnotation], ",") {
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 && parts[1] == mirror {
+			return parts[0]
+		}
+	}
+	return ""
+}
+
+// mirrorOf returns the destination a rule routing to an app mirrors its requests to, other than the mirrors of a release,
+// or an empty string
+func (vs *VirtualService) mirrorOf(app string, releaseID string) string {
+	for _, route := range vs.Spec.HTTP {
+		if route.Mirror == nil || vs.mirroredReleaseID(route) == releaseID {
+			continue
+		}
+		for _, destination := range route.Route {
+			if destination.Destination.Host == app {
+				return route.Mirror.Host + "/" + route.Mirror.Subset
+			}
+		}
+	}
+	return ""
+}
+
+// ReleaseHeaderOf returns the header carrying the release id of the requests of a release
+func ReleaseHeaderOf(release models.Release) string {
+	if release.Header == "" {
+		return ReleaseHeader
+	}
+	return release.Header
+}
+
+// releaseHeader returns the header the rules of the VirtualService use for a release
+func (vs *VirtualService) releaseHeader(releaseID string) string {
+	for _, entry := range strings.Split(vs.Annotations[ReleaseHeadersAnnotation], ",") {
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 && parts[0] == releaseID {
+			return parts[1]
+		}
+	}
+	return ReleaseHeader
+}
+
+// setReleaseHeader records the header the rules of the VirtualService use for a release, an empty header removes it
+func (vs *VirtualService) setReleaseHeader(releaseID string, header string) {
+	if header == "" || header == ReleaseHeader {
+		vs.setAnnotationEntries(ReleaseHeadersAnnotation, releaseID, nil)
+		return
+	}
+	vs.setAnnotationEntries(ReleaseHeadersAnnotation, releaseID, []string{header})
+}
+
+// setAnnotationEntries replaces the release=value entries of a release in an annotation, no values remove them
+func (vs *VirtualService) setAnnotationEntries(annotation string, releaseID string, values []string) {
+	entries := []string{}
+	for _, entry := range strings.Split(vs.Annotations[annotation], ",") {
+		if entry != "" && !strings.HasPrefix(entry, releaseID+"=") {
+			entries = append(entries, entry)
+		}
+	}
+	for _, value := range values {
+		entries = append(entries, releaseID+"="+value)
+	}
+	vs.setAnnotation(annotation, strings.Join(entries, ","))
+}
+
+// setAnnotation sets an annotation of the VirtualService, an empty value removes it.
+// It returns false if the annotation was left unchanged.
+func (vs *VirtualService) setAnnotation(annotation string, value string) bool {
+	if value == vs.Annotations[annotation] {
+		return false
+	}
+	// the annotations may be shared with the object the VirtualService was read from
+	annotations := map[string]string{}
+	for key, value := range vs.Annotations {
+		annotations[key] = value
+	}
+	if value == "" {
+		delete(annotations, annotation)
+	} else {
+		annotations[annotation] = value
+	}
+	vs.Annotations = annotations
+	return true
+}
+
+func lastDestination(route HTTPRoute) (Destination, bool) {
+	if len(route.Route) == 0 {
+		return Destination{}, false
+	}
+	return route.Route[len(route.Route)-1].Destination, true
+}
+
+func hasApp(apps []models.App, app models.App) bool {
+	for _, a := range apps {
+		if a.Labels[AppLabel] == app.Labels[AppLabel] && a.Labels[VersionLabel] == app.Labels[VersionLabel] && sameStringSlice(a.Hosts, app.Hosts) {
+			return true
+		}
+	}
+	return false
+}
+
+func newRelease(releases map[string]models.Release, id string) models.Release {
+	release, ok := releases[id]
+	if !ok {
+		release = models.Release{ID: id, Name: id}
+	}
+	return release
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// sameStringSlice returns true if both slices hold the same strings, in any order
+func sameStringSlice(x, y []string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	diff := make(map[string]int, len(x))
+	for _, _x := range x {
+		diff[_x]++
+	}
+	for _, _y := range y {
+		if diff[_y] == 0 {
+			return false
+		}
+		diff[_y]--
+	}
+	return true
+}
@@ -0,0 +1,372 @@
+package releases
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/models"
+)
+
+func managedMeta(name string) meta_v1.ObjectMeta {
+	return meta_v1.ObjectMeta{
+		Name:      name,
+		Namespace: "dummy",
+		Labels:    map[string]string{ManagedLabel: "true"},
+	}
+}
+
+func gatewayVirtualService() *kubernetes.VirtualService {
+	return &kubernetes.VirtualService{
+		ObjectMeta: managedMeta("gateway"),
+		Spec: map[string]interface{}{
+			"hosts":    []interface{}{"dummy.example.com"},
+			"gateways": []interface{}{"dummy-gateway"},
+			"http": []interface{}{
+				map[string]interface{}{
+					"match": []interface{}{
+						map[string]interface{}{
+							"uri": map[string]interface{}{"prefix": "/"},
+						},
+					},
+					"route": []interface{}{
+						map[string]interface{}{
+							"destination": map[string]interface{}{
+								"host":   "a",
+								"subset": "v1",
+								"port":   map[string]interface{}{"number": 8080},
+							},
+						},
+					},
+					"websocketUpgrade": true,
+				},
+			},
+		},
+	}
+}
+
+func appVirtualService() *kubernetes.VirtualService {
+	return &kubernetes.VirtualService{
+		ObjectMeta: managedMeta("a"),
+		Spec: map[string]interface{}{
+			"hosts": []interface{}{"a"},
+			"http": []interface{}{
+				map[string]interface{}{
+					"route": []interface{}{
+						map[string]interface{}{
+							"destination": map[string]interface{}{"host": "a", "subset": "v1"},
+						},
+					},
+					"timeout": "3s",
+				},
+			},
+		},
+	}
+}
+
+func testRelease() models.Release {
+	return models.Release{
+		ID:      "release1",
+		Name:    "release1",
+		Gateway: models.Gateway{Hosts: []string{"dummy.example.com"}},
+		Apps: []models.App{
+			{Hosts: []string{"a"}, Labels: models.Labels{AppLabel: "a", VersionLabel: "v2"}},
+		},
+		Match: &models.HttpMatch{
+			Headers: map[string]*models.StringMatch{"x-client-id": {Exact: "fancy"}},
+		},
+	}
+}
+
+func TestParseVirtualServiceInvalidSpec(t *testing.T) {
+	vs := &kubernetes.VirtualService{
+		ObjectMeta: managedMeta("broken"),
+		Spec: map[string]interface{}{
+			"hosts": "a",
+		},
+	}
+	_, err := ParseVirtualService(vs)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "VirtualService dummy/broken")
+
+	_, err = ManagedVirtualServices([]kubernetes.IstioObject{vs})
+	assert.Error(t, err)
+
+	vs.ObjectMeta.Labels = nil
+	virtualServices, err := ManagedVirtualServices([]kubernetes.IstioObject{vs})
+	assert.NoError(t, err)
+	assert.Empty(t, virtualServices)
+}
+
+func TestUnmodifiedVirtualServiceIsUnchanged(t *testing.T) {
+	original := gatewayVirtualService()
+	vs, err := ParseVirtualService(original)
+	assert.NoError(t, err)
+
+	object, err := vs.IstioObject()
+	assert.NoError(t, err)
+	assert.Equal(t, mustJSON(t, original.Spec), mustJSON(t, object.GetSpec()))
+}
+
+func TestAddRelease(t *testing.T) {
+	gateway, err := ParseVirtualService(gatewayVirtualService())
+	assert.NoError(t, err)
+	app, err := ParseVirtualService(appVirtualService())
+	assert.NoError(t, err)
+
+	assert.True(t, AddRelease(gateway, testRelease()))
+	assert.True(t, AddRelease(app, testRelease()))
+
+	// the release rules go before the rules matching every request
+	gatewaySpec := mustEncode(t, gateway)
+	gatewayRules := gatewaySpec["http"].([]interface{})
+	assert.Len(t, gatewayRules, 2)
+	assert.Equal(t, map[string]interface{}{ReleaseHeader: "release1"}, gatewayRules[0].(map[string]interface{})["appendHeaders"])
+	assert.Equal(t, mustJSON(t, gatewayVirtualService().Spec["http"].([]interface{})[0]), mustJSON(t, gatewayRules[1]))
+
+	appSpec := mustEncode(t, app)
+	appRules := appSpec["http"].([]interface{})
+	assert.Len(t, appRules, 2)
+	assert.Equal(t, mustJSON(t, appVirtualService().Spec["http"].([]interface{})[0]), mustJSON(t, appRules[1]))
+
+	// an app the virtual service doesn't route to is ignored
+	other, err := ParseVirtualService(appVirtualService())
+	assert.NoError(t, err)
+	release := testRelease()
+	release.Apps[0].Labels[AppLabel] = "b"
+	assert.False(t, AddRelease(other, release))
+}
+
+func TestAppTimeoutAndRetries(t *testing.T) {
+	gateway, app := mustParse(t, gatewayVirtualService()), mustParse(t, appVirtualService())
+	release := testRelease()
+	release.Apps[0].Timeout = "1s"
+	release.Apps[0].Retries = &models.Retries{Attempts: 2, PerTryTimeout: "300ms"}
+	AddRelease(gateway, release)
+	AddRelease(app, release)
+
+	// both rules of the release carry them, the stable rule keeps its own timeout
+	gatewayRules := mustEncode(t, gateway)["http"].([]interface{})
+	assert.Equal(t, "1s", gatewayRules[0].(map[string]interface{})["timeout"])
+	appRules := mustEncode(t, app)["http"].([]interface{})
+	assert.Equal(t, map[string]interface{}{"attempts": 2.0, "perTryTimeout": "300ms"}, appRules[0].(map[string]interface{})["retries"])
+	assert.Equal(t, "3s", appRules[1].(map[string]interface{})["timeout"])
+
+	read := Releases([]*VirtualService{reparse(t, gateway), reparse(t, app)})["release1"]
+	assert.Equal(t, release.Apps, read.Apps)
+}
+
+func TestShadowRelease(t *testing.T) {
+	gateway, app := mustParse(t, gatewayVirtualService()), mustParse(t, appVirtualService())
+	release := testRelease()
+	release.Mode = ModeShadow
+	release.Match = nil
+	release.MirrorPercent = 20
+	assert.True(t, AddRelease(gateway, release))
+	assert.True(t, AddRelease(app, release))
+
+	// the stable rules serve the requests and mirror them to the release's version, on the same port
+	gatewayRules := mustEncode(t, gateway)["http"].([]interface{})
+	assert.Len(t, gatewayRules, 1)
+	assert.Equal(t, `{"host":"a","port":{"number":8080},"subset":"v2"}`, mustJSON(t, gatewayRules[0].(map[string]interface{})["mirror"]))
+	appRules := mustEncode(t, app)["http"].([]interface{})
+	assert.Len(t, appRules, 1)
+	assert.Equal(t, `{"host":"a","subset":"v2"}`, mustJSON(t, appRules[0].(map[string]interface{})["mirror"]))
+	assert.Equal(t, 20.0, appRules[0].(map[string]interface{})["mirrorPercent"])
+
+	releases := Releases([]*VirtualService{reparse(t, gateway), reparse(t, app)})
+	assert.Equal(t, release, releases["release1"])
+
+	// a rule mirrors to a single destination
+	other := testRelease()
+	other.ID = "release2"
+	other.Mode = ModeShadow
+	other.Match = nil
+	other.Apps[0].Labels[VersionLabel] = "v3"
+	assert.NotEmpty(t, validateMirrors([]*VirtualService{app}, other))
+	assert.Empty(t, validateMirrors([]*VirtualService{app}, release))
+	assert.False(t, AddRelease(app, other))
+
+	assert.True(t, RemoveRelease(gateway, release.ID))
+	assert.True(t, RemoveRelease(app, release.ID))
+	assert.Equal(t, mustJSON(t, gatewayVirtualService().Spec), mustJSON(t, mustEncode(t, gateway)))
+	assert.Equal(t, mustJSON(t, appVirtualService().Spec), mustJSON(t, mustEncode(t, app)))
+	assert.Empty(t, app.Annotations)
+}
+
+func TestReleaseHeader(t *testing.T) {
+	gateway, app := mustParse(t, gatewayVirtualService()), mustParse(t, appVirtualService())
+	release := testRelease()
+	release.Header = "x-release"
+	other := testRelease()
+	other.ID = "other"
+	for _, vs := range []*VirtualService{gateway, app} {
+		assert.True(t, AddRelease(vs, release))
+		assert.True(t, AddRelease(vs, other))
+	}
+	assert.Equal(t, map[string]string{ReleaseHeadersAnnotation: "release1=x-release"}, app.Annotations)
+	assert.Equal(t, map[string]interface{}{"x-release": "release1"}, mustEncode(t, gateway)["http"].([]interface{})[0].(map[string]interface{})["appendHeaders"])
+
+	releases := Releases([]*VirtualService{gateway, app})
+	assert.Equal(t, "x-release", releases["release1"].Header)
+	assert.Equal(t, release.Apps, releases["release1"].Apps)
+	assert.Equal(t, "", releases["other"].Header)
+	assert.Equal(t, other.Apps, releases["other"].Apps)
+
+	assert.True(t, RemoveRelease(app, release.ID))
+	assert.Empty(t, app.Annotations)
+	assert.Len(t, app.Spec.HTTP, 2)
+}
+
+func TestReleasesRoundTrip(t *testing.T) {
+	gateway, _ := ParseVirtualService(gatewayVirtualService())
+	app, _ := ParseVirtualService(appVirtualService())
+	AddRelease(gateway, testRelease())
+	AddRelease(app, testRelease())
+
+	gateway = reparse(t, gateway)
+	app = reparse(t, app)
+
+	releases := Releases([]*VirtualService{gateway, app})
+	assert.Len(t, releases, 1)
+	expected := testRelease()
+	expected.Mode = ModeRouted
+	assert.Equal(t, expected, releases["release1"])
+}
+
+func reparse(t *testing.T, vs *VirtualService) *VirtualService {
+	object, err := vs.IstioObject()
+	assert.NoError(t, err)
+	parsed, err := ParseVirtualService(object)
+	assert.NoError(t, err)
+	return parsed
+}
+
+func mustEncode(t *testing.T, vs *VirtualService) map[string]interface{} {
+	object, err := vs.IstioObject()
+	assert.NoError(t, err)
+	spec, err := toJSONObject(object.GetSpec())
+	assert.NoError(t, err)
+	return spec
+}
+
+func mustJSON(t *testing.T, in interface{}) string {
+	value, err := toJSONValue(in)
+	assert.NoError(t, err)
+	data, err := json.Marshal(value)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestRemoveRelease(t *testing.T) {
+	gateway, _ := ParseVirtualService(gatewayVirtualService())
+	app, _ := ParseVirtualService(appVirtualService())
+	AddRelease(gateway, testRelease())
+	AddRelease(app, testRelease())
+
+	other := testRelease()
+	other.ID = "release2"
+	AddRelease(app, other)
+
+	assert.True(t, RemoveRelease(gateway, "release1"))
+	assert.True(t, RemoveRelease(app, "release1"))
+	assert.False(t, RemoveRelease(app, "release1"))
+
+	// the rules that were there before the release are written back untouched
+	assert.Equal(t, mustJSON(t, gatewayVirtualService().Spec), mustJSON(t, mustEncode(t, gateway)))
+	appRules := mustEncode(t, app)["http"].([]interface{})
+	assert.Len(t, appRules, 2)
+	assert.Equal(t, mustJSON(t, appVirtualService().Spec["http"].([]interface{})[0]), mustJSON(t, appRules[1]))
+	_, ok := Releases([]*VirtualService{reparse(t, app)})["release2"]
+	assert.True(t, ok)
+}
+
+func TestSetWeight(t *testing.T) {
+	app, _ := ParseVirtualService(appVirtualService())
+	release := testRelease()
+	AddRelease(app, release)
+
+	assert.True(t, SetWeight(app, release, 25))
+	assert.False(t, SetWeight(app, release, 25))
+	rules := mustEncode(t, reparse(t, app))["http"].([]interface{})
+	assert.Equal(t,
+		`[{"destination":{"host":"a","subset":"v1"},"weight":75},{"destination":{"host":"a","subset":"v2"},"weight":25}]`,
+		mustJSON(t, rules[1].(map[string]interface{})["route"]))
+
+	assert.True(t, SetWeight(app, release, 100))
+	rules = mustEncode(t, app)["http"].([]interface{})
+	assert.Equal(t,
+		`[{"destination":{"host":"a","subset":"v1"},"weight":0},{"destination":{"host":"a","subset":"v2"},"weight":100}]`,
+		mustJSON(t, rules[1].(map[string]interface{})["route"]))
+
+	// back to 0 the rules are as they were before the rollout
+	assert.True(t, SetWeight(app, release, 0))
+	assert.True(t, RemoveRelease(app, release.ID))
+	assert.Equal(t, mustJSON(t, appVirtualService().Spec), mustJSON(t, mustEncode(t, app)))
+
+	// removing a release leaves a stable rule weighted on its own unchanged
+	original := appVirtualService()
+	stable := original.Spec["http"].([]interface{})[0].(map[string]interface{})
+	stable["route"].([]interface{})[0].(map[string]interface{})["weight"] = 100
+	weighted := mustParse(t, original)
+	assert.False(t, RemoveReleaseRules(weighted, release))
+	assert.Equal(t, mustJSON(t, original.Spec), mustJSON(t, mustEncode(t, weighted)))
+}
+
+func TestRolloutSteps(t *testing.T) {
+	release := testRelease()
+	release.Rollout = &models.RolloutPlan{Steps: []models.RolloutStep{
+		{Weight: 5, Dwell: "10m"},
+		{Weight: 100},
+	}}
+	assert.NoError(t, ValidateRollout(release.Rollout))
+	assert.Error(t, ValidateRollout(&models.RolloutPlan{Steps: []models.RolloutStep{{Weight: 50}, {Weight: 10}}}))
+	assert.Error(t, ValidateRollout(&models.RolloutPlan{Steps: []models.RolloutStep{{Weight: 5, Dwell: "soon"}}}))
+
+	start := time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC)
+	StartRollout(&release, start)
+	assert.Equal(t, PhaseProgressing, release.Status.Phase)
+	assert.Equal(t, 5, release.Status.Weight)
+	assert.Equal(t, start.Add(10*time.Minute), *release.Status.NextStepAt)
+
+	assert.False(t, NextStep(&release, start.Add(time.Minute)))
+	assert.True(t, NextStep(&release, start.Add(10*time.Minute)))
+	assert.Equal(t, PhaseCompleted, release.Status.Phase)
+	assert.Equal(t, 100, release.Status.Weight)
+	assert.False(t, NextStep(&release, start.Add(time.Hour)))
+}
+
+func TestDiff(t *testing.T) {
+	app, _ := ParseVirtualService(appVirtualService())
+	patch, err := app.Diff()
+	assert.NoError(t, err)
+	assert.Empty(t, patch)
+
+	AddRelease(app, testRelease())
+	SetWeight(app, testRelease(), 10)
+	patch, err = app.Diff()
+	assert.NoError(t, err)
+	assert.Equal(t,
+		`[{"op":"add","path":"/http/0","value":{"match":[{"headers":{"devtio":{"exact":"release1"}}}],"route":[{"destination":{"host":"a","subset":"v2"}}]}},`+
+			`{"op":"add","path":"/http/1/route/0/weight","value":90},`+
+			`{"op":"add","path":"/http/1/route/1","value":{"destination":{"host":"a","subset":"v2"},"weight":10}}]`,
+		mustJSON(t, patch))
+}
+
+func TestPreviewVirtualServices(t *testing.T) {
+	gateway, _ := ParseVirtualService(gatewayVirtualService())
+	app, _ := ParseVirtualService(appVirtualService())
+	previews, err := PreviewVirtualServices([]*VirtualService{gateway, app}, func(vs *VirtualService) bool {
+		return vs.Name == "a" && AddRelease(vs, testRelease())
+	})
+	assert.NoError(t, err)
+	assert.Len(t, previews, 1)
+	assert.Equal(t, "a", previews[0].Name)
+	assert.Equal(t, mustJSON(t, appVirtualService().Spec), mustJSON(t, previews[0].Current))
+	assert.Len(t, previews[0].Proposed["http"], 2)
+	assert.Equal(t, "add", previews[0].Patch[0].Op)
+}
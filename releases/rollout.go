@@ -0,0 +1,291 @@
+package releases
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/devtio/canary/models"
+)
+
+// Phases of a release going through its rollout plan
+const (
+	PhaseProgressing      = "Progressing"
+	PhaseAwaitingApproval = "AwaitingApproval"
+	PhaseCompleted        = "Completed"
+	PhaseRolledBack       = "RolledBack"
+)
+
+// ValidateRollout checks that the steps of a rollout plan have increasing weights between 0 and 100
+// and a valid dwell time.
+func ValidateRollout(plan *models.RolloutPlan) error {
+	if plan == nil {
+		return nil
+	}
+	if len(plan.Steps) == 0 {
+		return fmt.Errorf("rollout has no steps")
+	}
+	previous := 0
+	for i, step := range plan.Steps {
+		if step.Weight < 0 || step.Weight > 100 {
+			return fmt.Errorf("rollout step %d has a weight of %d, it must be between 0 and 100", i, step.Weight)
+		}
+		if step.Weight < previous {
+			return fmt.Errorf("rollout step %d has a weight of %d, lower than the weight of the previous step", i, step.Weight)
+		}
+		previous = step.Weight
+		if _, err := dwell(step); err != nil {
+			return fmt.Errorf("rollout step %d has an invalid dwell time: %v", i, err)
+		}
+		if step.Approval && i == 0 {
+			return fmt.Errorf("rollout step 0 can't require an approval, releases start on it")
+		}
+	}
+	return validateAnalysis(plan.Analysis)
+}
+
+// StartRollout puts the release on the first step of its rollout plan, or a blue/green release on standby until it is switched.
+// The plan must have been validated with ValidateRollout.
+func StartRollout(release *models.Release, now time.Time) {
+	if release.Strategy == StrategyBlueGreen {
+		release.Status = &models.ReleaseStatus{Phase: PhaseStandby}
+		return
+	}
+	if release.Rollout == nil {
+		return
+	}
+	setStep(release, 0, now)
+}
+
+// IsDue returns true if the dwell time of the current step of the release is over.
+func IsDue(release models.Release, now time.Time) bool {
+	status := release.Status
+	if release.Rollout == nil || status == nil || status.Phase != PhaseProgressing {
+		return false
+	}
+	return status.NextStepAt == nil || !now.Before(*status.NextStepAt)
+}
+
+// NextStep moves the release to the next step of its rollout plan once the dwell time of the current step is over.
+// It returns false if the release stays on its current step.
+func NextStep(release *models.Release, now time.Time) bool {
+	if !IsDue(*release, now) {
+		return false
+	}
+	setStep(release, release.Status.Step+1, now)
+	return true
+}
+
+// MoveToStep moves the release to a step of its rollout plan before the dwell time of its current step is over,
+// the step must be in the plan.
+func MoveToStep(release *models.Release, step int, now time.Time) {
+	setStep(release, step, now)
+}
+
+func setStep(release *models.Release, step int, now time.Time) {
+	steps := release.Rollout.Steps
+	status := &models.ReleaseStatus{
+		Phase:         PhaseProgressing,
+		Step:          step,
+		Weight:        steps[step].Weight,
+		StepStartedAt: &now,
+	}
+	if step == len(steps)-1 {
+		status.Phase = PhaseCompleted
+	} else {
+		d, _ := dwell(steps[step])
+		next := now.Add(d)
+		status.NextStepAt = &next
+	}
+	if release.Status != nil {
+		status.Verdicts = release.Status.Verdicts
+		status.Approvals = release.Status.Approvals
+		status.Clusters = release.Status.Clusters
+	}
+	release.Status = status
+}
+
+func dwell(step models.RolloutStep) (time.Duration, error) {
+	if step.Dwell == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(step.Dwell)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("%s is negative", step.Dwell)
+	}
+	return d, err
+}
+
+// ApplyWeight sends weight percent of the traffic of every app of the release to the release's version,
+// on every managed VirtualService of the namespace in every cluster of the release, and returns the outcome in every cluster
+// and the changes applied.
+// It returns an error on any problem, the clusters already changed are then restored.
+func ApplyWeight(clusters []Cluster, namespace string, release models.Release, weight int) ([]models.ClusterStatus, []models.VirtualServiceChange, error) {
+	return ApplyToClusters(clusters, namespace, func(cluster Cluster, vs *VirtualService) bool {
+		return SetWeight(vs, release, weight)
+	})
+}
+
+// Rollback removes the rules of the release and the share of the traffic its rollout sends to the release's versions
+// from every managed VirtualService of the namespace in every cluster of the release, and returns the outcome in every
+// cluster and the changes applied.
+// It returns an error on any problem, the clusters already changed are then restored.
+func Rollback(clusters []Cluster, namespace string, release models.Release) ([]models.ClusterStatus, []models.VirtualServiceChange, error) {
+	return ApplyToClusters(clusters, namespace, func(cluster Cluster, vs *VirtualService) bool {
+		return RemoveReleaseRules(vs, release)
+	})
+}
+
+// RemoveReleaseRules removes the rules of the release and the share of the traffic its rollout sends to the release's versions,
+// and switches a switched blue/green release back.
+// It returns false if the VirtualService was left unchanged.
+func RemoveReleaseRules(vs *VirtualService, release models.Release) bool {
+	removed := RemoveRelease(vs, release.ID)
+	unweighted := SetWeight(vs, release, 0)
+	switchedBack := release.Status != nil && SwitchBackVersions(vs, release, release.Status.PreviousVersions)
+	changed := removed || unweighted || switchedBack
+	if changed && vs.Annotations[DeletedReleaseAnnotation] == release.ID {
+		// a deleted release created again is rolled back this time
+		vs.setAnnotation(DeletedReleaseAnnotation, "")
+	}
+	return changed
+}
+
+// DeleteReleaseRules removes the rules of a deleted release like RemoveReleaseRules,
+// and records the deletion in the DeletedReleaseAnnotation so watches don't report it as a rollback.
+// It returns false if the VirtualService was left unchanged.
+func DeleteReleaseRules(vs *VirtualService, release models.Release) bool {
+	if !RemoveReleaseRules(vs, release) {
+		return false
+	}
+	vs.setAnnotation(DeletedReleaseAnnotation, release.ID)
+	return true
+}
+
+// BaselineVersions returns, for every app of the release, the version serving the requests that are not part of the release.
+// Apps with no such version are left out.
+func BaselineVersions(virtualServices []*VirtualService, release models.Release) map[string]string {
+	baselines := map[string]string{}
+	for _, app := range release.Apps {
+		name, version := app.Labels[AppLabel], app.Labels[VersionLabel]
+		for _, vs := range virtualServices {
+			for _, route := range vs.Spec.HTTP {
+				if _, ok := baselines[name]; ok || vs.matchedReleaseID(route) != "" || vs.appendedReleaseID(route) != "" {
+					continue
+				}
+				for _, destination := range route.Route {
+					if destination.Destination.Host == name && destination.Destination.Subset != "" && destination.Destination.Subset != version {
+						baselines[name] = destination.Destination.Subset
+						break
+					}
+				}
+			}
+		}
+	}
+	return baselines
+}
+
+// SetWeight splits the rules routing every request of an app to a single stable version,
+// so that weight percent of them go to the release's version of the app instead.
+// A weight of 0 removes the release's version from the rules and leaves them as they were before the rollout.
+// Rules routing to several apps or versions are not modified.
+// It returns false if the VirtualService was left unchanged.
+func SetWeight(vs *VirtualService, release models.Release, weight int) bool {
+	if !vs.IsManaged() {
+		return false
+	}
+	changed := false
+	for _, app := range release.Apps {
+		name, version := app.Labels[AppLabel], app.Labels[VersionLabel]
+		if name == "" || version == "" {
+			continue
+		}
+		for i, route := range vs.Spec.HTTP {
+			if vs.isReleaseRoute(route, release.ID) {
+				continue
+			}
+			weighted, ok := weightedDestinations(route.Route, name, version, weight)
+			if ok && !reflect.DeepEqual(weighted, route.Route) {
+				vs.Spec.HTTP[i].Route = weighted
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// weightedDestinations returns the destinations of a rule with weight percent going to the release's version.
+// It returns false if the rule doesn't route to a single stable version of the app, or if a weight of 0 leaves
+// a rule without a destination of the release's version as it is.
+func weightedDestinations(destinations []DestinationWeight, app, version string, weight int) ([]DestinationWeight, bool) {
+	stable, canary := -1, -1
+	for i, destination := range destinations {
+		switch {
+		case destination.Destination.Host != app:
+			return nil, false
+		case destination.Destination.Subset == version:
+			canary = i
+		case stable != -1:
+			return nil, false
+		default:
+			stable = i
+		}
+	}
+	if stable == -1 {
+		return nil, false
+	}
+
+	stableDestination := destinations[stable]
+	if weight <= 0 && canary == -1 {
+		// the release never shifted traffic with this rule, a weight set on its own is kept
+		return nil, false
+	}
+	if weight <= 0 {
+		stableDestination.Weight = nil
+		return []DestinationWeight{stableDestination}, true
+	}
+	if weight > 100 {
+		weight = 100
+	}
+	stableWeight := 100 - weight
+	stableDestination.Weight = &stableWeight
+	canaryDestination := DestinationWeight{Destination: stableDestination.Destination}
+	if canary != -1 {
+		canaryDestination = destinations[canary]
+	}
+	canaryDestination.Destination.Subset = version
+	canaryDestination.Weight = &weight
+	return []DestinationWeight{stableDestination, canaryDestination}, true
+}
+
+// WithStatus completes the releases read from the VirtualServices with the traffic segment, clusters, rollout plan and progress,
+// Deployments and the traffic policies of the apps stored for them.
+// Stored releases that have no rule left in the VirtualServices are returned as they were stored.
+func WithStatus(releases map[string]models.Release, stored []models.Release) map[string]models.Release {
+	for _, s := range stored {
+		release, ok := releases[s.ID]
+		if !ok {
+			if s.Mode == "" {
+				s.Mode = ModeRouted
+			}
+			releases[s.ID] = s
+			continue
+		}
+		release.Segment = s.Segment
+		release.Clusters = s.Clusters
+		release.Strategy = s.Strategy
+		release.SmokeChecks = s.SmokeChecks
+		release.Deployments = s.Deployments
+		for i, app := range release.Apps {
+			for _, storedApp := range s.Apps {
+				if app.Labels[AppLabel] == storedApp.Labels[AppLabel] && app.Labels[VersionLabel] == storedApp.Labels[VersionLabel] {
+					release.Apps[i].TrafficPolicy = storedApp.TrafficPolicy
+				}
+			}
+		}
+		release.Rollout = s.Rollout
+		release.Status = s.Status
+		releases[s.ID] = release
+	}
+	return releases
+}
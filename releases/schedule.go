@@ -0,0 +1,260 @@
+package releases
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/models"
+)
+
+// ScheduleConfigMap is the name of the config map holding the scheduled actions of a namespace
+const ScheduleConfigMap = "canary-scheduled-actions"
+
+// WindowConfigMap is the name of the config map holding the maintenance windows of a namespace
+const WindowConfigMap = "canary-maintenance-windows"
+
+// Actions that can be scheduled on a release
+const (
+	ScheduleStart   = "start"
+	ScheduleAdvance = "advance"
+	SchedulePromote = "promote"
+)
+
+// Repetitions of a maintenance window
+const (
+	RepeatDaily  = "daily"
+	RepeatWeekly = "weekly"
+)
+
+var repeatPeriods = map[string]time.Duration{
+	RepeatDaily:  24 * time.Hour,
+	RepeatWeekly: 7 * 24 * time.Hour,
+}
+
+// ScheduleStore persists the actions scheduled on the releases of a namespace until they are run
+type ScheduleStore interface {
+	// List returns the scheduled actions of a namespace, earliest first
+	List(namespace string) ([]models.ScheduledAction, error)
+	// Get returns a scheduled action, or nil if there is no such action
+	Get(namespace string, actionID string) (*models.ScheduledAction, error)
+	// Put stores a scheduled action, replacing any previous version of it
+	Put(namespace string, action models.ScheduledAction) error
+	// Delete removes a scheduled action, it doesn't fail if there is no such action
+	Delete(namespace string, actionID string) error
+}
+
+// configMapScheduleStore keeps every scheduled action of a namespace as a JSON entry of the ScheduleConfigMap config map
+type configMapScheduleStore struct {
+	entries configMapEntries
+}
+
+// NewConfigMapScheduleStore returns a ScheduleStore backed by a config map per namespace
+func NewConfigMapScheduleStore(client kubernetes.IstioClientInterface) ScheduleStore {
+	return &configMapScheduleStore{entries: configMapEntries{client: client, name: ScheduleConfigMap, kind: "Scheduled action"}}
+}
+
+func (in *configMapScheduleStore) List(namespace string) ([]models.ScheduledAction, error) {
+	actions := []models.ScheduledAction{}
+	err := in.entries.list(namespace, func(data []byte) error {
+		var action models.ScheduledAction
+		if err := json.Unmarshal(data, &action); err != nil {
+			return err
+		}
+		actions = append(actions, action)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(actions, func(i, j int) bool { return actions[i].At.Before(actions[j].At) })
+	return actions, nil
+}
+
+func (in *configMapScheduleStore) Get(namespace string, actionID string) (*models.ScheduledAction, error) {
+	var action models.ScheduledAction
+	if found, err := in.entries.get(namespace, actionID, &action); err != nil || !found {
+		return nil, err
+	}
+	return &action, nil
+}
+
+func (in *configMapScheduleStore) Put(namespace string, action models.ScheduledAction) error {
+	return in.entries.put(namespace, action.ID, action)
+}
+
+func (in *configMapScheduleStore) Delete(namespace string, actionID string) error {
+	return in.entries.delete(namespace, actionID)
+}
+
+// WindowStore persists the maintenance windows of a namespace
+type WindowStore interface {
+	// List returns the maintenance windows of a namespace, sorted by id
+	List(namespace string) ([]models.MaintenanceWindow, error)
+	// Get returns a maintenance window, or nil if there is no such window
+	Get(namespace string, windowID string) (*models.MaintenanceWindow, error)
+	// Put stores a maintenance window, replacing any previous version of it
+	Put(namespace string, window models.MaintenanceWindow) error
+	// Delete removes a maintenance window, it doesn't fail if there is no such window
+	Delete(namespace string, windowID string) error
+}
+
+// configMapWindowStore keeps every maintenance window of a namespace as a JSON entry of the WindowConfigMap config map
+type configMapWindowStore struct {
+	entries configMapEntries
+}
+
+// NewConfigMapWindowStore returns a WindowStore backed by a config map per namespace
+func NewConfigMapWindowStore(client kubernetes.IstioClientInterface) WindowStore {
+	return &configMapWindowStore{entries: configMapEntries{client: client, name: WindowConfigMap, kind: "Maintenance window"}}
+}
+
+func (in *configMapWindowStore) List(namespace string) ([]models.MaintenanceWindow, error) {
+	windows := []models.MaintenanceWindow{}
+	err := in.entries.list(namespace, func(data []byte) error {
+		var window models.MaintenanceWindow
+		if err := json.Unmarshal(data, &window); err != nil {
+			return err
+		}
+		windows = append(windows, window)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return windows, nil
+}
+
+func (in *configMapWindowStore) Get(namespace string, windowID string) (*models.MaintenanceWindow, error) {
+	var window models.MaintenanceWindow
+	if found, err := in.entries.get(namespace, windowID, &window); err != nil || !found {
+		return nil, err
+	}
+	return &window, nil
+}
+
+func (in *configMapWindowStore) Put(namespace string, window models.MaintenanceWindow) error {
+	return in.entries.put(namespace, window.ID, window)
+}
+
+func (in *configMapWindowStore) Delete(namespace string, windowID string) error {
+	return in.entries.delete(namespace, windowID)
+}
+
+// ScheduledActionID returns the id of a scheduled action, a release can only have one action of a kind at a given time
+func ScheduledActionID(action models.ScheduledAction) string {
+	return fmt.Sprintf("%s-%s-%d", action.ReleaseID, action.Action, action.At.Unix())
+}
+
+// ValidateScheduledAction checks that a scheduled action is complete and well formed,
+// and that the release it starts is valid, see ValidateRelease.
+// It returns the invalid fields, or an empty list if the action is valid.
+func ValidateScheduledAction(action models.ScheduledAction) []models.FieldError {
+	fields := []models.FieldError{}
+	switch action.Action {
+	case ScheduleStart:
+		if action.Release == nil {
+			fields = append(fields, models.FieldError{Field: "release", Message: "is required to start a release"})
+		} else {
+			if action.Release.ID != action.ReleaseID {
+				fields = append(fields, models.FieldError{Field: "release.id", Message: fmt.Sprintf("must be the release id %s", action.ReleaseID)})
+			}
+			for _, field := range ValidateRelease(*action.Release) {
+				field.Field = "release." + field.Field
+				fields = append(fields, field)
+			}
+		}
+	case ScheduleAdvance, SchedulePromote:
+		if action.Release != nil {
+			fields = append(fields, models.FieldError{Field: "release", Message: "is only allowed to start a release"})
+		}
+	default:
+		fields = append(fields, models.FieldError{Field: "action", Message: fmt.Sprintf("must be %s, %s or %s", ScheduleStart, ScheduleAdvance, SchedulePromote)})
+	}
+	if action.ReleaseID == "" {
+		fields = append(fields, models.FieldError{Field: "releaseId", Message: "is required"})
+	}
+	if action.At.IsZero() {
+		fields = append(fields, models.FieldError{Field: "at", Message: "is required"})
+	}
+	return fields
+}
+
+// ValidateMaintenanceWindow checks that a maintenance window ends after it starts, and before it starts again if it is repeated.
+// It returns the invalid fields, or an empty list if the window is valid.
+func ValidateMaintenanceWindow(window models.MaintenanceWindow) []models.FieldError {
+	fields := []models.FieldError{}
+	if window.ID == "" {
+		fields = append(fields, models.FieldError{Field: "id", Message: "is required"})
+	} else {
+		for _, message := range validation.IsDNS1123Label(window.ID) {
+			fields = append(fields, models.FieldError{Field: "id", Message: message})
+		}
+	}
+	if window.Start.IsZero() {
+		fields = append(fields, models.FieldError{Field: "start", Message: "is required"})
+	}
+	if !window.End.After(window.Start) {
+		fields = append(fields, models.FieldError{Field: "end", Message: "must be after start"})
+	}
+	if window.Repeat != "" {
+		period, ok := repeatPeriods[window.Repeat]
+		if !ok {
+			fields = append(fields, models.FieldError{Field: "repeat", Message: fmt.Sprintf("must be %s or %s", RepeatDaily, RepeatWeekly)})
+		} else if window.End.Sub(window.Start) >= period {
+			fields = append(fields, models.FieldError{Field: "end", Message: fmt.Sprintf("must be less than a %s repeat after start", window.Repeat)})
+		}
+	}
+	return fields
+}
+
+// ActiveWindow returns the maintenance window in effect at a given time, and when it ends,
+// or nil if changes are allowed.
+func ActiveWindow(windows []models.MaintenanceWindow, now time.Time) (*models.MaintenanceWindow, time.Time) {
+	for i, window := range windows {
+		start, end := window.Start, window.End
+		if period, ok := repeatPeriods[window.Repeat]; ok && now.After(start) {
+			// move the window to its latest occurrence
+			occurrences := now.Sub(start) / period
+			start, end = start.Add(occurrences*period), end.Add(occurrences*period)
+		}
+		if !now.Before(start) && now.Before(end) {
+			return &windows[i], end
+		}
+	}
+	return nil, time.Time{}
+}
+
+// DueActions returns the scheduled actions whose time has come, earliest first
+func DueActions(actions []models.ScheduledAction, now time.Time) []models.ScheduledAction {
+	due := []models.ScheduledAction{}
+	for _, action := range actions {
+		if !now.Before(action.At) {
+			due = append(due, action)
+		}
+	}
+	return due
+}
+
+// ScheduledStep returns the step of its rollout a scheduled advance moves the release to.
+// It returns an error if the release has no rollout in progress, or if the next step requires an approval.
+func ScheduledStep(release models.Release) (int, error) {
+	if release.Rollout == nil || release.Status == nil {
+		return 0, fmt.Errorf("release %s has no rollout plan", release.ID)
+	}
+	if release.Status.Phase != PhaseProgressing {
+		return 0, fmt.Errorf("release %s rollout is %s", release.ID, release.Status.Phase)
+	}
+	step := release.Status.Step + 1
+	if step >= len(release.Rollout.Steps) {
+		return 0, fmt.Errorf("release %s rollout is on its last step", release.ID)
+	}
+	if release.Rollout.Steps[step].Approval {
+		return 0, fmt.Errorf("release %s rollout step %d requires an approval", release.ID, step)
+	}
+	return step, nil
+}
@@ -0,0 +1,72 @@
+package releases
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/devtio/canary/models"
+)
+
+func TestActiveWindow(t *testing.T) {
+	start := time.Date(2018, 7, 7, 22, 0, 0, 0, time.UTC) // a Saturday
+	windows := []models.MaintenanceWindow{
+		{ID: "freeze", Start: time.Date(2018, 12, 20, 0, 0, 0, 0, time.UTC), End: time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{ID: "weekend", Start: start, End: start.Add(26 * time.Hour), Repeat: RepeatWeekly},
+	}
+
+	window, _ := ActiveWindow(windows, start.Add(-time.Minute))
+	assert.Nil(t, window)
+	window, end := ActiveWindow(windows, start.Add(3*7*24*time.Hour+time.Hour))
+	assert.Equal(t, "weekend", window.ID)
+	assert.Equal(t, start.Add(3*7*24*time.Hour+26*time.Hour), end)
+	window, _ = ActiveWindow(windows, start.Add(3*7*24*time.Hour+26*time.Hour))
+	assert.Nil(t, window)
+	window, end = ActiveWindow(windows, time.Date(2018, 12, 25, 12, 0, 0, 0, time.UTC))
+	assert.Equal(t, "freeze", window.ID)
+	assert.Equal(t, time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC), end)
+}
+
+func TestValidateMaintenanceWindow(t *testing.T) {
+	start := time.Date(2018, 7, 7, 22, 0, 0, 0, time.UTC)
+	assert.Empty(t, ValidateMaintenanceWindow(models.MaintenanceWindow{ID: "weekend", Start: start, End: start.Add(time.Hour), Repeat: RepeatDaily}))
+	assert.Equal(t, []models.FieldError{
+		{Field: "id", Message: "is required"},
+		{Field: "end", Message: "must be less than a daily repeat after start"},
+	}, ValidateMaintenanceWindow(models.MaintenanceWindow{Start: start, End: start.Add(25 * time.Hour), Repeat: RepeatDaily}))
+	assert.Contains(t, ValidateMaintenanceWindow(models.MaintenanceWindow{ID: "w", Start: start, End: start}), models.FieldError{Field: "end", Message: "must be after start"})
+}
+
+func TestValidateScheduledAction(t *testing.T) {
+	at := time.Date(2018, 7, 9, 9, 0, 0, 0, time.UTC)
+	release := testRelease()
+	assert.Empty(t, ValidateScheduledAction(models.ScheduledAction{Action: ScheduleStart, ReleaseID: "release1", At: at, Release: &release}))
+	assert.Empty(t, ValidateScheduledAction(models.ScheduledAction{Action: SchedulePromote, ReleaseID: "release1", At: at}))
+	assert.Equal(t, []models.FieldError{
+		{Field: "release", Message: "is required to start a release"},
+		{Field: "at", Message: "is required"},
+	}, ValidateScheduledAction(models.ScheduledAction{Action: ScheduleStart, ReleaseID: "release1"}))
+	assert.Equal(t, []models.FieldError{
+		{Field: "action", Message: "must be start, advance or promote"},
+	}, ValidateScheduledAction(models.ScheduledAction{Action: "deploy", ReleaseID: "release1", At: at}))
+	assert.Equal(t, "release1-promote-1531126800", ScheduledActionID(models.ScheduledAction{Action: SchedulePromote, ReleaseID: "release1", At: at}))
+}
+
+func TestScheduledStep(t *testing.T) {
+	release := testRelease()
+	_, err := ScheduledStep(release)
+	assert.Error(t, err)
+
+	release.Rollout = &models.RolloutPlan{Steps: []models.RolloutStep{{Weight: 5, Dwell: "1h"}, {Weight: 25, Dwell: "1h"}, {Weight: 100}}}
+	StartRollout(&release, time.Now())
+	step, err := ScheduledStep(release)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, step)
+
+	MoveToStep(&release, 2, time.Now())
+	assert.Equal(t, PhaseCompleted, release.Status.Phase)
+	assert.Equal(t, 100, release.Status.Weight)
+	_, err = ScheduledStep(release)
+	assert.Error(t, err)
+}
@@ -0,0 +1,110 @@
+package releases
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/models"
+)
+
+// SegmentConfigMap is the name of the config map holding the traffic segments of a namespace
+const SegmentConfigMap = "canary-traffic-segments"
+
+// SegmentStore persists the traffic segments releases can target instead of a match of their own
+type SegmentStore interface {
+	// List returns the traffic segments of a namespace, sorted by id
+	List(namespace string) ([]models.TrafficSegment, error)
+	// Get returns a traffic segment, or nil if there is no such segment
+	Get(namespace string, segmentID string) (*models.TrafficSegment, error)
+	// Put stores a traffic segment, replacing any previous version of it
+	Put(namespace string, segment models.TrafficSegment) error
+	// Delete removes a traffic segment, it doesn't fail if there is no such segment
+	Delete(namespace string, segmentID string) error
+}
+
+// configMapSegmentStore keeps every traffic segment of a namespace as a JSON entry of the SegmentConfigMap config map
+type configMapSegmentStore struct {
+	entries configMapEntries
+}
+
+// NewConfigMapSegmentStore returns a SegmentStore backed by a config map per namespace
+func NewConfigMapSegmentStore(client kubernetes.IstioClientInterface) SegmentStore {
+	return &configMapSegmentStore{entries: configMapEntries{client: client, name: SegmentConfigMap, kind: "Traffic segment"}}
+}
+
+func (in *configMapSegmentStore) List(namespace string) ([]models.TrafficSegment, error) {
+	segments := []models.TrafficSegment{}
+	err := in.entries.list(namespace, func(data []byte) error {
+		var segment models.TrafficSegment
+		if err := json.Unmarshal(data, &segment); err != nil {
+			return err
+		}
+		segments = append(segments, segment)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
+func (in *configMapSegmentStore) Get(namespace string, segmentID string) (*models.TrafficSegment, error) {
+	var segment models.TrafficSegment
+	if found, err := in.entries.get(namespace, segmentID, &segment); err != nil || !found {
+		return nil, err
+	}
+	return &segment, nil
+}
+
+func (in *configMapSegmentStore) Put(namespace string, segment models.TrafficSegment) error {
+	return in.entries.put(namespace, segment.ID, segment)
+}
+
+func (in *configMapSegmentStore) Delete(namespace string, segmentID string) error {
+	return in.entries.delete(namespace, segmentID)
+}
+
+// ResolveSegment sets the match of a release targeting a traffic segment to the match of the segment.
+// It returns an error if the segment doesn't exist, or on any problem.
+func ResolveSegment(store SegmentStore, namespace string, release *models.Release) error {
+	if release.Segment == "" {
+		return nil
+	}
+	segment, err := store.Get(namespace, release.Segment)
+	if err != nil {
+		return err
+	}
+	if segment == nil {
+		return fmt.Errorf("Traffic segment %s not found in namespace %s", release.Segment, namespace)
+	}
+	release.Match = segment.Match
+	return nil
+}
+
+// SegmentReleases returns the stored releases targeting a traffic segment
+func SegmentReleases(stored []models.Release, segmentID string) []models.Release {
+	targeting := []models.Release{}
+	for _, release := range stored {
+		if release.Segment == segmentID {
+			targeting = append(targeting, release)
+		}
+	}
+	return targeting
+}
+
+// SetMatch replaces the rules AddRelease added for the release with rules for the release's match,
+// leaving the share of the traffic its rollout sends to the release's versions and the faults of a running experiment as they are.
+// A release whose rules were removed, like a release rolled back by its analysis, gets no rules.
+// It returns false if the VirtualService was left unchanged.
+func SetMatch(vs *VirtualService, release models.Release) bool {
+	experimentID, fault := ReleaseFault(vs, release.ID)
+	if !RemoveRelease(vs, release.ID) {
+		return false
+	}
+	AddRelease(vs, release)
+	if experimentID != "" {
+		AddFault(vs, release.ID, experimentID, fault)
+	}
+	return true
+}
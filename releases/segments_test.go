@@ -0,0 +1,102 @@
+package releases
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/devtio/canary/models"
+)
+
+func TestMatchRoundTrip(t *testing.T) {
+	for _, cookie := range []models.StringMatch{{Exact: "beta.1"}, {Prefix: "be"}, {Regex: "beta|alpha"}} {
+		match := models.HttpMatch{
+			Headers:      map[string]*models.StringMatch{"user-agent": {Regex: ".*Mobile.*"}},
+			Cookies:      map[string]*models.StringMatch{"group": &cookie},
+			Claims:       map[string]*models.StringMatch{"groups": {Exact: "beta"}},
+			Bucket:       &models.HashBucket{Header: "x-user-id", Percent: 5},
+			Uri:          &models.StringMatch{Prefix: "/api"},
+			Scheme:       &models.StringMatch{Exact: "https"},
+			Method:       &models.StringMatch{Regex: "GET|HEAD"},
+			Authority:    &models.StringMatch{Exact: "dummy.example.com"},
+			QueryParams:  map[string]*models.StringMatch{"beta": {Exact: "true"}},
+			SourceLabels: map[string]string{"app": "frontend"},
+			Port:         8080,
+			Gateways:     []string{"dummy-gateway"},
+		}
+		assert.Equal(t, &match, toHttpMatch(fromHttpMatch(match)))
+	}
+
+	header := cookieMatch("group", models.StringMatch{Exact: "beta.1"}).Regex
+	assert.Regexp(t, regexp.MustCompile(header), "session=1; group=beta.1; theme=dark")
+	assert.Regexp(t, regexp.MustCompile(header), "group=beta.1")
+	assert.NotRegexp(t, regexp.MustCompile(header), "group=beta.10")
+	assert.NotRegexp(t, regexp.MustCompile(header), "subgroup=beta.1")
+}
+
+func TestBucketMatch(t *testing.T) {
+	for _, percent := range []int{1, 5, 50, 99, 100} {
+		bucket := regexp.MustCompile(bucketMatch(percent).Regex)
+		matched := 0
+		for i := 0; i < 256; i++ {
+			if bucket.MatchString(fmt.Sprintf("user-%02x", i)) {
+				matched++
+			}
+			assert.Equal(t, bucket.MatchString(fmt.Sprintf("user-%02x", i)), bucket.MatchString(fmt.Sprintf("USER-%02X", i)))
+		}
+		assert.Equal(t, (percent*256+50)/100, matched, "percent %d", percent)
+		parsed, ok := parseBucketMatch(bucketMatch(percent))
+		assert.True(t, ok)
+		assert.Equal(t, percent, parsed)
+	}
+}
+
+func TestValidateTrafficSegment(t *testing.T) {
+	segment := models.TrafficSegment{
+		ID:    "beta-users",
+		Match: &models.HttpMatch{Cookies: map[string]*models.StringMatch{"group": {Exact: "beta"}}},
+	}
+	assert.Empty(t, ValidateTrafficSegment(segment))
+
+	segment.Match.Headers = map[string]*models.StringMatch{CookieHeader: {Exact: "group=beta"}}
+	segment.Match.Cookies["other"] = &models.StringMatch{}
+	segment.Match.Uri = &models.StringMatch{Exact: "/", Prefix: "/"}
+	segment.Match.Method = &models.StringMatch{}
+	segment.Match.Port = 70000
+	fields := []string{}
+	for _, field := range ValidateTrafficSegment(segment) {
+		fields = append(fields, field.Field)
+	}
+	assert.Equal(t, []string{"match.headers.cookie", "match.cookies", "match.cookies.other", "match.uri", "match.method", "match.port"}, fields)
+
+	assert.Len(t, ValidateTrafficSegment(models.TrafficSegment{ID: "empty", Match: &models.HttpMatch{}}), 1)
+	assert.Empty(t, ValidateTrafficSegment(models.TrafficSegment{ID: "mobile", Match: &models.HttpMatch{Port: 8080}}))
+}
+
+func TestSetMatch(t *testing.T) {
+	gateway, app := mustParse(t, gatewayVirtualService()), mustParse(t, appVirtualService())
+	release := testRelease()
+	AddRelease(gateway, release)
+	AddRelease(app, release)
+
+	release.Segment = "beta-users"
+	release.Match = &models.HttpMatch{Cookies: map[string]*models.StringMatch{"group": {Exact: "beta"}}}
+	assert.True(t, SetMatch(gateway, release))
+	assert.True(t, SetMatch(app, release))
+	assert.Equal(t, release.Match, Releases([]*VirtualService{gateway, app})[release.ID].Match)
+
+	// the faults of a running experiment are kept
+	experiment := models.Experiment{ID: "slow-a", Delay: &models.DelayFault{Percent: 50, FixedDelay: "2s"}}
+	assert.True(t, AddFault(app, release.ID, experiment.ID, FaultOf(experiment)))
+	release.Match = &models.HttpMatch{Cookies: map[string]*models.StringMatch{"group": {Exact: "alpha"}}}
+	assert.True(t, SetMatch(app, release))
+	assert.Equal(t, experiment.ID, FaultingExperiment([]*VirtualService{app}, release.ID))
+	rules := mustEncode(t, reparse(t, app))["http"].([]interface{})
+	assert.Equal(t, `{"delay":{"fixedDelay":"2s","percent":50}}`, mustJSON(t, rules[0].(map[string]interface{})["fault"]))
+
+	other := testRelease()
+	other.ID = "other"
+	assert.False(t, SetMatch(gateway, other))
+}
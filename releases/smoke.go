@@ -0,0 +1,82 @@
+package releases
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/devtio/canary/models"
+)
+
+// RunSmokeChecks sends the smoke checks of a blue/green release to every ready pod of the release's versions in its clusters,
+// through the proxy of the API server of each cluster, as canary can't reach the pods of remote clusters directly.
+// The requests carry the release id in the release's header.
+// It returns the result of every check on every pod, and true if they all passed.
+func RunSmokeChecks(clusters []Cluster, namespace string, release models.Release, now time.Time) ([]models.SmokeResult, bool) {
+	results := []models.SmokeResult{}
+	passed := true
+	for _, cluster := range clusters {
+		for _, check := range release.SmokeChecks {
+			for _, result := range runSmokeCheck(cluster, namespace, release, check, now) {
+				result.Cluster = cluster.Name
+				passed = passed && result.Outcome == VerdictPassed
+				results = append(results, result)
+			}
+		}
+	}
+	return results, passed
+}
+
+func runSmokeCheck(cluster Cluster, namespace string, release models.Release, check models.SmokeCheck, now time.Time) []models.SmokeResult {
+	failed := func(message string) []models.SmokeResult {
+		return []models.SmokeResult{{Name: check.Name, Time: now, Outcome: VerdictFailed, Message: message}}
+	}
+	var selector labels.Set
+	for _, app := range release.Apps {
+		if app.Labels[AppLabel] == check.App {
+			selector = labels.Set(app.Labels)
+		}
+	}
+	if selector == nil {
+		return failed(fmt.Sprintf("app %s isn't part of the release", check.App))
+	}
+	pods, err := cluster.Client.GetPods(namespace, selector.String())
+	if err != nil {
+		return failed(err.Error())
+	}
+	results := []models.SmokeResult{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !isPodReady(pod) {
+			continue
+		}
+		result := models.SmokeResult{Name: check.Name, Pod: pod.Name, Time: now, Outcome: VerdictPassed}
+		if err := smokeRequest(cluster, namespace, pod, check, release); err != nil {
+			result.Outcome = VerdictFailed
+			result.Message = err.Error()
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		return failed(fmt.Sprintf("no ready pod of version %s of %s", selector[VersionLabel], check.App))
+	}
+	return results
+}
+
+// smokeRequest sends the request of a smoke check to a pod, it returns an error if the pod doesn't answer as expected
+func smokeRequest(cluster Cluster, namespace string, pod *v1.Pod, check models.SmokeCheck, release models.Release) error {
+	status, err := cluster.Client.ProxyPodGet(namespace, pod.Name, check.Port, check.Path, map[string]string{ReleaseHeaderOf(release): release.ID})
+	if err != nil {
+		return err
+	}
+	if check.Status == 0 && (status < 200 || status > 299) {
+		return fmt.Errorf("answered %d %s, expected a 2xx status", status, http.StatusText(status))
+	}
+	if check.Status != 0 && status != check.Status {
+		return fmt.Errorf("answered %d %s, expected %d", status, http.StatusText(status), check.Status)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package releases
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/models"
+)
+
+// StoreConfigMap is the name of the config map holding the releases of a namespace
+const StoreConfigMap = "canary-releases"
+
+// Store persists what can't be read back from the VirtualServices of a release, like its rollout plan and progress
+// or the traffic segment it targets.
+type Store interface {
+	// List returns the stored releases of a namespace, sorted by id
+	List(namespace string) ([]models.Release, error)
+	// Get returns a stored release, or nil if the release isn't stored
+	Get(namespace string, releaseID string) (*models.Release, error)
+	// Put stores a release, replacing any previous version of it
+	Put(namespace string, release models.Release) error
+	// Delete removes a release from the store, it doesn't fail if the release isn't stored
+	Delete(namespace string, releaseID string) error
+}
+
+// configMapStore keeps every release of a namespace as a JSON entry of the StoreConfigMap config map
+type configMapStore struct {
+	entries configMapEntries
+}
+
+// NewConfigMapStore returns a Store backed by a config map per namespace
+func NewConfigMapStore(client kubernetes.IstioClientInterface) Store {
+	return &configMapStore{entries: configMapEntries{client: client, name: StoreConfigMap, kind: "Release"}}
+}
+
+func (in *configMapStore) List(namespace string) ([]models.Release, error) {
+	stored := []models.Release{}
+	err := in.entries.list(namespace, func(data []byte) error {
+		var release models.Release
+		if err := json.Unmarshal(data, &release); err != nil {
+			return err
+		}
+		stored = append(stored, release)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (in *configMapStore) Get(namespace string, releaseID string) (*models.Release, error) {
+	var release models.Release
+	if found, err := in.entries.get(namespace, releaseID, &release); err != nil || !found {
+		return nil, err
+	}
+	return &release, nil
+}
+
+func (in *configMapStore) Put(namespace string, release models.Release) error {
+	return in.entries.put(namespace, release.ID, release)
+}
+
+func (in *configMapStore) Delete(namespace string, releaseID string) error {
+	return in.entries.delete(namespace, releaseID)
+}
+
+// configMapEntries keeps values of a kind as JSON entries of a config map per namespace, keyed by their id.
+// The stores of canary are built on it.
+type configMapEntries struct {
+	client kubernetes.IstioClientInterface
+	// name is the name of the config map
+	name string
+	// kind names the values in errors
+	kind string
+}
+
+// list calls decode with every entry of the config map of the namespace, sorted by id.
+// Nothing was stored in the namespace yet when the config map doesn't exist.
+func (in configMapEntries) list(namespace string, decode func(data []byte) error) error {
+	configMap, err := getConfigMap(in.client, namespace, in.name)
+	if err != nil || configMap == nil {
+		return err
+	}
+	for _, id := range sortedDataKeys(configMap) {
+		if err := decode([]byte(configMap.Data[id])); err != nil {
+			return in.decodeError(namespace, id, err)
+		}
+	}
+	return nil
+}
+
+// get decodes the entry with the id into value, it returns false if there is no such entry
+func (in configMapEntries) get(namespace string, id string, value interface{}) (bool, error) {
+	configMap, err := getConfigMap(in.client, namespace, in.name)
+	if err != nil || configMap == nil {
+		return false, err
+	}
+	data, ok := configMap.Data[id]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal([]byte(data), value); err != nil {
+		return false, in.decodeError(namespace, id, err)
+	}
+	return true, nil
+}
+
+// put stores value as the entry with the id, replacing any previous entry
+func (in configMapEntries) put(namespace string, id string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return retry.RetryOnConflict(ConflictBackoff, func() error {
+		return putConfigMapEntry(in.client, namespace, in.name, id, string(data))
+	})
+}
+
+// delete removes the entry with the id, it doesn't fail if there is no such entry
+func (in configMapEntries) delete(namespace string, id string) error {
+	return retry.RetryOnConflict(ConflictBackoff, func() error {
+		return deleteConfigMapEntry(in.client, namespace, in.name, id)
+	})
+}
+
+func (in configMapEntries) decodeError(namespace string, id string, err error) error {
+	return fmt.Errorf("%s %s/%s can't be read from config map %s: %v", in.kind, namespace, id, in.name, err)
+}
+
+// getConfigMap returns a config map of canary, or nil if it doesn't exist yet
+func getConfigMap(client kubernetes.IstioClientInterface, namespace string, name string) (*v1.ConfigMap, error) {
+	configMap, err := client.GetConfigMap(namespace, name)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	return configMap, err
+}
+
+// putConfigMapEntry sets an entry of a config map of canary, creating the config map if it doesn't exist yet.
+// The config map is read and written once, callers retry on conflicts.
+func putConfigMapEntry(client kubernetes.IstioClientInterface, namespace string, name string, key string, data string) error {
+	configMap, err := getConfigMap(client, namespace, name)
+	if err != nil {
+		return err
+	}
+	if configMap == nil {
+		_, err = client.CreateConfigMap(namespace, &v1.ConfigMap{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{"app": "canary", ManagedLabel: "true"},
+			},
+			Data: map[string]string{key: data},
+		})
+		return err
+	}
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	configMap.Data[key] = data
+	_, err = client.UpdateConfigMap(namespace, configMap)
+	return err
+}
+
+// deleteConfigMapEntry removes an entry of a config map of canary, it doesn't fail if there is no such entry.
+// The config map is read and written once, callers retry on conflicts.
+func deleteConfigMapEntry(client kubernetes.IstioClientInterface, namespace string, name string, key string) error {
+	configMap, err := getConfigMap(client, namespace, name)
+	if err != nil || configMap == nil {
+		return err
+	}
+	if _, ok := configMap.Data[key]; !ok {
+		return nil
+	}
+	delete(configMap.Data, key)
+	_, err = client.UpdateConfigMap(namespace, configMap)
+	return err
+}
+
+// sortedDataKeys returns the keys of the entries of a config map, sorted
+func sortedDataKeys(configMap *v1.ConfigMap) []string {
+	keys := make([]string, 0, len(configMap.Data))
+	for key := range configMap.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,343 @@
+package releases
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/log"
+	"github.com/devtio/canary/models"
+)
+
+const (
+	// ManagedSubsetsAnnotation lists the subsets of a DestinationRule canary added for releases, comma separated
+	ManagedSubsetsAnnotation = "io.devtio.canary/subsets"
+	// ManagedPoliciesAnnotation lists the subsets of a DestinationRule whose trafficPolicy canary set for releases, comma separated
+	ManagedPoliciesAnnotation = "io.devtio.canary/subset-policies"
+)
+
+// AddSubsets adds a subset for the release's version to the DestinationRule of every app of the release that doesn't have one,
+// and creates the DestinationRule of apps that have none.
+// The subsets added are listed in the ManagedSubsetsAnnotation of the DestinationRule, so RemoveUnusedSubsets can remove them.
+// The traffic policy of an app is set on the subset of its version, unless the subset has a traffic policy canary didn't set,
+// and the subsets with a policy are listed in the ManagedPoliciesAnnotation.
+// It returns an error on any problem.
+func AddSubsets(client kubernetes.IstioClientInterface, namespace string, release models.Release) error {
+	for _, app := range release.Apps {
+		name, version := app.Labels[AppLabel], app.Labels[VersionLabel]
+		if name == "" || version == "" {
+			continue
+		}
+		err := retry.RetryOnConflict(ConflictBackoff, func() error {
+			destinationRules, err := serviceDestinationRules(client, namespace, name)
+			if err != nil {
+				return err
+			}
+			if len(destinationRules) == 0 {
+				log.Infof("Creating destination rule %s/%s with subset %s", namespace, name, version)
+				meta := meta_v1.ObjectMeta{
+					Name:        name,
+					Labels:      map[string]string{ManagedLabel: "true"},
+					Annotations: map[string]string{ManagedSubsetsAnnotation: version},
+				}
+				subset := newSubset(version)
+				if _, err := setSubsetPolicy(&meta, subset, app.TrafficPolicy); err != nil {
+					return err
+				}
+				_, err := client.CreateDestinationRule(namespace, &kubernetes.DestinationRule{
+					ObjectMeta: meta,
+					Spec: map[string]interface{}{
+						"host":    name,
+						"subsets": []interface{}{subset},
+					},
+				})
+				return err
+			}
+			destinationRule := destinationRules[0]
+			meta := destinationRule.GetObjectMeta()
+			subsets, _ := destinationRule.GetSpec()["subsets"].([]interface{})
+			changed := false
+			i := subsetIndex(subsets, version)
+			if i == -1 {
+				log.Infof("Adding subset %s to destination rule %s/%s", version, namespace, meta.Name)
+				subsets = append(subsets, newSubset(version))
+				destinationRule.GetSpec()["subsets"] = subsets
+				setAnnotationList(&meta, ManagedSubsetsAnnotation, append(annotationList(meta, ManagedSubsetsAnnotation), version))
+				i, changed = len(subsets)-1, true
+			}
+			subset, ok := subsets[i].(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("subset %s of destination rule %s/%s isn't an object", version, namespace, meta.Name)
+			}
+			policyChanged, err := setSubsetPolicy(&meta, subset, app.TrafficPolicy)
+			if err != nil {
+				return err
+			}
+			if !changed && !policyChanged {
+				return nil
+			}
+			destinationRule.SetObjectMeta(meta)
+			_, err = client.PutDestinationRule(namespace, destinationRule)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveUnusedSubsets removes the subsets AddSubsets added for the release's versions
+// that no rule of the managed VirtualServices of the namespace routes to anymore.
+// It returns an error on any problem.
+func RemoveUnusedSubsets(client kubernetes.IstioClientInterface, namespace string, release models.Release) error {
+	virtualServices, err := GetManagedVirtualServices(client, namespace)
+	if err != nil {
+		return err
+	}
+	for _, app := range release.Apps {
+		name, version := app.Labels[AppLabel], app.Labels[VersionLabel]
+		if name == "" || version == "" || routesToSubset(virtualServices, namespace, name, version) {
+			continue
+		}
+		err := retry.RetryOnConflict(ConflictBackoff, func() error {
+			destinationRules, err := serviceDestinationRules(client, namespace, name)
+			if err != nil {
+				return err
+			}
+			for _, destinationRule := range destinationRules {
+				meta := destinationRule.GetObjectMeta()
+				managed := annotationList(meta, ManagedSubsetsAnnotation)
+				policies := annotationList(meta, ManagedPoliciesAnnotation)
+				subsets, _ := destinationRule.GetSpec()["subsets"].([]interface{})
+				i := subsetIndex(subsets, version)
+				switch {
+				case containsString(managed, version):
+					log.Infof("Removing subset %s from destination rule %s/%s", version, namespace, meta.Name)
+					if i != -1 {
+						destinationRule.GetSpec()["subsets"] = append(subsets[:i:i], subsets[i+1:]...)
+					}
+					setAnnotationList(&meta, ManagedSubsetsAnnotation, removeString(managed, version))
+					setAnnotationList(&meta, ManagedPoliciesAnnotation, removeString(policies, version))
+				case containsString(policies, version):
+					// the subset was there before the release, only its traffic policy is the release's
+					log.Infof("Removing the traffic policy of subset %s from destination rule %s/%s", version, namespace, meta.Name)
+					if i != -1 {
+						if subset, ok := subsets[i].(map[string]interface{}); ok {
+							delete(subset, "trafficPolicy")
+						}
+					}
+					setAnnotationList(&meta, ManagedPoliciesAnnotation, removeString(policies, version))
+				default:
+					continue
+				}
+				destinationRule.SetObjectMeta(meta)
+				if _, err := client.PutDestinationRule(namespace, destinationRule); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveSubsets removes the subsets of the given versions of the apps from their DestinationRules,
+// except the ones a VirtualService of the namespace, managed or not, still routes to.
+// The VirtualServices just written, by name, replace the ones read from the client, which may not have received them yet.
+// It returns an error on any problem.
+func RemoveSubsets(client kubernetes.IstioClientInterface, namespace string, versions map[string][]string, written map[string]*VirtualService) error {
+	objects, err := client.GetVirtualServices(namespace, "")
+	if err != nil {
+		return err
+	}
+	virtualServices := make([]*VirtualService, 0, len(objects))
+	for _, object := range objects {
+		vs, ok := written[object.GetObjectMeta().Name]
+		if !ok {
+			if vs, err = ParseVirtualService(object); err != nil {
+				return err
+			}
+		}
+		virtualServices = append(virtualServices, vs)
+	}
+	for app, appVersions := range versions {
+		for _, version := range appVersions {
+			if routesToSubset(virtualServices, namespace, app, version) {
+				continue
+			}
+			err := retry.RetryOnConflict(ConflictBackoff, func() error {
+				destinationRules, err := serviceDestinationRules(client, namespace, app)
+				if err != nil {
+					return err
+				}
+				for _, destinationRule := range destinationRules {
+					subsets, _ := destinationRule.GetSpec()["subsets"].([]interface{})
+					i := subsetIndex(subsets, version)
+					if i == -1 {
+						continue
+					}
+					meta := destinationRule.GetObjectMeta()
+					log.Infof("Removing subset %s from destination rule %s/%s", version, namespace, meta.Name)
+					destinationRule.GetSpec()["subsets"] = append(subsets[:i:i], subsets[i+1:]...)
+					setAnnotationList(&meta, ManagedSubsetsAnnotation, removeString(annotationList(meta, ManagedSubsetsAnnotation), version))
+					setAnnotationList(&meta, ManagedPoliciesAnnotation, removeString(annotationList(meta, ManagedPoliciesAnnotation), version))
+					destinationRule.SetObjectMeta(meta)
+					if _, err := client.PutDestinationRule(namespace, destinationRule); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func newSubset(version string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":   version,
+		"labels": map[string]interface{}{VersionLabel: version},
+	}
+}
+
+func subsetIndex(subsets []interface{}, name string) int {
+	for i, subset := range subsets {
+		if s, ok := subset.(map[string]interface{}); ok && s["name"] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// routesToSubset returns true if a rule of the VirtualServices of the namespace routes or mirrors requests to the subset of a service,
+// named by its short or fully qualified host
+func routesToSubset(virtualServices []*VirtualService, namespace, service, subset string) bool {
+	for _, vs := range virtualServices {
+		for _, route := range vs.Spec.HTTP {
+			if mirror := route.Mirror; mirror != nil && isServiceHost(mirror.Host, namespace, service) && mirror.Subset == subset {
+				return true
+			}
+			for _, destination := range route.Route {
+				if isServiceHost(destination.Destination.Host, namespace, service) && destination.Destination.Subset == subset {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// serviceDestinationRules returns the DestinationRules of a namespace whose host is the service,
+// by its short name or its fully qualified one
+func serviceDestinationRules(client kubernetes.IstioClientInterface, namespace, service string) ([]kubernetes.IstioObject, error) {
+	all, err := client.GetDestinationRules(namespace, "")
+	if err != nil {
+		return nil, err
+	}
+	destinationRules := []kubernetes.IstioObject{}
+	for _, destinationRule := range all {
+		if isServiceDestinationRule(destinationRule, namespace, service) {
+			destinationRules = append(destinationRules, destinationRule)
+		}
+	}
+	return destinationRules, nil
+}
+
+// isServiceDestinationRule returns true if the host of the DestinationRule of the namespace names the service
+func isServiceDestinationRule(destinationRule kubernetes.IstioObject, namespace, service string) bool {
+	host, _ := destinationRuleHost(destinationRule).(string)
+	return isServiceHost(host, namespace, service)
+}
+
+// isServiceHost returns true if the host, relative to the namespace, names the service of the namespace
+func isServiceHost(host, namespace, service string) bool {
+	name, hostNamespace, ok := serviceOfHost(host, namespace)
+	return ok && name == service && hostNamespace == namespace
+}
+
+// setSubsetPolicy sets the traffic policy of a release's app on a subset, or removes the one canary set when the app has none.
+// A traffic policy canary didn't set is left alone, see validateAppsInCluster.
+// It returns false if the subset was left unchanged.
+func setSubsetPolicy(meta *meta_v1.ObjectMeta, subset map[string]interface{}, policy *models.TrafficPolicy) (bool, error) {
+	name, _ := subset["name"].(string)
+	policies := annotationList(*meta, ManagedPoliciesAnnotation)
+	existing, hasPolicy := subset["trafficPolicy"]
+	if hasPolicy && !containsString(policies, name) {
+		return false, nil
+	}
+	if policy == nil {
+		if !hasPolicy {
+			return false, nil
+		}
+		delete(subset, "trafficPolicy")
+		setAnnotationList(meta, ManagedPoliciesAnnotation, removeString(policies, name))
+		return true, nil
+	}
+	value, err := toJSONValue(policy)
+	if err != nil {
+		return false, err
+	}
+	if hasPolicy && reflect.DeepEqual(existing, value) {
+		return false, nil
+	}
+	subset["trafficPolicy"] = value
+	if !containsString(policies, name) {
+		setAnnotationList(meta, ManagedPoliciesAnnotation, append(policies, name))
+	}
+	return true, nil
+}
+
+// unmanagedPolicy returns true if the subset of a DestinationRule has a traffic policy canary didn't set
+func unmanagedPolicy(destinationRule kubernetes.IstioObject, name string) bool {
+	subsets, _ := destinationRule.GetSpec()["subsets"].([]interface{})
+	i := subsetIndex(subsets, name)
+	if i == -1 {
+		return false
+	}
+	subset, _ := subsets[i].(map[string]interface{})
+	_, hasPolicy := subset["trafficPolicy"]
+	return hasPolicy && !containsString(annotationList(destinationRule.GetObjectMeta(), ManagedPoliciesAnnotation), name)
+}
+
+// annotationList returns the comma separated values of an annotation
+func annotationList(meta meta_v1.ObjectMeta, annotation string) []string {
+	values := []string{}
+	for _, value := range strings.Split(meta.Annotations[annotation], ",") {
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func setAnnotationList(meta *meta_v1.ObjectMeta, annotation string, values []string) {
+	if len(values) == 0 {
+		delete(meta.Annotations, annotation)
+		return
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[annotation] = strings.Join(values, ",")
+}
+
+func removeString(values []string, value string) []string {
+	result := []string{}
+	for _, v := range values {
+		if v != value {
+			result = append(result, v)
+		}
+	}
+	return result
+}
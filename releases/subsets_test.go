@@ -0,0 +1,138 @@
+package releases
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/models"
+)
+
+// subsetsClient keeps the DestinationRules written to it, and serves its VirtualServices
+type subsetsClient struct {
+	kubernetes.IstioClientInterface
+	destinationRules []kubernetes.IstioObject
+	virtualServices  []kubernetes.IstioObject
+}
+
+func (in *subsetsClient) GetDestinationRules(namespace string, serviceName string) ([]kubernetes.IstioObject, error) {
+	destinationRules := []kubernetes.IstioObject{}
+	for _, destinationRule := range in.destinationRules {
+		destinationRules = append(destinationRules, destinationRule.DeepCopyIstioObject())
+	}
+	return destinationRules, nil
+}
+
+func (in *subsetsClient) CreateDestinationRule(namespace string, destinationRule kubernetes.IstioObject) (kubernetes.IstioObject, error) {
+	in.destinationRules = append(in.destinationRules, destinationRule)
+	return destinationRule, nil
+}
+
+func (in *subsetsClient) PutDestinationRule(namespace string, destinationRule kubernetes.IstioObject) (kubernetes.IstioObject, error) {
+	in.destinationRules[0] = destinationRule
+	return destinationRule, nil
+}
+
+func (in *subsetsClient) GetVirtualServices(namespace string, serviceName string) ([]kubernetes.IstioObject, error) {
+	return append([]kubernetes.IstioObject{}, in.virtualServices...), nil
+}
+
+func TestSubsets(t *testing.T) {
+	client := &subsetsClient{}
+	release := testRelease()
+	version := release.Apps[0].Labels[VersionLabel]
+
+	assert.NoError(t, AddSubsets(client, "dummy", release))
+	assert.Len(t, client.destinationRules, 1)
+	subsets := client.destinationRules[0].GetSpec()["subsets"].([]interface{})
+	assert.Equal(t, []interface{}{newSubset(version)}, subsets)
+
+	// the subset already exists, nothing changes
+	assert.NoError(t, AddSubsets(client, "dummy", release))
+	assert.Len(t, client.destinationRules[0].GetSpec()["subsets"], 1)
+
+	assert.NoError(t, RemoveUnusedSubsets(client, "dummy", release))
+	assert.Empty(t, client.destinationRules[0].GetSpec()["subsets"])
+	assert.Empty(t, client.destinationRules[0].GetObjectMeta().Annotations)
+
+	// the DestinationRule of the app is found by its fully qualified host
+	client = &subsetsClient{destinationRules: []kubernetes.IstioObject{&kubernetes.DestinationRule{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "a"},
+		Spec:       map[string]interface{}{"host": "a.dummy.svc.cluster.local"},
+	}}}
+	assert.NoError(t, AddSubsets(client, "dummy", release))
+	assert.Len(t, client.destinationRules, 1)
+	assert.Equal(t, []interface{}{newSubset(version)}, client.destinationRules[0].GetSpec()["subsets"])
+	assert.NoError(t, RemoveUnusedSubsets(client, "dummy", release))
+	assert.Empty(t, client.destinationRules[0].GetSpec()["subsets"])
+}
+
+func TestRemoveSubsets(t *testing.T) {
+	// the client still serves the VirtualService routing to v1 as it was before the promotion
+	stale := appVirtualService()
+	client := &subsetsClient{
+		destinationRules: []kubernetes.IstioObject{&kubernetes.DestinationRule{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "a"},
+			Spec:       map[string]interface{}{"host": "a", "subsets": []interface{}{newSubset("v1"), newSubset("v2")}},
+		}},
+		virtualServices: []kubernetes.IstioObject{stale},
+	}
+	assert.NoError(t, RemoveSubsets(client, "dummy", map[string][]string{"a": {"v1"}}, nil))
+	assert.Len(t, client.destinationRules[0].GetSpec()["subsets"], 2)
+
+	promoted := mustParse(t, stale)
+	PromoteVersions(promoted, testRelease())
+	assert.NoError(t, RemoveSubsets(client, "dummy", map[string][]string{"a": {"v1"}}, map[string]*VirtualService{promoted.Name: promoted}))
+	assert.Equal(t, []interface{}{newSubset("v2")}, client.destinationRules[0].GetSpec()["subsets"])
+}
+
+func TestSubsetPolicies(t *testing.T) {
+	client := &subsetsClient{}
+	release := testRelease()
+	release.Apps[0].TrafficPolicy = &models.TrafficPolicy{
+		ConnectionPool: &models.ConnectionPool{HTTP: &models.HTTPSettings{HTTP1MaxPendingRequests: 10}},
+	}
+	policy := map[string]interface{}{
+		"connectionPool": map[string]interface{}{"http": map[string]interface{}{"http1MaxPendingRequests": 10.0}},
+	}
+
+	assert.NoError(t, AddSubsets(client, "dummy", release))
+	subset := client.destinationRules[0].GetSpec()["subsets"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, policy, subset["trafficPolicy"])
+	assert.Equal(t, "v2", client.destinationRules[0].GetObjectMeta().Annotations[ManagedPoliciesAnnotation])
+
+	// the release no longer sets a policy, canary's is removed
+	release.Apps[0].TrafficPolicy = nil
+	assert.NoError(t, AddSubsets(client, "dummy", release))
+	subset = client.destinationRules[0].GetSpec()["subsets"].([]interface{})[0].(map[string]interface{})
+	assert.NotContains(t, subset, "trafficPolicy")
+	assert.NotContains(t, client.destinationRules[0].GetObjectMeta().Annotations, ManagedPoliciesAnnotation)
+
+	// a subset canary didn't add only loses the policy canary set on it
+	client = &subsetsClient{destinationRules: []kubernetes.IstioObject{&kubernetes.DestinationRule{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "a"},
+		Spec: map[string]interface{}{
+			"host":    "a",
+			"subsets": []interface{}{newSubset("v2")},
+		},
+	}}}
+	release.Apps[0].TrafficPolicy = &models.TrafficPolicy{OutlierDetection: &models.OutlierDetection{ConsecutiveErrors: 1}}
+	assert.NoError(t, AddSubsets(client, "dummy", release))
+	subset = client.destinationRules[0].GetSpec()["subsets"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"outlierDetection": map[string]interface{}{"consecutiveErrors": 1.0}}, subset["trafficPolicy"])
+	assert.False(t, unmanagedPolicy(client.destinationRules[0], "v2"))
+	assert.NoError(t, RemoveUnusedSubsets(client, "dummy", release))
+	assert.Equal(t, []interface{}{newSubset("v2")}, client.destinationRules[0].GetSpec()["subsets"])
+	assert.Empty(t, client.destinationRules[0].GetObjectMeta().Annotations)
+
+	// a policy canary didn't set is left alone
+	subset = client.destinationRules[0].GetSpec()["subsets"].([]interface{})[0].(map[string]interface{})
+	subset["trafficPolicy"] = policy
+	assert.True(t, unmanagedPolicy(client.destinationRules[0], "v2"))
+	assert.NoError(t, AddSubsets(client, "dummy", release))
+	subset = client.destinationRules[0].GetSpec()["subsets"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, policy, subset["trafficPolicy"])
+}
@@ -0,0 +1,126 @@
+package releases
+
+// Typed views of the networking.istio.io/v1alpha3 specs canary reads and writes.
+// Only the fields canary needs are modelled: when a spec is encoded back, every field
+// that is not modelled here (or that was not modified) is copied unchanged from the original object.
+// Reference: https://istio.io/docs/reference/config/istio.networking.v1alpha3/
+
+// VirtualServiceSpec is the typed spec of a VirtualService
+type VirtualServiceSpec struct {
+	Hosts    []string    `json:"hosts,omitempty"`
+	Gateways []string    `json:"gateways,omitempty"`
+	HTTP     []HTTPRoute `json:"http,omitempty"`
+}
+
+// HTTPRoute is a single rule of the http section of a VirtualService.
+// Mirror receives a copy of MirrorPercent percent of the requests, all of them when it is nil.
+type HTTPRoute struct {
+	Match         []HTTPMatchRequest  `json:"match,omitempty"`
+	Route         []DestinationWeight `json:"route,omitempty"`
+	AppendHeaders map[string]string   `json:"appendHeaders,omitempty"`
+	Mirror        *Destination        `json:"mirror,omitempty"`
+	MirrorPercent *int                `json:"mirrorPercent,omitempty"`
+	Fault         *HTTPFaultInjection `json:"fault,omitempty"`
+	Timeout       string              `json:"timeout,omitempty"`
+	Retries       *HTTPRetry          `json:"retries,omitempty"`
+
+	// raw is the rule as read from the cluster, nil for rules created by canary
+	raw map[string]interface{}
+}
+
+// HTTPMatchRequest holds the conditions a request must satisfy for a rule to be applied
+type HTTPMatchRequest struct {
+	Headers      map[string]StringMatch `json:"headers,omitempty"`
+	URI          *StringMatch           `json:"uri,omitempty"`
+	Scheme       *StringMatch           `json:"scheme,omitempty"`
+	Method       *StringMatch           `json:"method,omitempty"`
+	Authority    *StringMatch           `json:"authority,omitempty"`
+	QueryParams  map[string]StringMatch `json:"queryParams,omitempty"`
+	SourceLabels map[string]string      `json:"sourceLabels,omitempty"`
+	Port         uint32                 `json:"port,omitempty"`
+	Gateways     []string               `json:"gateways,omitempty"`
+}
+
+// StringMatch matches a string exactly, by prefix or by regular expression
+type StringMatch struct {
+	Exact  string `json:"exact,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Regex  string `json:"regex,omitempty"`
+}
+
+// HTTPFaultInjection delays or aborts a share of the requests of a rule
+type HTTPFaultInjection struct {
+	Delay *FaultDelay `json:"delay,omitempty"`
+	Abort *FaultAbort `json:"abort,omitempty"`
+}
+
+// FaultDelay delays Percent percent of the requests by FixedDelay
+type FaultDelay struct {
+	Percent    int    `json:"percent,omitempty"`
+	FixedDelay string `json:"fixedDelay,omitempty"`
+}
+
+// FaultAbort answers Percent percent of the requests with HTTPStatus
+type FaultAbort struct {
+	Percent    int `json:"percent,omitempty"`
+	HTTPStatus int `json:"httpStatus,omitempty"`
+}
+
+// HTTPRetry retries the failed requests of a rule Attempts times, each try timing out after PerTryTimeout
+type HTTPRetry struct {
+	Attempts      int    `json:"attempts"`
+	PerTryTimeout string `json:"perTryTimeout,omitempty"`
+}
+
+// DestinationWeight is a destination of a rule and the share of the traffic it receives.
+// Weight is a pointer as a weight of 0 has to be written when the other destinations take all the traffic.
+type DestinationWeight struct {
+	Destination Destination `json:"destination"`
+	Weight      *int        `json:"weight,omitempty"`
+}
+
+// Destination identifies a service subset traffic is forwarded to
+type Destination struct {
+	Host   string        `json:"host"`
+	Subset string        `json:"subset,omitempty"`
+	Port   *PortSelector `json:"port,omitempty"`
+}
+
+// PortSelector selects a port of a destination by number or name
+type PortSelector struct {
+	Number uint32 `json:"number,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+// GatewaySpec is the typed spec of a Gateway
+type GatewaySpec struct {
+	Selector map[string]string `json:"selector,omitempty"`
+	Servers  []Server          `json:"servers,omitempty"`
+}
+
+// Server describes a port exposed by a Gateway and the hosts it serves
+type Server struct {
+	Port  *Port    `json:"port,omitempty"`
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// Port describes the properties of a port of a Gateway server
+type Port struct {
+	Number   uint32 `json:"number,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Name     string `json:"name,omitempty"`
+}
+
+// DestinationRuleSpec is the typed spec of a DestinationRule
+// Name is still read as older DestinationRules identify the service with it instead of host.
+type DestinationRuleSpec struct {
+	Host    string   `json:"host,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Subsets []Subset `json:"subsets,omitempty"`
+}
+
+// Subset is a named group of endpoints of a service, selected by labels
+type Subset struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
@@ -0,0 +1,534 @@
+package releases
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/models"
+)
+
+// ValidateRelease checks that a release is complete and well formed, without looking at the cluster.
+// It returns the invalid fields, or an empty list if the release is valid.
+func ValidateRelease(release models.Release) []models.FieldError {
+	fields := []models.FieldError{}
+	if release.ID == "" {
+		fields = append(fields, models.FieldError{Field: "id", Message: "is required"})
+	} else {
+		for _, message := range validation.IsDNS1123Label(release.ID) {
+			fields = append(fields, models.FieldError{Field: "id", Message: message})
+		}
+	}
+	if len(release.Gateway.Hosts) == 0 {
+		fields = append(fields, models.FieldError{Field: "gateway.hosts", Message: "at least one host is required"})
+	}
+	if len(release.Apps) == 0 {
+		fields = append(fields, models.FieldError{Field: "apps", Message: "at least one app is required"})
+	}
+	for i, app := range release.Apps {
+		field := fmt.Sprintf("apps[%d]", i)
+		if len(app.Hosts) == 0 {
+			fields = append(fields, models.FieldError{Field: field + ".hosts", Message: "at least one host is required"})
+		}
+		for _, label := range []string{AppLabel, VersionLabel} {
+			if app.Labels[label] == "" {
+				fields = append(fields, models.FieldError{Field: field + ".labels." + label, Message: "is required"})
+			}
+		}
+		fields = append(fields, validateAppPolicies(field, app)...)
+		if release.Mode == ModeShadow && (app.Timeout != "" || app.Retries != nil) {
+			// the responses of a shadow release's versions are dropped, it has no rule to set them on
+			fields = append(fields, models.FieldError{Field: field, Message: "timeout and retries aren't allowed in " + ModeShadow + " mode"})
+		}
+	}
+	switch release.Mode {
+	case "", ModeRouted:
+		if release.MirrorPercent != 0 {
+			fields = append(fields, models.FieldError{Field: "mirrorPercent", Message: "is only allowed in " + ModeShadow + " mode"})
+		}
+	case ModeShadow:
+		// a shadow release mirrors all of the requests of its apps, none of them are routed to its versions
+		if release.Match != nil {
+			fields = append(fields, models.FieldError{Field: "match", Message: "isn't allowed in " + ModeShadow + " mode"})
+		}
+		if release.Segment != "" {
+			fields = append(fields, models.FieldError{Field: "segment", Message: "isn't allowed in " + ModeShadow + " mode"})
+		}
+		if release.Header != "" {
+			fields = append(fields, models.FieldError{Field: "header", Message: "isn't allowed in " + ModeShadow + " mode"})
+		}
+		if release.Rollout != nil {
+			fields = append(fields, models.FieldError{Field: "rollout", Message: "isn't allowed in " + ModeShadow + " mode"})
+		}
+		if release.MirrorPercent < 0 || release.MirrorPercent > 100 {
+			fields = append(fields, models.FieldError{Field: "mirrorPercent", Message: "must be between 1 and 100"})
+		}
+	default:
+		fields = append(fields, models.FieldError{Field: "mode", Message: fmt.Sprintf("must be %s or %s", ModeRouted, ModeShadow)})
+	}
+	switch release.Strategy {
+	case "":
+		if len(release.SmokeChecks) > 0 {
+			fields = append(fields, models.FieldError{Field: "smokeChecks", Message: "are only allowed with the " + StrategyBlueGreen + " strategy"})
+		}
+	case StrategyBlueGreen:
+		// a blue/green release only receives the requests carrying its id until it is switched
+		if release.Match != nil {
+			fields = append(fields, models.FieldError{Field: "match", Message: "isn't allowed with the " + StrategyBlueGreen + " strategy"})
+		}
+		if release.Segment != "" {
+			fields = append(fields, models.FieldError{Field: "segment", Message: "isn't allowed with the " + StrategyBlueGreen + " strategy"})
+		}
+		if release.Rollout != nil {
+			fields = append(fields, models.FieldError{Field: "rollout", Message: "isn't allowed with the " + StrategyBlueGreen + " strategy"})
+		}
+		if release.Mode == ModeShadow {
+			fields = append(fields, models.FieldError{Field: "mode", Message: "must be " + ModeRouted + " with the " + StrategyBlueGreen + " strategy"})
+		}
+		fields = append(fields, validateSmokeChecks(release)...)
+	default:
+		fields = append(fields, models.FieldError{Field: "strategy", Message: "must be " + StrategyBlueGreen + " or empty"})
+	}
+	if release.Match != nil && release.Segment != "" {
+		fields = append(fields, models.FieldError{Field: "segment", Message: "a release targets either a traffic segment or a match, not both"})
+	}
+	if release.Header != "" {
+		for _, message := range validation.IsHTTPHeaderName(release.Header) {
+			fields = append(fields, models.FieldError{Field: "header", Message: message})
+		}
+		if release.Header != strings.ToLower(release.Header) {
+			fields = append(fields, models.FieldError{Field: "header", Message: "must be lower case, as Istio matches headers"})
+		}
+		if release.Header == CookieHeader {
+			fields = append(fields, models.FieldError{Field: "header", Message: "can't carry the release id"})
+		}
+	}
+	if release.Match != nil {
+		fields = append(fields, validateMatch("match", *release.Match, ReleaseHeaderOf(release))...)
+	}
+	if err := ValidateRollout(release.Rollout); err != nil {
+		fields = append(fields, models.FieldError{Field: "rollout", Message: err.Error()})
+	}
+	for i, name := range release.Clusters {
+		field := fmt.Sprintf("clusters[%d]", i)
+		if _, ok := clusterConfig(name); !ok {
+			fields = append(fields, models.FieldError{Field: field, Message: fmt.Sprintf("cluster %s isn't configured", name)})
+		} else if containsString(release.Clusters[:i], name) {
+			fields = append(fields, models.FieldError{Field: field, Message: fmt.Sprintf("cluster %s is listed more than once", name)})
+		}
+	}
+	return fields
+}
+
+// validateSmokeChecks checks that the smoke checks of a release are complete and send requests to the release's apps
+func validateSmokeChecks(release models.Release) []models.FieldError {
+	fields := []models.FieldError{}
+	apps := []string{}
+	for _, app := range release.Apps {
+		apps = append(apps, app.Labels[AppLabel])
+	}
+	for i, check := range release.SmokeChecks {
+		field := fmt.Sprintf("smokeChecks[%d]", i)
+		if check.Name == "" {
+			fields = append(fields, models.FieldError{Field: field + ".name", Message: "is required"})
+		}
+		if !containsString(apps, check.App) {
+			fields = append(fields, models.FieldError{Field: field + ".app", Message: "must be an app of the release"})
+		}
+		if check.Port < 1 || check.Port > 65535 {
+			fields = append(fields, models.FieldError{Field: field + ".port", Message: "must be between 1 and 65535"})
+		}
+		if !strings.HasPrefix(check.Path, "/") {
+			fields = append(fields, models.FieldError{Field: field + ".path", Message: "must start with /"})
+		}
+		if check.Status != 0 && (check.Status < 100 || check.Status > 599) {
+			fields = append(fields, models.FieldError{Field: field + ".status", Message: "must be an HTTP status"})
+		}
+	}
+	return fields
+}
+
+// validateAppPolicies checks the timeout, retries and traffic policy of an app of a release
+func validateAppPolicies(field string, app models.App) []models.FieldError {
+	fields := validateDuration(field+".timeout", app.Timeout)
+	if app.Retries != nil {
+		if app.Retries.Attempts <= 0 {
+			fields = append(fields, models.FieldError{Field: field + ".retries.attempts", Message: "must be greater than 0"})
+		}
+		fields = append(fields, validateDuration(field+".retries.perTryTimeout", app.Retries.PerTryTimeout)...)
+	}
+	policy := app.TrafficPolicy
+	if policy == nil {
+		return fields
+	}
+	field += ".trafficPolicy"
+	if policy.ConnectionPool == nil && policy.OutlierDetection == nil {
+		fields = append(fields, models.FieldError{Field: field, Message: "a connection pool or an outlier detection is required"})
+	}
+	counts := map[string]int{}
+	if pool := policy.ConnectionPool; pool != nil {
+		if pool.TCP == nil && pool.HTTP == nil {
+			fields = append(fields, models.FieldError{Field: field + ".connectionPool", Message: "tcp or http settings are required"})
+		}
+		if pool.TCP != nil {
+			counts["connectionPool.tcp.maxConnections"] = pool.TCP.MaxConnections
+			fields = append(fields, validateDuration(field+".connectionPool.tcp.connectTimeout", pool.TCP.ConnectTimeout)...)
+		}
+		if pool.HTTP != nil {
+			counts["connectionPool.http.http1MaxPendingRequests"] = pool.HTTP.HTTP1MaxPendingRequests
+			counts["connectionPool.http.http2MaxRequests"] = pool.HTTP.HTTP2MaxRequests
+			counts["connectionPool.http.maxRequestsPerConnection"] = pool.HTTP.MaxRequestsPerConnection
+			counts["connectionPool.http.maxRetries"] = pool.HTTP.MaxRetries
+		}
+	}
+	if detection := policy.OutlierDetection; detection != nil {
+		counts["outlierDetection.consecutiveErrors"] = detection.ConsecutiveErrors
+		fields = append(fields, validateDuration(field+".outlierDetection.interval", detection.Interval)...)
+		fields = append(fields, validateDuration(field+".outlierDetection.baseEjectionTime", detection.BaseEjectionTime)...)
+		if detection.MaxEjectionPercent < 0 || detection.MaxEjectionPercent > 100 {
+			fields = append(fields, models.FieldError{Field: field + ".outlierDetection.maxEjectionPercent", Message: "must be between 0 and 100"})
+		}
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if counts[name] < 0 {
+			fields = append(fields, models.FieldError{Field: field + "." + name, Message: "can't be negative"})
+		}
+	}
+	return fields
+}
+
+// validateDuration checks that an optional duration, e.g. "1.5s", is positive
+func validateDuration(field string, value string) []models.FieldError {
+	if value == "" {
+		return nil
+	}
+	if duration, err := time.ParseDuration(value); err != nil || duration <= 0 {
+		return []models.FieldError{{Field: field, Message: "must be a positive duration, e.g. 1.5s"}}
+	}
+	return nil
+}
+
+// ValidateTrafficSegment checks that a traffic segment is complete and well formed.
+// It returns the invalid fields, or an empty list if the traffic segment is valid.
+func ValidateTrafficSegment(segment models.TrafficSegment) []models.FieldError {
+	fields := []models.FieldError{}
+	if segment.ID == "" {
+		fields = append(fields, models.FieldError{Field: "id", Message: "is required"})
+	} else {
+		for _, message := range validation.IsDNS1123Label(segment.ID) {
+			fields = append(fields, models.FieldError{Field: "id", Message: message})
+		}
+	}
+	if segment.Match == nil {
+		return append(fields, models.FieldError{Field: "match", Message: "is required"})
+	}
+	if IsEmptyMatch(*segment.Match) {
+		fields = append(fields, models.FieldError{Field: "match", Message: "at least one condition is required"})
+	}
+	return append(fields, validateMatch("match", *segment.Match, ReleaseHeader)...)
+}
+
+// requestAttributes are the fields of a match matching a single attribute of the request, in the order validateMatch checks them
+var requestAttributes = []string{"uri", "scheme", "method", "authority"}
+
+// validateMatch checks that every condition of a match is well formed and leaves the header carrying the release id alone
+func validateMatch(field string, match models.HttpMatch, releaseHeader string) []models.FieldError {
+	fields := []models.FieldError{}
+	for _, name := range sortedStringMatchKeys(match.Headers) {
+		if name == releaseHeader {
+			fields = append(fields, models.FieldError{Field: field + ".headers." + name, Message: "is the header canary propagates the release with"})
+			continue
+		}
+		if name == CookieHeader && len(match.Cookies) > 0 {
+			fields = append(fields, models.FieldError{Field: field + ".headers." + name, Message: "can't be matched together with cookies"})
+			continue
+		}
+		fields = append(fields, validateStringMatch(field+".headers."+name, match.Headers[name])...)
+	}
+	if len(match.Cookies) > 1 {
+		fields = append(fields, models.FieldError{Field: field + ".cookies", Message: "at most one cookie can be matched"})
+	}
+	for _, name := range sortedStringMatchKeys(match.Cookies) {
+		fields = append(fields, validateStringMatch(field+".cookies."+name, match.Cookies[name])...)
+	}
+	for _, name := range sortedStringMatchKeys(match.Claims) {
+		fields = append(fields, validateStringMatch(field+".claims."+name, match.Claims[name])...)
+	}
+	if bucket := match.Bucket; bucket != nil {
+		if bucket.Header == "" {
+			fields = append(fields, models.FieldError{Field: field + ".bucket.header", Message: "is required"})
+		} else if _, ok := match.Headers[bucket.Header]; ok || bucket.Header == releaseHeader || bucket.Header == CookieHeader {
+			fields = append(fields, models.FieldError{Field: field + ".bucket.header", Message: "is already matched"})
+		}
+		if bucket.Percent < 1 || bucket.Percent > 100 {
+			fields = append(fields, models.FieldError{Field: field + ".bucket.percent", Message: "must be between 1 and 100"})
+		}
+	}
+	for i, value := range []*models.StringMatch{match.Uri, match.Scheme, match.Method, match.Authority} {
+		if value != nil {
+			fields = append(fields, validateStringMatch(field+"."+requestAttributes[i], value)...)
+		}
+	}
+	for _, name := range sortedStringMatchKeys(match.QueryParams) {
+		fields = append(fields, validateStringMatch(field+".queryParams."+name, match.QueryParams[name])...)
+	}
+	if match.Port > 65535 {
+		fields = append(fields, models.FieldError{Field: field + ".port", Message: "must be between 1 and 65535"})
+	}
+	for i, gateway := range match.Gateways {
+		if gateway == "" {
+			fields = append(fields, models.FieldError{Field: fmt.Sprintf("%s.gateways[%d]", field, i), Message: "is required"})
+		}
+	}
+	return fields
+}
+
+func validateStringMatch(field string, match *models.StringMatch) []models.FieldError {
+	if match == nil || countNonEmpty(match.Exact, match.Prefix, match.Regex) != 1 {
+		return []models.FieldError{{Field: field, Message: "exactly one of exact, prefix or regex is required"}}
+	}
+	return nil
+}
+
+func sortedStringMatchKeys(matches map[string]*models.StringMatch) []string {
+	keys := make([]string, 0, len(matches))
+	for key := range matches {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ValidateReleaseInCluster checks that the objects a release refers to exist in the namespace:
+// a Service for every app, no DestinationRule subset named after a version selecting another one,
+// a managed Gateway for every gateway host, the traffic segment the release targets,
+// and, for a new release, that no other release uses its id.
+// The release must have been validated with ValidateRelease.
+// It returns the invalid fields, or an empty list if the release is valid, and an error on any problem reading the cluster.
+func ValidateReleaseInCluster(client kubernetes.IstioClientInterface, namespace string, release models.Release, create bool) ([]models.FieldError, error) {
+	return ValidateReleaseInClusters(client, []Cluster{{Client: client}}, namespace, release, create)
+}
+
+// ValidateReleaseInClusters is ValidateReleaseInCluster for a release applied to several clusters.
+// The stored releases and the traffic segments are read from the cluster canary runs in, with local,
+// the services, subsets, gateways and releases of the VirtualServices from every cluster of the release.
+func ValidateReleaseInClusters(local kubernetes.IstioClientInterface, clusters []Cluster, namespace string, release models.Release, create bool) ([]models.FieldError, error) {
+	fields := []models.FieldError{}
+
+	exists := false
+	if create {
+		stored, err := NewConfigMapStore(local).Get(namespace, release.ID)
+		if err != nil {
+			return nil, err
+		}
+		exists = stored != nil
+	}
+	if release.Segment != "" {
+		segment, err := NewConfigMapSegmentStore(local).Get(namespace, release.Segment)
+		if err != nil {
+			return nil, err
+		}
+		if segment == nil {
+			fields = append(fields, models.FieldError{Field: "segment", Message: fmt.Sprintf("traffic segment %s not found", release.Segment)})
+		}
+	}
+
+	for _, cluster := range clusters {
+		clusterFields := []models.FieldError{}
+		if create || release.Mode == ModeShadow {
+			managed, err := GetManagedVirtualServices(cluster.Client, namespace)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := Releases(managed)[release.ID]; ok && create {
+				exists = true
+			}
+			if release.Mode == ModeShadow {
+				clusterFields = append(clusterFields, validateMirrors(managed, release)...)
+			}
+		}
+		appFields, err := validateAppsInCluster(cluster.Client, namespace, release)
+		if err != nil {
+			return nil, err
+		}
+		clusterFields = append(clusterFields, appFields...)
+		for _, field := range clusterFields {
+			if cluster.Name != "" {
+				field.Message = fmt.Sprintf("in cluster %s, %s", cluster.Name, field.Message)
+			}
+			fields = append(fields, field)
+		}
+	}
+	if exists {
+		fields = append([]models.FieldError{{Field: "id", Message: fmt.Sprintf("release %s already exists", release.ID)}}, fields...)
+	}
+	return fields, nil
+}
+
+// validateAppsInCluster checks that the apps and the gateway hosts of a release exist in a cluster
+func validateAppsInCluster(client kubernetes.IstioClientInterface, namespace string, release models.Release) ([]models.FieldError, error) {
+	fields := []models.FieldError{}
+	destinationRules, err := client.GetDestinationRules(namespace, "")
+	if err != nil {
+		return nil, err
+	}
+	for i, app := range release.Apps {
+		field := fmt.Sprintf("apps[%d]", i)
+		name, version := app.Labels[AppLabel], app.Labels[VersionLabel]
+		if missing, err := missingService(client, namespace, name); err != nil {
+			return nil, err
+		} else if missing != "" {
+			fields = append(fields, models.FieldError{Field: field + ".labels." + AppLabel, Message: missing})
+			continue
+		}
+		for j, host := range app.Hosts {
+			if missing, err := missingService(client, namespace, host); err != nil {
+				return nil, err
+			} else if missing != "" {
+				fields = append(fields, models.FieldError{Field: fmt.Sprintf("%s.hosts[%d]", field, j), Message: missing})
+			}
+		}
+		// the release routes to the subset named after the version, AddSubsets adds it if it's missing
+		subsets := []string{}
+		for _, destinationRule := range destinationRules {
+			if isServiceDestinationRule(destinationRule, namespace, name) {
+				host := destinationRuleHost(destinationRule).(string)
+				subsets = append(subsets, kubernetes.GetDestinationRulesSubsets([]kubernetes.IstioObject{destinationRule}, host, version)...)
+			}
+		}
+		if !containsString(subsets, version) && hasSubset(destinationRules, namespace, name, version) {
+			fields = append(fields, models.FieldError{
+				Field:   field + ".labels." + VersionLabel,
+				Message: fmt.Sprintf("the subset %s of %s doesn't select version %s", version, name, version),
+			})
+		}
+		// AddSubsets doesn't replace a traffic policy canary didn't set
+		if app.TrafficPolicy != nil {
+			for _, destinationRule := range destinationRules {
+				if isServiceDestinationRule(destinationRule, namespace, name) && unmanagedPolicy(destinationRule, version) {
+					fields = append(fields, models.FieldError{
+						Field:   field + ".trafficPolicy",
+						Message: fmt.Sprintf("the subset %s of %s already has a traffic policy", version, name),
+					})
+					break
+				}
+			}
+		}
+	}
+
+	gatewayObjects, err := client.GetGateways(namespace)
+	if err != nil {
+		return nil, err
+	}
+	gateways, err := ManagedGateways(gatewayObjects)
+	if err != nil {
+		return nil, err
+	}
+	for i, host := range release.Gateway.Hosts {
+		if !servedByGateway(gateways, host) {
+			fields = append(fields, models.FieldError{
+				Field:   fmt.Sprintf("gateway.hosts[%d]", i),
+				Message: fmt.Sprintf("no gateway managed by canary serves %s", host),
+			})
+		}
+	}
+	return fields, nil
+}
+
+// validateMirrors checks that the rules routing to the apps of a shadow release don't mirror their requests already,
+// as a rule has a single mirror
+func validateMirrors(managed []*VirtualService, release models.Release) []models.FieldError {
+	fields := []models.FieldError{}
+	for i, app := range release.Apps {
+		name := app.Labels[AppLabel]
+		for _, vs := range managed {
+			if mirror := vs.mirrorOf(name, release.ID); mirror != "" {
+				fields = append(fields, models.FieldError{
+					Field:   fmt.Sprintf("apps[%d].labels.%s", i, AppLabel),
+					Message: fmt.Sprintf("the requests of %s are already mirrored to %s by virtual service %s", name, mirror, vs.Name),
+				})
+				break
+			}
+		}
+	}
+	return fields
+}
+
+// missingService returns why a host doesn't resolve to a Service, or an empty string if it does
+func missingService(client kubernetes.IstioClientInterface, namespace string, host string) (string, error) {
+	name, serviceNamespace, ok := serviceOfHost(host, namespace)
+	if !ok {
+		return fmt.Sprintf("%s isn't the host of a Kubernetes service", host), nil
+	}
+	_, err := client.GetService(serviceNamespace, name)
+	if errors.IsNotFound(err) {
+		return fmt.Sprintf("service %s not found in namespace %s", name, serviceNamespace), nil
+	}
+	return "", err
+}
+
+// serviceOfHost returns the name and namespace of the Service a host resolves to:
+// a short name in the namespace, name.namespace or name.namespace.svc[.domain]
+func serviceOfHost(host string, namespace string) (string, string, bool) {
+	parts := strings.Split(host, ".")
+	switch {
+	case len(parts) == 1:
+		return parts[0], namespace, true
+	case len(parts) == 2 || parts[2] == "svc":
+		return parts[0], parts[1], true
+	}
+	return "", "", false
+}
+
+// hasSubset returns true if a DestinationRule of the service of the namespace has a subset with the name
+func hasSubset(destinationRules []kubernetes.IstioObject, namespace string, service string, name string) bool {
+	for _, destinationRule := range destinationRules {
+		subsets, _ := destinationRule.GetSpec()["subsets"].([]interface{})
+		if isServiceDestinationRule(destinationRule, namespace, service) && subsetIndex(subsets, name) != -1 {
+			return true
+		}
+	}
+	return false
+}
+
+// destinationRuleHost returns the service of a DestinationRule, from host or from name for older DestinationRules
+func destinationRuleHost(destinationRule kubernetes.IstioObject) interface{} {
+	spec := destinationRule.GetSpec()
+	if host, ok := spec["host"]; ok {
+		return host
+	}
+	return spec["name"]
+}
+
+func servedByGateway(gateways []*Gateway, host string) bool {
+	for _, gateway := range gateways {
+		for _, server := range gateway.Spec.Servers {
+			for _, served := range server.Hosts {
+				if served == host || served == "*" || (strings.HasPrefix(served, "*.") && strings.HasSuffix(host, served[1:])) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func countNonEmpty(values ...string) int {
+	count := 0
+	for _, value := range values {
+		if value != "" {
+			count++
+		}
+	}
+	return count
+}
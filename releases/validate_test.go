@@ -0,0 +1,137 @@
+package releases
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/devtio/canary/config"
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/models"
+)
+
+// clusterClient serves the service a, its DestinationRule and a managed gateway
+type clusterClient struct {
+	kubernetes.IstioClientInterface
+}
+
+func (in *clusterClient) GetService(namespace string, name string) (*v1.Service, error) {
+	if name != "a" {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "services"}, name)
+	}
+	return &v1.Service{}, nil
+}
+
+func (in *clusterClient) GetDestinationRules(namespace string, serviceName string) ([]kubernetes.IstioObject, error) {
+	return []kubernetes.IstioObject{&kubernetes.DestinationRule{
+		Spec: map[string]interface{}{
+			"host": "a",
+			"subsets": []interface{}{
+				map[string]interface{}{"name": "v1", "labels": map[string]interface{}{"version": "v1"}},
+				map[string]interface{}{"name": "v2", "labels": map[string]interface{}{"version": "v2"}},
+				map[string]interface{}{"name": "v4", "labels": map[string]interface{}{"version": "other"}},
+			},
+		},
+	}}, nil
+}
+
+func (in *clusterClient) GetGateways(namespace string) ([]kubernetes.IstioObject, error) {
+	return []kubernetes.IstioObject{&kubernetes.Gateway{
+		ObjectMeta: managedMeta("dummy-gateway"),
+		Spec: map[string]interface{}{
+			"servers": []interface{}{
+				map[string]interface{}{"hosts": []interface{}{"dummy.example.com"}},
+			},
+		},
+	}}, nil
+}
+
+func (in *clusterClient) GetVirtualServices(namespace string, serviceName string) ([]kubernetes.IstioObject, error) {
+	app, _ := ParseVirtualService(appVirtualService())
+	release := testRelease()
+	release.ID = "existing"
+	AddRelease(app, release)
+	object, _ := app.IstioObject()
+	return []kubernetes.IstioObject{object}, nil
+}
+
+func (in *clusterClient) GetConfigMap(namespace string, name string) (*v1.ConfigMap, error) {
+	return nil, errors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+}
+
+func TestValidateRelease(t *testing.T) {
+	assert.Empty(t, ValidateRelease(testRelease()))
+
+	release := testRelease()
+	release.ID = "Release_1"
+	release.Apps = append(release.Apps, models.App{Labels: models.Labels{AppLabel: "b"}})
+	release.Match.Headers[ReleaseHeader] = &models.StringMatch{Exact: "other"}
+	fields := []string{}
+	for _, field := range ValidateRelease(release) {
+		fields = append(fields, field.Field)
+	}
+	assert.Equal(t, []string{"id", "apps[1].hosts", "apps[1].labels.version", "match.headers.devtio"}, fields)
+
+	shadow := testRelease()
+	shadow.Mode = ModeShadow
+	shadow.MirrorPercent = 150
+	shadow.Rollout = &models.RolloutPlan{Steps: []models.RolloutStep{{Weight: 100}}}
+	fields = []string{}
+	for _, field := range ValidateRelease(shadow) {
+		fields = append(fields, field.Field)
+	}
+	assert.Equal(t, []string{"match", "rollout", "mirrorPercent"}, fields)
+
+	fenced := testRelease()
+	fenced.Apps[0].Timeout = "2s"
+	fenced.Apps[0].Retries = &models.Retries{Attempts: 3, PerTryTimeout: "500ms"}
+	fenced.Apps[0].TrafficPolicy = &models.TrafficPolicy{OutlierDetection: &models.OutlierDetection{ConsecutiveErrors: 2, Interval: "10s"}}
+	assert.Empty(t, ValidateRelease(fenced))
+	fenced.Apps[0].Timeout = "2"
+	fenced.Apps[0].Retries.Attempts = 0
+	fenced.Apps[0].TrafficPolicy.ConnectionPool = &models.ConnectionPool{TCP: &models.TCPSettings{MaxConnections: -1}}
+	fenced.Apps[0].TrafficPolicy.OutlierDetection.MaxEjectionPercent = 101
+	fields = []string{}
+	for _, field := range ValidateRelease(fenced) {
+		fields = append(fields, field.Field)
+	}
+	assert.Equal(t, []string{
+		"apps[0].timeout",
+		"apps[0].retries.attempts",
+		"apps[0].trafficPolicy.outlierDetection.maxEjectionPercent",
+		"apps[0].trafficPolicy.connectionPool.tcp.maxConnections",
+	}, fields)
+}
+
+func TestValidateReleaseInCluster(t *testing.T) {
+	config.Set(config.NewConfig())
+	client := &clusterClient{}
+
+	fields, err := ValidateReleaseInCluster(client, "dummy", testRelease(), true)
+	assert.NoError(t, err)
+	assert.Empty(t, fields)
+
+	release := testRelease()
+	release.ID = "existing"
+	release.Gateway.Hosts = []string{"other.example.com"}
+	release.Apps = append(release.Apps,
+		models.App{Hosts: []string{"a"}, Labels: models.Labels{AppLabel: "a", VersionLabel: "v3"}},
+		models.App{Hosts: []string{"a"}, Labels: models.Labels{AppLabel: "a", VersionLabel: "v4"}},
+		models.App{Hosts: []string{"b.dummy.svc.cluster.local"}, Labels: models.Labels{AppLabel: "a", VersionLabel: "v1"}},
+	)
+	fields, err = ValidateReleaseInCluster(client, "dummy", release, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.FieldError{
+		{Field: "id", Message: "release existing already exists"},
+		{Field: "apps[2].labels.version", Message: "the subset v4 of a doesn't select version v4"},
+		{Field: "apps[3].hosts[0]", Message: "service b not found in namespace dummy"},
+		{Field: "gateway.hosts[0]", Message: "no gateway managed by canary serves other.example.com"},
+	}, fields)
+
+	fields, err = ValidateReleaseInCluster(client, "dummy", release, false)
+	assert.NoError(t, err)
+	assert.Len(t, fields, 3)
+}
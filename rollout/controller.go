@@ -0,0 +1,419 @@
+package rollout
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/devtio/canary/config"
+	"github.com/devtio/canary/kubernetes"
+	"github.com/devtio/canary/log"
+	"github.com/devtio/canary/models"
+	"github.com/devtio/canary/prometheus"
+	"github.com/devtio/canary/releases"
+)
+
+// Controller periodically moves the releases of every namespace to the next step of their rollout plan
+// once the dwell time of their current step is over, and their analysis passed.
+// A release failing its analysis is rolled back, a release whose next step requires an approval waits for it.
+// It also runs the actions scheduled on the releases once they are due.
+// During a maintenance window of a namespace, its rollouts and scheduled actions wait for the end of the window,
+// releases failing their analysis are still rolled back.
+type Controller struct {
+	interval   time.Duration
+	prometheus prometheus.Querier
+	stop       chan bool
+}
+
+// NewController creates a controller checking the rollouts at the interval of the global configuration.
+// Start and Stop it with the corresponding functions.
+func NewController() *Controller {
+	interval := config.Get().Rollout.Interval
+	if interval <= 0 {
+		interval = 10
+	}
+	return &Controller{
+		interval:   time.Duration(interval) * time.Second,
+		prometheus: prometheus.NewClient(config.Get().Products.PrometheusServiceURL),
+		stop:       make(chan bool),
+	}
+}
+
+// Start checking the rollouts asynchronously
+func (c *Controller) Start() {
+	log.Infof("Rollout controller will check releases every [%v]", c.interval)
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.advance(time.Now())
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop checking the rollouts
+func (c *Controller) Stop() {
+	log.Info("Rollout controller will stop")
+	close(c.stop)
+}
+
+// advance moves every release that is due to its next step
+func (c *Controller) advance(now time.Time) {
+	client, err := kubernetes.GetClient()
+	if err != nil {
+		log.Errorf("Rollout controller can't create a client: %v", err)
+		return
+	}
+	namespaces, err := client.GetNamespaces()
+	if err != nil {
+		log.Errorf("Rollout controller can't list namespaces: %v", err)
+		return
+	}
+	store := releases.NewConfigMapStore(client)
+	for _, namespace := range namespaces.Items {
+		windows, err := releases.NewConfigMapWindowStore(client).List(namespace.Name)
+		if err != nil {
+			log.Errorf("Rollout controller can't read the maintenance windows of namespace %s: %v", namespace.Name, err)
+			continue
+		}
+		window, _ := releases.ActiveWindow(windows, now)
+		// expired experiments are removed even during a maintenance window, as they only remove faults
+		c.reapExperiments(client, namespace.Name, now)
+		c.runScheduled(client, store, namespace.Name, window, now)
+
+		stored, err := store.List(namespace.Name)
+		if err != nil {
+			log.Errorf("Rollout controller can't read the releases of namespace %s: %v", namespace.Name, err)
+			continue
+		}
+		for _, release := range stored {
+			if releases.IsDeploying(release) {
+				if err := c.startDeployed(client, namespace.Name, release, window, now); err != nil {
+					log.Errorf("Release %s/%s can't be started once its deployments are ready: %v", namespace.Name, release.ID, err)
+				}
+				continue
+			}
+			if !releases.IsDue(release, now) {
+				continue
+			}
+			if err := c.advanceRelease(client, store, namespace.Name, release, window, now); err != nil {
+				log.Errorf("Release %s/%s rollout can't be advanced: %v", namespace.Name, release.ID, err)
+			}
+		}
+	}
+}
+
+// runScheduled runs the actions of a namespace that are due, unless the namespace is in a maintenance window.
+// An action is run once, it is removed from the schedule even if it fails.
+func (c *Controller) runScheduled(client kubernetes.IstioClientInterface, store releases.Store, namespace string, window *models.MaintenanceWindow, now time.Time) {
+	schedule := releases.NewConfigMapScheduleStore(client)
+	actions, err := schedule.List(namespace)
+	if err != nil {
+		log.Errorf("Rollout controller can't read the scheduled actions of namespace %s: %v", namespace, err)
+		return
+	}
+	for _, action := range releases.DueActions(actions, now) {
+		if window != nil && !action.Force {
+			log.Debugf("Scheduled action %s/%s waits for the end of maintenance window %s", namespace, action.ID, window.ID)
+			continue
+		}
+		if err := c.runAction(client, store, namespace, action, now); err != nil {
+			log.Errorf("Scheduled action %s/%s failed: %v", namespace, action.ID, err)
+		}
+		if err := schedule.Delete(namespace, action.ID); err != nil {
+			log.Errorf("Scheduled action %s/%s can't be removed from the schedule: %v", namespace, action.ID, err)
+		}
+	}
+}
+
+// reapExperiments removes the faults of the experiments of a namespace that expired, recording it in the history of their releases
+func (c *Controller) reapExperiments(client kubernetes.IstioClientInterface, namespace string, now time.Time) {
+	experiments, err := releases.NewConfigMapExperimentStore(client).List(namespace)
+	if err != nil {
+		log.Errorf("Rollout controller can't read the experiments of namespace %s: %v", namespace, err)
+		return
+	}
+	history := releases.NewConfigMapHistory(client)
+	for _, experiment := range releases.ExpiredExperiments(experiments, now) {
+		changes, err := releases.EndExperiment(client, namespace, experiment)
+		if err != nil {
+			log.Errorf("Experiment %s/%s can't be removed: %v", namespace, experiment.ID, err)
+		}
+		for _, releaseID := range experiment.Releases {
+			event := releases.NewEvent(releases.ActionFaultsRemoved, releases.ControllerUser, changes, err)
+			if err == nil {
+				event.Message = fmt.Sprintf("Experiment %s expired", experiment.ID)
+			}
+			recordEvent(history, namespace, releaseID, event)
+		}
+	}
+}
+
+// runAction starts, advances or promotes a release as scheduled, recording what it did in the history of the release.
+// It returns an error on any problem.
+func (c *Controller) runAction(client kubernetes.IstioClientInterface, store releases.Store, namespace string, action models.ScheduledAction, now time.Time) error {
+	history := releases.NewConfigMapHistory(client)
+	user := action.User
+	if user == "" {
+		user = releases.ControllerUser
+	}
+	if action.Action == releases.ScheduleStart {
+		result, err := startRelease(client, namespace, *action.Release, now)
+		event := releases.NewEvent(releases.ActionCreated, user, result.VirtualServices, err)
+		if err == nil && releases.IsDeploying(result.Release) {
+			event.Message = "Started as scheduled, waits for its deployments"
+			log.Infof("Release %s/%s started as scheduled, waits for its deployments", namespace, action.ReleaseID)
+		} else if err == nil {
+			event.Message = "Started as scheduled"
+			log.Infof("Release %s/%s started as scheduled", namespace, action.ReleaseID)
+		}
+		recordEvent(history, namespace, action.ReleaseID, event)
+		return err
+	}
+	if action.Action == releases.SchedulePromote {
+		result, err := promoteRelease(client, store, namespace, action.ReleaseID)
+		event := releases.NewEvent(releases.ActionPromoted, user, result.VirtualServices, err)
+		if err == nil {
+			event.Message = "Promoted as scheduled"
+			log.Infof("Release %s/%s promoted as scheduled", namespace, action.ReleaseID)
+		}
+		recordEvent(history, namespace, action.ReleaseID, event)
+		return err
+	}
+
+	release, err := store.Get(namespace, action.ReleaseID)
+	if err != nil {
+		return err
+	}
+	step := 0
+	if release == nil {
+		err = fmt.Errorf("release %s has no rollout plan", action.ReleaseID)
+	} else {
+		step, err = releases.ScheduledStep(*release)
+	}
+	if err != nil {
+		recordEvent(history, namespace, action.ReleaseID, releases.NewEvent(releases.ActionAdvanced, user, nil, err))
+		return err
+	}
+	clusters, err := releases.ReleaseClusters(*release, client)
+	if err != nil {
+		return err
+	}
+	if reason, err := releases.DeploymentsReady(clusters, namespace, *release); err != nil || reason != "" {
+		if err == nil {
+			err = fmt.Errorf("release %s waits for its deployments: %s", action.ReleaseID, reason)
+		}
+		recordEvent(history, namespace, action.ReleaseID, releases.NewEvent(releases.ActionAdvanced, user, nil, err))
+		return err
+	}
+	releases.MoveToStep(release, step, now)
+	return applyStep(history, store, clusters, namespace, *release, user)
+}
+
+// startRelease validates a release scheduled to start in the namespace as CreateRelease does, and creates it,
+// or creates its Deployments and holds it until they are ready when it has some.
+// It returns the outcome of the change, and an error on any problem, the error lists the invalid fields of an invalid release.
+func startRelease(client kubernetes.IstioClientInterface, namespace string, release models.Release, now time.Time) (models.ReleaseResult, error) {
+	result := models.ReleaseResult{Release: release}
+	deployments := release.Deployments
+	release.Deployments = nil
+	fields := releases.ValidateRelease(release)
+	var clusters []releases.Cluster
+	if len(fields) == 0 {
+		var err error
+		if clusters, err = releases.ReleaseClusters(release, client); err != nil {
+			return result, err
+		}
+		if fields, err = releases.ValidateReleaseInClusters(client, clusters, namespace, release, true); err != nil {
+			return result, err
+		}
+		if len(deployments) > 0 {
+			fields = append(fields, releases.ValidateDeployments(release, deployments)...)
+		}
+	}
+	if len(fields) > 0 {
+		messages := []string{}
+		for _, field := range fields {
+			messages = append(messages, field.Field+" "+field.Message)
+		}
+		return result, fmt.Errorf("release is invalid: %s", strings.Join(messages, ", "))
+	}
+	if err := releases.ResolveSegment(releases.NewConfigMapSegmentStore(client), namespace, &release); err != nil {
+		return result, err
+	}
+	if len(deployments) > 0 {
+		return releases.Deploy(client, clusters, namespace, release, deployments)
+	}
+	releases.StartRollout(&release, now)
+	return releases.Create(client, clusters, namespace, release)
+}
+
+// startDeployed creates a release held until the Deployments canary created for it are ready, once they are,
+// recording it in the history of the release. A release waits for the end of a maintenance window to be created.
+// It returns an error on any problem.
+func (c *Controller) startDeployed(client kubernetes.IstioClientInterface, namespace string, release models.Release, window *models.MaintenanceWindow, now time.Time) error {
+	if window != nil {
+		log.Debugf("Release %s/%s waits for the end of maintenance window %s", namespace, release.ID, window.ID)
+		return nil
+	}
+	clusters, err := releases.ReleaseClusters(release, client)
+	if err != nil {
+		return err
+	}
+	if reason, err := releases.DeploymentsReady(clusters, namespace, release); err != nil {
+		return err
+	} else if reason != "" {
+		log.Debugf("Release %s/%s waits for its deployments: %s", namespace, release.ID, reason)
+		return nil
+	}
+	result, err := releases.StartDeployed(client, clusters, namespace, release, now)
+	event := releases.NewEvent(releases.ActionCreated, releases.ControllerUser, result.VirtualServices, err)
+	if err == nil {
+		event.Message = "Created once its deployments were ready"
+		log.Infof("Release %s/%s created once its deployments were ready", namespace, release.ID)
+	}
+	recordEvent(releases.NewConfigMapHistory(client), namespace, release.ID, event)
+	return err
+}
+
+// promoteRelease promotes a release of the namespace as PromoteRelease does, keeping the subsets of the versions replaced.
+// It returns the outcome of the change, and an error on any problem.
+func promoteRelease(client kubernetes.IstioClientInterface, store releases.Store, namespace string, releaseID string) (models.ReleaseResult, error) {
+	result := models.ReleaseResult{}
+	managed, err := releases.GetManagedVirtualServices(client, namespace)
+	if err != nil {
+		return result, err
+	}
+	stored, err := store.List(namespace)
+	if err != nil {
+		return result, err
+	}
+	release, ok := releases.WithStatus(releases.Releases(managed), stored)[releaseID]
+	if !ok {
+		return result, fmt.Errorf("release %s not found", releaseID)
+	}
+	result.Release = release
+	if err := releases.CanPromote(release); err != nil {
+		return result, err
+	}
+	clusters, err := releases.ReleaseClusters(release, client)
+	if err != nil {
+		return result, err
+	}
+	if reason, err := releases.DeploymentsReady(clusters, namespace, release); err != nil {
+		return result, err
+	} else if reason != "" {
+		return result, fmt.Errorf("release %s waits for its deployments: %s", releaseID, reason)
+	}
+	return releases.Promote(client, clusters, namespace, release, false)
+}
+
+// advanceRelease analyzes the release and moves it to its next step or rolls it back, recording what it did in the history.
+// During a maintenance window, a release passing its analysis stays on its current step,
+// and a release stays on its current step until the Deployments canary created for it are ready.
+// It returns an error on any problem.
+func (c *Controller) advanceRelease(client kubernetes.IstioClientInterface, store releases.Store, namespace string, release models.Release, window *models.MaintenanceWindow, now time.Time) error {
+	history := releases.NewConfigMapHistory(client)
+	clusters, err := releases.ReleaseClusters(release, client)
+	if err != nil {
+		return err
+	}
+	if reason, err := releases.DeploymentsReady(clusters, namespace, release); err != nil {
+		return err
+	} else if reason != "" {
+		log.Debugf("Release %s/%s waits for its deployments: %s", namespace, release.ID, reason)
+		return nil
+	}
+	if release.Rollout.Analysis != nil {
+		verdicts := append([]models.Verdict(nil), release.Status.Verdicts...)
+		outcome, err := releases.AnalyzeClusters(clusters, c.querier, namespace, &release, now)
+		if err != nil {
+			return err
+		}
+		log.Infof("Release %s/%s analysis of step %d: %s", namespace, release.ID, release.Status.Step, outcome)
+		switch outcome {
+		case releases.VerdictFailed:
+			// a release failing in one cluster is rolled back from all of them
+			statuses, changes, err := releases.Rollback(clusters, namespace, release)
+			event := releases.NewEvent(releases.ActionRolledBack, releases.ControllerUser, changes, err)
+			if err == nil {
+				event.Message = fmt.Sprintf("Analysis of step %d failed", release.Status.Step)
+			}
+			recordEvent(history, namespace, release.ID, event)
+			if err != nil {
+				return err
+			}
+			releases.RemoveClusterSubsets(clusters, namespace, release)
+			releases.DeleteDeployments(clusters, namespace, release)
+			release.Deployments = nil
+			releases.SetClusterStatuses(&release, statuses)
+			release.Status.Phase = releases.PhaseRolledBack
+			release.Status.NextStepAt = nil
+			return store.Put(namespace, release)
+		case releases.VerdictInconclusive:
+			// stay on the current step until there is enough traffic to judge the release,
+			// the release is only stored again when its verdicts changed
+			if reflect.DeepEqual(verdicts, release.Status.Verdicts) {
+				return nil
+			}
+			return store.Put(namespace, release)
+		}
+	}
+
+	if window != nil {
+		log.Debugf("Release %s/%s waits for the end of maintenance window %s", namespace, release.ID, window.ID)
+		return nil
+	}
+	if releases.NeedsApproval(release) {
+		releases.AwaitApproval(&release)
+		event := releases.NewEvent(releases.ActionPaused, releases.ControllerUser, nil, nil)
+		event.Message = fmt.Sprintf("Step %d awaits approval", release.Status.Step+1)
+		recordEvent(history, namespace, release.ID, event)
+		log.Infof("Release %s/%s awaits approval of step %d", namespace, release.ID, release.Status.Step+1)
+		return store.Put(namespace, release)
+	}
+	releases.NextStep(&release, now)
+	return applyStep(history, store, clusters, namespace, release, releases.ControllerUser)
+}
+
+// applyStep sends the weight of the current step of the release to its versions in its clusters and stores its progress,
+// recording it in the history of the release as done by user.
+// It returns an error on any problem.
+func applyStep(history releases.History, store releases.Store, clusters []releases.Cluster, namespace string, release models.Release, user string) error {
+	statuses, changes, err := releases.ApplyWeight(clusters, namespace, release, release.Status.Weight)
+	event := releases.NewEvent(releases.ActionAdvanced, user, changes, err)
+	if err == nil {
+		event.Message = fmt.Sprintf("Moved to step %d, %d%% of the traffic", release.Status.Step, release.Status.Weight)
+	}
+	recordEvent(history, namespace, release.ID, event)
+	if err != nil {
+		return err
+	}
+	releases.SetClusterStatuses(&release, statuses)
+	if err := store.Put(namespace, release); err != nil {
+		return err
+	}
+	log.Infof("Release %s/%s moved to step %d, %d%% of the traffic", namespace, release.ID, release.Status.Step, release.Status.Weight)
+	return nil
+}
+
+// querier returns the Prometheus the analysis queries in a cluster
+func (c *Controller) querier(cluster releases.Cluster) prometheus.Querier {
+	if cluster.PrometheusURL == "" || cluster.PrometheusURL == config.Get().Products.PrometheusServiceURL {
+		return c.prometheus
+	}
+	return prometheus.NewClient(cluster.PrometheusURL)
+}
+
+// recordEvent appends an event to the history of a release, failing to do so doesn't stop the rollout
+func recordEvent(history releases.History, namespace string, releaseID string, event models.ReleaseEvent) {
+	if err := history.Record(namespace, releaseID, event); err != nil {
+		log.Errorf("Release %s/%s history can't be recorded: %v", namespace, releaseID, err)
+	}
+}
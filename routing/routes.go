@@ -60,6 +60,150 @@ func NewRoutes() (r *Routes) {
 			"/api/pods/{namespace}",
 			handlers.ListGateways,
 		},
+		{
+			"ListReleases",
+			"GET",
+			"/api/releases/{namespace}",
+			handlers.ListReleases,
+		},
+		{
+			"CreateRelease",
+			"POST",
+			"/api/releases/{namespace}",
+			handlers.CreateRelease,
+		},
+		{
+			"GetRelease",
+			"GET",
+			"/api/releases/{namespace}/{releaseId}",
+			handlers.GetRelease,
+		},
+		{
+			"UpdateRelease",
+			"PUT",
+			"/api/releases/{namespace}/{releaseId}",
+			handlers.UpdateRelease,
+		},
+		{
+			"DeleteRelease",
+			"DELETE",
+			"/api/releases/{namespace}/{releaseId}",
+			handlers.DeleteRelease,
+		},
+		{
+			"RollbackRelease",
+			"POST",
+			"/api/releases/{namespace}/{releaseId}/rollback",
+			handlers.RollbackRelease,
+		},
+		{
+			"PromoteRelease",
+			"POST",
+			"/api/releases/{namespace}/{releaseId}/promote",
+			handlers.PromoteRelease,
+		},
+		{
+			"SwitchRelease",
+			"POST",
+			"/api/releases/{namespace}/{releaseId}/switch",
+			handlers.SwitchRelease,
+		},
+		{
+			"SwitchBackRelease",
+			"POST",
+			"/api/releases/{namespace}/{releaseId}/switch-back",
+			handlers.SwitchBackRelease,
+		},
+		{
+			"CreateReleaseDeployments",
+			"POST",
+			"/api/releases/{namespace}/{releaseId}/deployments",
+			handlers.CreateReleaseDeployments,
+		},
+		{
+			"ApproveRelease",
+			"POST",
+			"/api/releases/{namespace}/{releaseId}/approve",
+			handlers.ApproveRelease,
+		},
+		{
+			"RejectRelease",
+			"POST",
+			"/api/releases/{namespace}/{releaseId}/reject",
+			handlers.RejectRelease,
+		},
+		{
+			"ReleaseHistory",
+			"GET",
+			"/api/releases/{namespace}/{releaseId}/history",
+			handlers.ReleaseHistory,
+		},
+		{
+			"ReleasePropagation",
+			"GET",
+			"/api/releases/{namespace}/{releaseId}/propagation",
+			handlers.ReleasePropagation,
+		},
+		{
+			"ListScheduledActions",
+			"GET",
+			"/api/scheduled-actions/{namespace}",
+			handlers.ListScheduledActions,
+		},
+		{
+			"ScheduleAction",
+			"POST",
+			"/api/scheduled-actions/{namespace}",
+			handlers.ScheduleAction,
+		},
+		{
+			"CancelScheduledAction",
+			"DELETE",
+			"/api/scheduled-actions/{namespace}/{actionId}",
+			handlers.CancelScheduledAction,
+		},
+		{
+			"ListMaintenanceWindows",
+			"GET",
+			"/api/maintenance-windows/{namespace}",
+			handlers.ListMaintenanceWindows,
+		},
+		{
+			"CreateMaintenanceWindow",
+			"POST",
+			"/api/maintenance-windows/{namespace}",
+			handlers.CreateMaintenanceWindow,
+		},
+		{
+			"DeleteMaintenanceWindow",
+			"DELETE",
+			"/api/maintenance-windows/{namespace}/{windowId}",
+			handlers.DeleteMaintenanceWindow,
+		},
+		{
+			"ListExperiments",
+			"GET",
+			"/api/experiments/{namespace}",
+			handlers.ListExperiments,
+		},
+		{
+			"CreateExperiment",
+			"POST",
+			"/api/experiments/{namespace}",
+			handlers.CreateExperiment,
+		},
+		{
+			"DeleteExperiment",
+			"DELETE",
+			"/api/experiments/{namespace}/{experimentId}",
+			handlers.DeleteExperiment,
+		},
+		{
+			"WatchNamespace",
+			"GET",
+			"/api/watch/{namespace}",
+			handlers.WatchNamespace,
+		},
 		{
 			"ListTrafficSegments",
 			"GET",
@@ -68,10 +212,28 @@ func NewRoutes() (r *Routes) {
 		},
 		{
 			"CreateTrafficSegment",
-			"GET",
-			"/api/traffic-segments/{namespace}/{releaseId}",
+			"POST",
+			"/api/traffic-segments/{namespace}",
 			handlers.CreateTrafficSegment,
 		},
+		{
+			"GetTrafficSegment",
+			"GET",
+			"/api/traffic-segments/{namespace}/{segmentId}",
+			handlers.GetTrafficSegment,
+		},
+		{
+			"UpdateTrafficSegment",
+			"PUT",
+			"/api/traffic-segments/{namespace}/{segmentId}",
+			handlers.UpdateTrafficSegment,
+		},
+		{
+			"DeleteTrafficSegment",
+			"DELETE",
+			"/api/traffic-segments/{namespace}/{segmentId}",
+			handlers.DeleteTrafficSegment,
+		},
 	}
 
 	return
@@ -105,7 +105,7 @@ func kubernetesVersion() (*ProductInfo, error) {
 	return nil, err
 }
 func getService(namespace string, service string) (*v1.ServiceSpec, error) {
-	client, err := kubernetes.NewClient()
+	client, err := kubernetes.GetClient()
 	if err != nil {
 		return nil, err
 	}